@@ -0,0 +1,251 @@
+package bot
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"ss_ref_bot/sheets"
+)
+
+// accrualState - этап начисления бонуса по сделке
+type accrualState string
+
+const (
+	accrualStarted  accrualState = "started"  // бонус рассчитан, в хранилище еще ничего не записано
+	accrualRecorded accrualState = "recorded" // запись в Рефералы создана, бонус рефоводу еще не добавлен
+	accrualDone     accrualState = "done"     // бонус добавлен к ожидающей выплате
+)
+
+// accrual - начисление бонуса рефоводу по одной сделке на одном уровне цепочки
+type accrual struct {
+	DealID     string           `json:"deal_id"`
+	Level      int              `json:"level,omitempty"` // 0 в старых записях журнала - первый уровень
+	State      accrualState     `json:"state"`
+	ReferrerID int64            `json:"referrer_id"`
+	Referral   *sheets.Referral `json:"referral"`
+}
+
+// key - ключ начисления в журнале: по сделке бывает по начислению на каждый уровень
+func (a accrual) key() string {
+	if a.Level <= 1 {
+		return a.DealID
+	}
+	return fmt.Sprintf("%s:%d", a.DealID, a.Level)
+}
+
+// accrualJournal хранит незавершенные начисления. Каждый этап дописывается в файл
+// до перехода к следующему, поэтому после сбоя начисление можно довести до конца,
+// не потеряв бонус и не начислив его дважды.
+type accrualJournal struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	pending map[string]accrual // ключ начисления -> последнее состояние
+}
+
+// openAccrualJournal загружает незавершенные начисления и оставляет в файле только их.
+// Пустой путь - журнал только в памяти.
+func openAccrualJournal(path string) (*accrualJournal, error) {
+	j := &accrualJournal{path: path, pending: make(map[string]accrual)}
+	if path == "" {
+		return j, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("ошибка открытия журнала начислений: %w", err)
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var a accrual
+			if err := json.Unmarshal(scanner.Bytes(), &a); err != nil {
+				// Последняя строка могла оборваться при падении - пропускаем ее
+				log.Printf("⚠️ Пропуск поврежденной записи журнала начислений: %v", err)
+				continue
+			}
+			if a.State == accrualDone {
+				delete(j.pending, a.key())
+			} else {
+				j.pending[a.key()] = a
+			}
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("ошибка чтения журнала начислений: %w", err)
+		}
+	}
+
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// record сохраняет новое состояние начисления
+func (j *accrualJournal) record(a accrual) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file != nil {
+		line, err := json.Marshal(a)
+		if err != nil {
+			return fmt.Errorf("ошибка сериализации начисления: %w", err)
+		}
+		if _, err := j.file.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("ошибка записи журнала начислений: %w", err)
+		}
+		if err := j.file.Sync(); err != nil {
+			return fmt.Errorf("ошибка сохранения журнала начислений: %w", err)
+		}
+	}
+
+	if a.State == accrualDone {
+		delete(j.pending, a.key())
+	} else {
+		j.pending[a.key()] = a
+	}
+	return nil
+}
+
+// has сообщает, есть ли незавершенное начисление по сделке на любом уровне
+func (j *accrualJournal) has(dealID string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, a := range j.pending {
+		if a.DealID == dealID {
+			return true
+		}
+	}
+	return false
+}
+
+// unfinished возвращает незавершенные начисления
+func (j *accrualJournal) unfinished() []accrual {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	result := make([]accrual, 0, len(j.pending))
+	for _, a := range j.pending {
+		result = append(result, a)
+	}
+	return result
+}
+
+// compact атомарно перезаписывает файл журнала только незавершенными начислениями
+func (j *accrualJournal) compact() error {
+	tmpPath := j.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("ошибка создания журнала начислений: %w", err)
+	}
+
+	for _, a := range j.pending {
+		line, err := json.Marshal(a)
+		if err != nil {
+			tmp.Close()
+			return fmt.Errorf("ошибка сериализации начисления: %w", err)
+		}
+		if _, err := tmp.Write(append(line, '\n')); err != nil {
+			tmp.Close()
+			return fmt.Errorf("ошибка записи журнала начислений: %w", err)
+		}
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("ошибка сохранения журнала начислений: %w", err)
+	}
+	tmp.Close()
+
+	if err := os.Rename(tmpPath, j.path); err != nil {
+		return fmt.Errorf("ошибка замены журнала начислений: %w", err)
+	}
+
+	file, err := os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("ошибка открытия журнала начислений: %w", err)
+	}
+	j.file = file
+	return nil
+}
+
+// applyAccrual доводит начисление до конца, начиная с этапа, на котором оно остановилось
+func (b *Bot) applyAccrual(a accrual) error {
+	if a.State == "" {
+		a.State = accrualStarted
+		if err := b.accruals.record(a); err != nil {
+			return err
+		}
+	}
+
+	referral := a.Referral
+
+	// Шаг 1: Создаем запись в Рефералы (если она не успела создаться до сбоя)
+	if a.State == accrualStarted {
+		exists, err := b.store.HasReferral(a.DealID, a.Level)
+		if err != nil {
+			return fmt.Errorf("ошибка проверки сделки в Рефералы: %w", err)
+		}
+
+		if exists {
+			log.Printf("Запись о сделке %s (уровень %d) уже есть в Рефералы, продолжаем начисление", a.DealID, referral.Level)
+		} else {
+			if err := b.store.CreateReferral(referral); err != nil {
+				return fmt.Errorf("ошибка создания записи в Рефералы: %w", err)
+			}
+			log.Printf("✅ Запись создана в Рефералы: RefID=%d, RefCode=%s, DealID=%s, Bonus=%s",
+				referral.RefID, referral.RefCode, referral.DealID, referral.Bonus)
+		}
+
+		a.State = accrualRecorded
+		if err := b.accruals.record(a); err != nil {
+			return err
+		}
+	}
+
+	// Шаг 2: Фиксируем начисление в Журнале. ID записи задается сделкой и уровнем,
+	// поэтому повтор после сбоя не создаст вторую запись.
+	reason := fmt.Sprintf("сделка реферала %d, ставка %s%%", referral.RefID, referral.Rate)
+	if a.Level > 1 {
+		reason += fmt.Sprintf(", уровень %d", a.Level)
+	}
+	entry := sheets.NewAccrualEntry(a.ReferrerID, referral.Bonus, a.DealID, a.Level, reason)
+	if err := b.store.AppendLedgerEntry(entry); err != nil {
+		return fmt.Errorf("ошибка записи начисления в Журнал: %w", err)
+	}
+
+	// Шаг 3: Пересчитываем ожидающую выплату рефовода по журналу. Бонус не прибавляется
+	// к текущему значению, поэтому повтор шага после сбоя не начислит его дважды.
+	ref, oldPayout, err := syncLedgerBalance(b.store, a.ReferrerID)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("✅ Рефовод обновлен: ID=%d, код=%s, ожидает выплаты: %s → %s USDT",
+		ref.ID, ref.Code, oldPayout, ref.PendingPayout)
+
+	a.State = accrualDone
+	return b.accruals.record(a)
+}
+
+// replayAccruals завершает начисления, прерванные сбоем или ошибкой хранилища
+func (b *Bot) replayAccruals() {
+	unfinished := b.accruals.unfinished()
+	if len(unfinished) == 0 {
+		return
+	}
+
+	log.Printf("Незавершенных начислений в журнале: %d, продолжаем их", len(unfinished))
+	for _, a := range unfinished {
+		if err := b.applyAccrual(a); err != nil {
+			log.Printf("❌ Не удалось завершить начисление по сделке %s (этап %s): %v", a.DealID, a.State, err)
+			continue
+		}
+		log.Printf("✅ Начисление по сделке %s завершено после сбоя", a.DealID)
+	}
+}
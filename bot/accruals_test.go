@@ -0,0 +1,89 @@
+package bot
+
+import (
+	"testing"
+
+	"ss_ref_bot/money"
+	"ss_ref_bot/sheets"
+)
+
+func TestReplayOfHalfAppliedAccrualCreditsOnce(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		credit bool // сбой после обновления рефовода, но до записи "done" в журнал начислений
+	}{
+		{name: "сбой до обновления рефовода"},
+		{name: "сбой после обновления рефовода", credit: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, store, _ := newTestBot(t)
+
+			ref, err := store.CreateReferrer(111, "@ref")
+			if err != nil {
+				t.Fatalf("CreateReferrer: %v", err)
+			}
+
+			bonus := money.FromFloat(2.5)
+			a := accrual{
+				DealID:     "D-1",
+				Level:      1,
+				State:      accrualRecorded,
+				ReferrerID: ref.ID,
+				Referral: &sheets.Referral{RefID: 1001, RefCode: ref.Code, Profit: 25 * money.USDT,
+					DealID: "D-1", Bonus: bonus, Date: "01.01.2025 10:00", Level: 1},
+			}
+
+			// Шаги 1 и 2 прошли до сбоя: запись в Рефералы и начисление в Журнале уже есть
+			if err := store.CreateReferral(a.Referral); err != nil {
+				t.Fatalf("CreateReferral: %v", err)
+			}
+			if err := store.AppendLedgerEntry(sheets.NewAccrualEntry(ref.ID, bonus, "D-1", 1, "сделка")); err != nil {
+				t.Fatalf("AppendLedgerEntry: %v", err)
+			}
+			if tc.credit {
+				if _, err := store.ModifyReferrer(ref.ID, func(r *sheets.Referrer) error {
+					r.PendingPayout += bonus
+					return nil
+				}); err != nil {
+					t.Fatalf("ModifyReferrer: %v", err)
+				}
+			}
+			if err := b.accruals.record(a); err != nil {
+				t.Fatalf("record: %v", err)
+			}
+
+			// Перезапуск: журнал начислений читается заново, незавершенное начисление доводится дважды
+			for run := 1; run <= 2; run++ {
+				accruals, err := openAccrualJournal(b.accruals.path)
+				if err != nil {
+					t.Fatalf("openAccrualJournal: %v", err)
+				}
+				b.accruals = accruals
+				if run == 2 {
+					// Повтор того же этапа, например после ошибки записи "done"
+					if err := b.applyAccrual(a); err != nil {
+						t.Fatalf("applyAccrual: %v", err)
+					}
+				} else {
+					b.replayAccruals()
+				}
+
+				got, err := store.GetReferrerByID(ref.ID)
+				if err != nil {
+					t.Fatalf("GetReferrerByID: %v", err)
+				}
+				if got.PendingPayout != bonus {
+					t.Errorf("запуск %d: ожидает выплаты = %s, ожидалось %s (одно начисление)", run, got.PendingPayout, bonus)
+				}
+			}
+
+			if len(b.accruals.unfinished()) != 0 {
+				t.Errorf("незавершенные начисления после повтора: %+v", b.accruals.unfinished())
+			}
+			entries, _ := store.LedgerEntries(ref.ID)
+			if len(entries) != 1 {
+				t.Errorf("записей журнала %d, ожидалась 1", len(entries))
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+
+	"ss_ref_bot/config"
+	"ss_ref_bot/sheets"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Префиксы данных inline-кнопок заявки на выплату; после двоеточия - ID заявки
+const (
+	callbackApprove = "payout_approve"
+	callbackReject  = "payout_reject"
+)
+
+// pendingRejection - заявка, по которой администратор должен прислать причину отказа
+type pendingRejection struct {
+	requestID string
+	chatID    int64
+	messageID int // сообщение с заявкой в чате администраторов
+}
+
+// notifyAdmins отправляет новую заявку в чат администраторов с кнопками решения
+func (b *Bot) notifyAdmins(req *sheets.PayoutRequest) {
+	if config.AppConfig.AdminChatID == 0 {
+		return
+	}
+
+	msg := tgbotapi.NewMessage(config.AppConfig.AdminChatID, payoutRequestAdminText(req))
+	msg.ParseMode = tgbotapi.ModeHTML
+	msg.DisableWebPagePreview = true
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Одобрить", callbackApprove+":"+req.ID),
+			tgbotapi.NewInlineKeyboardButtonData("❌ Отклонить", callbackReject+":"+req.ID),
+		),
+	)
+	if _, err := b.api.Send(msg); err != nil {
+		log.Printf("❌ Ошибка отправки заявки %s в чат администраторов: %v", req.ID, err)
+	}
+}
+
+// payoutRequestAdminText - текст заявки для чата администраторов
+func payoutRequestAdminText(req *sheets.PayoutRequest) string {
+	text := fmt.Sprintf(
+		"<b>💰 Заявка на выплату %s</b>\n\n"+
+			"<b>Рефовод:</b> %s (ID %d)\n"+
+			"<b>Сумма:</b> %s USDT\n"+
+			"<b>Кошелёк:</b> <code>%s</code>\n"+
+			"<b>Дата:</b> %s",
+		req.ID, html.EscapeString(req.Username), req.ReferrerID, req.Amount,
+		html.EscapeString(req.Wallet), req.Time.Format("02.01.2006 15:04"))
+
+	switch req.Status {
+	case sheets.PayoutRequested:
+		return text
+	case sheets.PayoutApproved:
+		text += "\n\n✅ <b>Одобрена</b>"
+	case sheets.PayoutExported:
+		text += fmt.Sprintf("\n\n✅ <b>Одобрена, выгружена %s</b>", html.EscapeString(req.ExportID))
+	case sheets.PayoutRejected:
+		text += "\n\n❌ <b>Отклонена</b>"
+	default:
+		return text + fmt.Sprintf("\n\n<b>Статус:</b> %s", html.EscapeString(string(req.Status)))
+	}
+
+	if req.ReviewedBy != "" {
+		text += ", " + html.EscapeString(req.ReviewedBy)
+	}
+	if !req.ReviewedAt.IsZero() {
+		text += ", " + req.ReviewedAt.Format("02.01.2006 15:04")
+	}
+	if req.Reason != "" {
+		text += "\n<b>Причина:</b> " + html.EscapeString(req.Reason)
+	}
+	return text
+}
+
+// isAdmin сообщает, может ли пользователь рассматривать заявки (ADMIN_USER_IDS)
+func isAdmin(userID int64) bool {
+	for _, id := range config.AppConfig.AdminUserIDs {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// reviewerName - как записать администратора, рассмотревшего заявку
+func reviewerName(user *tgbotapi.User) string {
+	if user.UserName != "" {
+		return "@" + user.UserName
+	}
+	return fmt.Sprintf("%d", user.ID)
+}
+
+// handleCallback обрабатывает нажатия inline-кнопок заявок на выплату
+func (b *Bot) handleCallback(cb *tgbotapi.CallbackQuery) {
+	log.Printf("Нажатие кнопки от %d (@%s): %s", cb.From.ID, cb.From.UserName, cb.Data)
+
+	action, requestID, ok := strings.Cut(cb.Data, ":")
+	if !ok || (action != callbackApprove && action != callbackReject) {
+		b.answerCallback(cb, "")
+		return
+	}
+
+	// Решения принимаются только в чате администраторов
+	if config.AppConfig.AdminChatID == 0 || cb.Message == nil || cb.Message.Chat.ID != config.AppConfig.AdminChatID {
+		log.Printf("⚠️ Нажатие кнопки заявки %s вне чата администраторов от %d", requestID, cb.From.ID)
+		b.answerCallback(cb, "Недостаточно прав")
+		return
+	}
+	if !isAdmin(cb.From.ID) {
+		log.Printf("⚠️ Нажатие кнопки заявки %s пользователем %d не из ADMIN_USER_IDS", requestID, cb.From.ID)
+		b.answerCallback(cb, "Недостаточно прав")
+		return
+	}
+
+	if action == callbackApprove {
+		b.approvePayout(cb, requestID)
+		return
+	}
+
+	b.mu.Lock()
+	b.waitingForReason[cb.From.ID] = pendingRejection{
+		requestID: requestID,
+		chatID:    cb.Message.Chat.ID,
+		messageID: cb.Message.MessageID,
+	}
+	b.mu.Unlock()
+
+	b.answerCallback(cb, "Напишите причину отказа")
+
+	// В группе бот видит только ответы на свои сообщения, поэтому просим ответить на это
+	msg := tgbotapi.NewMessage(cb.Message.Chat.ID, fmt.Sprintf(
+		"%s, напишите причину отказа по заявке %s ответом на это сообщение (/cancel - не отклонять).",
+		reviewerName(cb.From), requestID))
+	msg.ReplyMarkup = tgbotapi.ForceReply{ForceReply: true, Selective: true}
+	if _, err := b.api.Send(msg); err != nil {
+		log.Printf("Ошибка отправки запроса причины отказа: %v", err)
+	}
+}
+
+// approvePayout одобряет заявку: выплата записывается в Журнал, сумма переходит
+// из "Ожидает выплаты" в "Выплачено", рефовод получает уведомление
+func (b *Bot) approvePayout(cb *tgbotapi.CallbackQuery, requestID string) {
+	reviewer := reviewerName(cb.From)
+
+	req, err := approvePayoutRequest(b.store, requestID, reviewer)
+	switch {
+	case errors.Is(err, sheets.ErrPayoutRequestResolved):
+		b.answerCallback(cb, fmt.Sprintf("Заявка уже рассмотрена: %s", req.Status))
+		b.editAdminMessage(cb.Message.Chat.ID, cb.Message.MessageID, req)
+		return
+	case errors.Is(err, errPayoutUnavailable):
+		log.Printf("⚠️ Заявка %s не одобрена: %v", requestID, err)
+		b.answerCallback(cb, "Недостаточно средств")
+		b.sendMessage(cb.Message.Chat.ID, fmt.Sprintf(
+			"⚠️ Заявка %s не одобрена: %v. Заявка осталась в статусе \"%s\" - отклоните ее, рефовод сможет создать новую.",
+			requestID, err, sheets.PayoutRequested))
+		return
+	case errors.Is(err, errPayoutNotRecorded):
+		log.Printf("❌ Заявка %s не одобрена: %v", requestID, err)
+		b.answerCallback(cb, "Ошибка, попробуйте позже")
+		text := fmt.Sprintf("⚠️ Заявка %s не одобрена: выплату не удалось записать в Журнал, рефовод не уведомлен.", requestID)
+		if req != nil && req.Status == sheets.PayoutRequested {
+			text += fmt.Sprintf(" Заявка осталась в статусе \"%s\" - одобрите ее позже.", sheets.PayoutRequested)
+		} else {
+			text += fmt.Sprintf(" Одобрение отменить не удалось: верните заявке статус \"%s\" в листе вручную.", sheets.PayoutRequested)
+		}
+		b.sendMessage(cb.Message.Chat.ID, text)
+		return
+	case err != nil:
+		log.Printf("❌ Ошибка одобрения заявки %s: %v", requestID, err)
+		b.answerCallback(cb, "Ошибка, попробуйте позже")
+		return
+	}
+
+	log.Printf("💰 Заявка %s одобрена (%s): рефовод %d, %s USDT на %s", req.ID, reviewer, req.ReferrerID, req.Amount, req.Wallet)
+
+	b.answerCallback(cb, "Заявка одобрена")
+	b.editAdminMessage(cb.Message.Chat.ID, cb.Message.MessageID, req)
+
+	b.sendHTMLMessage(req.ReferrerID, fmt.Sprintf(
+		"<b>✅ Заявка на выплату одобрена</b>\n\n"+
+			"<b>Номер:</b> %s\n"+
+			"<b>Сумма:</b> %s USDT\n"+
+			"<b>Кошелёк:</b> %s",
+		req.ID, req.Amount, req.Wallet))
+}
+
+// handleRejectReason принимает причину отказа от администратора, нажавшего "Отклонить".
+// Возвращает true, если сообщение обработано.
+func (b *Bot) handleRejectReason(msg *tgbotapi.Message) bool {
+	b.mu.Lock()
+	pending, ok := b.waitingForReason[msg.From.ID]
+	if ok && pending.chatID == msg.Chat.ID {
+		delete(b.waitingForReason, msg.From.ID)
+	}
+	b.mu.Unlock()
+
+	if !ok || pending.chatID != msg.Chat.ID {
+		return false
+	}
+
+	if msg.IsCommand() {
+		b.sendMessage(msg.Chat.ID, fmt.Sprintf("Отклонение заявки %s отменено.", pending.requestID))
+		return true
+	}
+
+	reason := strings.TrimSpace(msg.Text)
+	if reason == "" {
+		b.mu.Lock()
+		b.waitingForReason[msg.From.ID] = pending
+		b.mu.Unlock()
+		b.sendMessage(msg.Chat.ID, "Напишите причину отказа текстом.")
+		return true
+	}
+
+	b.rejectPayout(pending, reviewerName(msg.From), reason)
+	return true
+}
+
+// rejectPayout отклоняет заявку: сумма снова доступна к выплате, рефовод получает причину отказа
+func (b *Bot) rejectPayout(pending pendingRejection, reviewer, reason string) {
+	req, err := b.store.ResolvePayoutRequest(pending.requestID, sheets.PayoutRejected, reviewer, reason)
+	if errors.Is(err, sheets.ErrPayoutRequestResolved) {
+		b.sendMessage(pending.chatID, fmt.Sprintf("Заявка %s уже рассмотрена: %s", req.ID, req.Status))
+		b.editAdminMessage(pending.chatID, pending.messageID, req)
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Ошибка отклонения заявки %s: %v", pending.requestID, err)
+		b.sendMessage(pending.chatID, "Произошла ошибка. Попробуйте позже.")
+		return
+	}
+
+	log.Printf("Заявка %s отклонена (%s): рефовод %d, %s USDT, причина: %s", req.ID, reviewer, req.ReferrerID, req.Amount, reason)
+
+	b.editAdminMessage(pending.chatID, pending.messageID, req)
+	b.sendMessage(pending.chatID, fmt.Sprintf("Заявка %s отклонена, рефовод уведомлен.", req.ID))
+
+	b.sendHTMLMessage(req.ReferrerID, fmt.Sprintf(
+		"<b>❌ Заявка на выплату отклонена</b>\n\n"+
+			"<b>Номер:</b> %s\n"+
+			"<b>Сумма:</b> %s USDT\n"+
+			"<b>Причина:</b> %s\n\n"+
+			"Сумма снова доступна к выплате.",
+		req.ID, req.Amount, html.EscapeString(reason)))
+}
+
+// editAdminMessage показывает решение в сообщении с заявкой и убирает кнопки
+func (b *Bot) editAdminMessage(chatID int64, messageID int, req *sheets.PayoutRequest) {
+	edit := tgbotapi.NewEditMessageText(chatID, messageID, payoutRequestAdminText(req))
+	edit.ParseMode = tgbotapi.ModeHTML
+	edit.DisableWebPagePreview = true
+	if _, err := b.api.Send(edit); err != nil {
+		log.Printf("Ошибка обновления сообщения с заявкой %s: %v", req.ID, err)
+	}
+}
+
+// answerCallback подтверждает нажатие кнопки, text показывается всплывающим уведомлением
+func (b *Bot) answerCallback(cb *tgbotapi.CallbackQuery, text string) {
+	if _, err := b.api.Request(tgbotapi.NewCallback(cb.ID, text)); err != nil {
+		log.Printf("Ошибка ответа на нажатие кнопки: %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"ss_ref_bot/config"
+	"ss_ref_bot/money"
+	"ss_ref_bot/sheets"
+	"ss_ref_bot/sqlite"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	testAdminChatID = -100
+	testAdminUserID = 42
+)
+
+// setTestAdmins включает чат администраторов testAdminChatID с администратором testAdminUserID
+func setTestAdmins() {
+	config.AppConfig.AdminChatID = testAdminChatID
+	config.AppConfig.AdminUserIDs = []int64{testAdminUserID}
+}
+
+// newPayoutFixture создает рефовода с начислением 20 USDT и заявкой на всю сумму
+func newPayoutFixture(t *testing.T) (*Bot, *sqlite.SQLiteStore, *fakeTelegram, *sheets.PayoutRequest) {
+	t.Helper()
+
+	b, store, tg := newTestBot(t)
+	setTestAdmins()
+	ref := newFundedReferrer(t, store, "UQ-test")
+
+	req := sheets.NewPayoutRequest(ref, 20*money.USDT)
+	if err := store.CreatePayoutRequest(&req); err != nil {
+		t.Fatalf("CreatePayoutRequest: %v", err)
+	}
+	return b, store, tg, &req
+}
+
+// pressButton нажимает кнопку заявки в чате администраторов от имени пользователя
+func pressButton(b *Bot, userID int64, data string) {
+	b.handleCallback(&tgbotapi.CallbackQuery{
+		ID:      "cb",
+		From:    &tgbotapi.User{ID: userID, UserName: "admin"},
+		Message: &tgbotapi.Message{MessageID: 7, Chat: &tgbotapi.Chat{ID: testAdminChatID}},
+		Data:    data,
+	})
+}
+
+// payoutState возвращает статус заявки, остаток рефовода и число выплат в Журнале
+func payoutState(t *testing.T, store *sqlite.SQLiteStore, req *sheets.PayoutRequest) (sheets.PayoutStatus, *sheets.Referrer, int) {
+	t.Helper()
+
+	requests, err := store.GetPayoutRequests()
+	if err != nil {
+		t.Fatalf("GetPayoutRequests: %v", err)
+	}
+	var status sheets.PayoutStatus
+	for _, r := range requests {
+		if r.ID == req.ID {
+			status = r.Status
+		}
+	}
+
+	ref, err := store.GetReferrerByID(req.ReferrerID)
+	if err != nil {
+		t.Fatalf("GetReferrerByID: %v", err)
+	}
+
+	entries, err := store.LedgerEntries(req.ReferrerID)
+	if err != nil {
+		t.Fatalf("LedgerEntries: %v", err)
+	}
+	var payouts int
+	for _, e := range entries {
+		if e.Type == sheets.EntryPayout {
+			payouts++
+		}
+	}
+	return status, ref, payouts
+}
+
+func TestApprovePayout(t *testing.T) {
+	b, store, _, req := newPayoutFixture(t)
+
+	// Повторное нажатие не выплачивает второй раз
+	for i := 0; i < 2; i++ {
+		pressButton(b, testAdminUserID, callbackApprove+":"+req.ID)
+	}
+
+	status, ref, payouts := payoutState(t, store, req)
+	if status != sheets.PayoutApproved {
+		t.Errorf("статус заявки %s, ожидалось %s", status, sheets.PayoutApproved)
+	}
+	if payouts != 1 {
+		t.Errorf("выплат в Журнале %d, ожидалась 1", payouts)
+	}
+	if ref.PendingPayout != 0 || ref.PaidOut != 20*money.USDT {
+		t.Errorf("ожидает выплаты %s, выплачено %s; ожидалось 0 и 20", ref.PendingPayout, ref.PaidOut)
+	}
+}
+
+func TestApprovePayoutRequiresAdminUser(t *testing.T) {
+	b, store, _, req := newPayoutFixture(t)
+
+	// Участник чата администраторов, которого нет в ADMIN_USER_IDS
+	pressButton(b, testAdminUserID+1, callbackApprove+":"+req.ID)
+	pressButton(b, testAdminUserID+1, callbackReject+":"+req.ID)
+
+	status, ref, payouts := payoutState(t, store, req)
+	if status != sheets.PayoutRequested || payouts != 0 || ref.PendingPayout != 20*money.USDT {
+		t.Errorf("статус %s, выплат %d, ожидает выплаты %s; заявка не должна рассматриваться", status, payouts, ref.PendingPayout)
+	}
+	if len(b.waitingForReason) != 0 {
+		t.Errorf("бот ждет причину отказа от пользователя не из ADMIN_USER_IDS")
+	}
+}
+
+func TestApprovePayoutRechecksBalance(t *testing.T) {
+	b, store, tg, req := newPayoutFixture(t)
+
+	// После создания заявки часть бонуса списана
+	clawback := sheets.NewLedgerEntry(sheets.EntryClawback, req.ReferrerID, 5*money.USDT, "D-1", "сделка D-1 отменена")
+	if err := store.AppendLedgerEntry(clawback); err != nil {
+		t.Fatalf("AppendLedgerEntry: %v", err)
+	}
+
+	pressButton(b, testAdminUserID, callbackApprove+":"+req.ID)
+
+	status, _, payouts := payoutState(t, store, req)
+	if status != sheets.PayoutRequested || payouts != 0 {
+		t.Errorf("статус %s, выплат %d; заявка больше остатка не должна одобряться", status, payouts)
+	}
+
+	var warned bool
+	for _, msg := range tg.sent("sendMessage") {
+		if strings.Contains(msg.Params["text"], "не одобрена") && strings.Contains(msg.Params["text"], "доступно 15.00 USDT") {
+			warned = true
+		}
+	}
+	if !warned {
+		t.Errorf("администраторам не сообщили о нехватке средств: %+v", tg.sent("sendMessage"))
+	}
+}
+
+// failingLedgerStore отклоняет первые failures записей о выплате в Журнал
+type failingLedgerStore struct {
+	*sqlite.SQLiteStore
+	failures int
+}
+
+func (s *failingLedgerStore) AppendLedgerEntry(entry sheets.LedgerEntry) error {
+	if entry.Type == sheets.EntryPayout && s.failures > 0 {
+		s.failures--
+		return errors.New("квота исчерпана")
+	}
+	return s.SQLiteStore.AppendLedgerEntry(entry)
+}
+
+func TestApprovePayoutRetriesLedgerEntry(t *testing.T) {
+	b, store, tg, req := newPayoutFixture(t)
+	noPayoutRetryDelay(t)
+	b.store = &failingLedgerStore{SQLiteStore: store, failures: payoutEntryAttempts - 1}
+
+	pressButton(b, testAdminUserID, callbackApprove+":"+req.ID)
+
+	status, ref, payouts := payoutState(t, store, req)
+	if status != sheets.PayoutApproved || payouts != 1 || ref.PendingPayout != 0 {
+		t.Errorf("статус %s, выплат %d, ожидает выплаты %s; ожидалось одобрение после повтора", status, payouts, ref.PendingPayout)
+	}
+	if notices := sentTo(tg, req.ReferrerID); len(notices) != 1 {
+		t.Errorf("уведомлений рефоводу %d, ожидалось 1", len(notices))
+	}
+}
+
+func TestApprovePayoutIsRevertedWithoutLedgerEntry(t *testing.T) {
+	b, store, tg, req := newPayoutFixture(t)
+	noPayoutRetryDelay(t)
+	b.store = &failingLedgerStore{SQLiteStore: store, failures: payoutEntryAttempts}
+
+	pressButton(b, testAdminUserID, callbackApprove+":"+req.ID)
+
+	// Заявка снова ждет решения, остаток не изменился, рефовод ничего не получил
+	status, ref, payouts := payoutState(t, store, req)
+	if status != sheets.PayoutRequested || payouts != 0 || ref.PendingPayout != 20*money.USDT {
+		t.Errorf("статус %s, выплат %d, ожидает выплаты %s; одобрение должно быть отменено", status, payouts, ref.PendingPayout)
+	}
+	if notices := sentTo(tg, req.ReferrerID); len(notices) != 0 {
+		t.Errorf("рефовод уведомлен об одобрении без выплаты в Журнале: %+v", notices)
+	}
+
+	// После восстановления Журнала заявку можно одобрить
+	pressButton(b, testAdminUserID, callbackApprove+":"+req.ID)
+	if status, _, payouts := payoutState(t, store, req); status != sheets.PayoutApproved || payouts != 1 {
+		t.Errorf("повторное одобрение: статус %s, выплат %d", status, payouts)
+	}
+}
+
+// noPayoutRetryDelay убирает паузу между попытками записи выплаты на время теста
+func noPayoutRetryDelay(t *testing.T) {
+	delay := payoutEntryRetryDelay
+	payoutEntryRetryDelay = 0
+	t.Cleanup(func() { payoutEntryRetryDelay = delay })
+}
+
+// sentTo возвращает сообщения, отправленные в чат chatID
+func sentTo(tg *fakeTelegram, chatID int64) []sentRequest {
+	var result []sentRequest
+	for _, msg := range tg.sent("sendMessage") {
+		if msg.Params["chat_id"] == fmt.Sprintf("%d", chatID) {
+			result = append(result, msg)
+		}
+	}
+	return result
+}
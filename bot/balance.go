@@ -0,0 +1,143 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"ss_ref_bot/money"
+	"ss_ref_bot/sheets"
+)
+
+// balanceMu сериализует пересчет остатков: иначе пересчет по устаревшему чтению журнала
+// мог бы перезаписать более новый остаток. Под ним же проверяется остаток при одобрении
+// выплаты и выполняются списания, чтобы списание не прошло между проверкой и выплатой.
+var balanceMu sync.Mutex
+
+var (
+	// errPayoutUnavailable - сумма заявки больше доступного остатка (например, после списания)
+	errPayoutUnavailable = errors.New("сумма заявки больше доступного остатка")
+	// errPayoutNotRecorded - выплата не записана в Журнал, одобрение заявки отменено
+	errPayoutNotRecorded = errors.New("выплата не записана в Журнал")
+)
+
+// payoutEntryAttempts - сколько раз пробуем записать выплату в Журнал после одобрения заявки.
+// ID записи задан заявкой, поэтому повтор не создаст вторую выплату.
+const payoutEntryAttempts = 3
+
+// payoutEntryRetryDelay - пауза между попытками записать выплату
+var payoutEntryRetryDelay = 2 * time.Second
+
+// syncLedgerBalance записывает в рефовода остаток по журналу: "Ожидает выплаты" и "Выплачено" -
+// проекция журнала, а не счетчики. Поэтому повтор после сбоя (запись в журнале уже есть,
+// рефовод еще не обновлен или уже обновлен) не изменит остаток дважды.
+// Возвращает обновленного рефовода и прежнюю сумму к выплате.
+func syncLedgerBalance(store Store, referrerID int64) (*sheets.Referrer, money.Amount, error) {
+	balanceMu.Lock()
+	defer balanceMu.Unlock()
+	return syncLedgerBalanceLocked(store, referrerID)
+}
+
+// syncLedgerBalanceLocked - syncLedgerBalance для вызова под balanceMu
+func syncLedgerBalanceLocked(store Store, referrerID int64) (*sheets.Referrer, money.Amount, error) {
+	entries, err := store.LedgerEntries(referrerID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("ошибка чтения журнала: %w", err)
+	}
+
+	var balance sheets.LedgerBalance
+	for _, e := range entries {
+		balance.Apply(e)
+	}
+
+	var oldPending money.Amount
+	ref, err := store.ModifyReferrer(referrerID, func(r *sheets.Referrer) error {
+		oldPending = r.PendingPayout
+		r.PendingPayout = balance.Pending()
+		r.PaidOut = balance.Paid
+		return nil
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("ошибка обновления рефовода: %w", err)
+	}
+	return ref, oldPending, nil
+}
+
+// approvePayoutRequest одобряет заявку в статусе "ожидает" и записывает выплату в Журнал.
+// Перед решением остаток рефовода заново считается по Журналу (с учетом удержания): если
+// после создания заявки по сделкам были списания и сумма больше доступной, заявка не
+// одобряется и остается в статусе "ожидает" (ошибка errPayoutUnavailable).
+// Если заявку уже рассмотрели, возвращает ее вместе с sheets.ErrPayoutRequestResolved.
+// Если выплату не удалось записать в Журнал, одобрение отменяется (заявка снова "ожидает"):
+// иначе остаток при пересчете вернулся бы к прежнему, и ту же сумму можно было бы запросить
+// повторно, пока одобренная заявка ждет выгрузки. Тогда возвращается ошибка errPayoutNotRecorded.
+func approvePayoutRequest(store Store, requestID, reviewer string) (*sheets.PayoutRequest, error) {
+	balanceMu.Lock()
+	defer balanceMu.Unlock()
+
+	requests, err := store.GetPayoutRequests()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения заявок на выплату: %w", err)
+	}
+	var req *sheets.PayoutRequest
+	for i := range requests {
+		if requests[i].ID == requestID {
+			req = &requests[i]
+			break
+		}
+	}
+	if req == nil {
+		return nil, fmt.Errorf("заявка %s не найдена", requestID)
+	}
+	if req.Status != sheets.PayoutRequested {
+		return req, sheets.ErrPayoutRequestResolved
+	}
+
+	// Сумма заявки в Журнал еще не записана, поэтому доступный остаток должен ее покрывать
+	entries, err := store.LedgerEntries(req.ReferrerID)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения журнала: %w", err)
+	}
+	if available := sheets.SplitHold(entries, holdPeriod(), time.Now()).Available; req.Amount > available {
+		return req, fmt.Errorf("%w: в заявке %s USDT, доступно %s USDT", errPayoutUnavailable, req.Amount, available)
+	}
+
+	req, err = store.ResolvePayoutRequest(requestID, sheets.PayoutApproved, reviewer, "")
+	if err != nil {
+		return req, err
+	}
+
+	entry := sheets.NewPayoutEntry(req, fmt.Sprintf("заявка %s, одобрил %s", req.ID, reviewer))
+	if err := appendPayoutEntry(store, entry); err != nil {
+		reopened, reopenErr := store.ReopenPayoutRequest(req.ID)
+		if reopenErr != nil {
+			log.Printf("❌ Заявка %s одобрена без выплаты в Журнале, и одобрение не отменено: %v", req.ID, reopenErr)
+			return req, fmt.Errorf("%w: %v; одобрение не отменено: %v", errPayoutNotRecorded, err, reopenErr)
+		}
+		return reopened, fmt.Errorf("%w: %v", errPayoutNotRecorded, err)
+	}
+
+	// "Ожидает выплаты" и "Выплачено" - проекция Журнала
+	if _, _, err := syncLedgerBalanceLocked(store, req.ReferrerID); err != nil {
+		// Выплата уже в Журнале: остаток будет пересчитан по нему при ближайшем обновлении
+		log.Printf("❌ Ошибка обновления рефовода %d после выплаты: %v", req.ReferrerID, err)
+	}
+	return req, nil
+}
+
+// appendPayoutEntry записывает выплату в Журнал, повторяя попытку при ошибке
+func appendPayoutEntry(store Store, entry sheets.LedgerEntry) error {
+	var err error
+	for attempt := 1; attempt <= payoutEntryAttempts; attempt++ {
+		if err = store.AppendLedgerEntry(entry); err == nil {
+			return nil
+		}
+		log.Printf("⚠️ Попытка %d из %d записать выплату %s в Журнал не удалась: %v", attempt, payoutEntryAttempts, entry.ID, err)
+		if attempt < payoutEntryAttempts {
+			time.Sleep(payoutEntryRetryDelay)
+		}
+	}
+	return err
+}
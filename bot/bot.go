@@ -1,6 +1,7 @@
 package bot
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"regexp"
@@ -16,14 +17,22 @@ import (
 
 type Bot struct {
 	api              *tgbotapi.BotAPI
-	sheets           *sheets.SheetsClient
+	store            Store
 	waitingForWallet map[int64]bool
+	waitingForReason map[int64]pendingRejection // администратор -> заявка, ожидающая причины отказа
 	mu               sync.RWMutex
+
+	// Журнал незавершенных начислений бонусов
+	accruals *accrualJournal
+
+	// absentDeals - сделка -> сколько синхронизаций подряд ее нет в листе Выводы.
+	// Используется только из цикла синхронизации; после перезапуска счет начинается заново.
+	absentDeals map[string]int
 }
 
 var walletRegex = regexp.MustCompile(`^(UQ|EQ)[A-Za-z0-9_-]{46}$`)
 
-func NewBot(token string, sheetsClient *sheets.SheetsClient) (*Bot, error) {
+func NewBot(token string, store Store) (*Bot, error) {
 	api, err := tgbotapi.NewBotAPI(token)
 	if err != nil {
 		return nil, fmt.Errorf("ошибка создания бота: %w", err)
@@ -31,10 +40,17 @@ func NewBot(token string, sheetsClient *sheets.SheetsClient) (*Bot, error) {
 
 	log.Printf("Авторизован как %s", api.Self.UserName)
 
+	accruals, err := openAccrualJournal(config.AppConfig.AccrualJournalPath)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Bot{
 		api:              api,
-		sheets:           sheetsClient,
+		store:            store,
 		waitingForWallet: make(map[int64]bool),
+		waitingForReason: make(map[int64]pendingRejection),
+		accruals:         accruals,
 	}, nil
 }
 
@@ -65,7 +81,12 @@ func (b *Bot) Start() error {
 }
 
 func (b *Bot) handleUpdate(update tgbotapi.Update) {
-	if update.Message == nil {
+	if update.CallbackQuery != nil {
+		b.handleCallback(update.CallbackQuery)
+		return
+	}
+
+	if update.Message == nil || update.Message.From == nil {
 		return
 	}
 
@@ -75,6 +96,23 @@ func (b *Bot) handleUpdate(update tgbotapi.Update) {
 
 	log.Printf("Сообщение от %d (@%s): %s", userID, username, msg.Text)
 
+	// Причина отказа по заявке на выплату
+	if b.handleRejectReason(msg) {
+		return
+	}
+
+	// Команды чата администраторов
+	if msg.Chat.ID == config.AppConfig.AdminChatID {
+		if msg.IsCommand() && msg.Command() == "export" {
+			b.handleExport(msg)
+			return
+		}
+		// В групповом чате меню не показываем
+		if !msg.Chat.IsPrivate() {
+			return
+		}
+	}
+
 	// Обработка команд
 	if msg.IsCommand() {
 		command := msg.Command()
@@ -91,6 +129,9 @@ func (b *Bot) handleUpdate(update tgbotapi.Update) {
 		case "wallet", "connect_wallet":
 			b.handleConnectWallet(msg, userID)
 			return
+		case "withdraw", "payout":
+			b.handlePayoutRequest(msg, userID)
+			return
 		default:
 			// Неизвестная команда - показываем меню
 			b.showMenu(msg.Chat.ID, "Неизвестная команда. Выберите действие из меню:")
@@ -114,7 +155,7 @@ func (b *Bot) handleUpdate(update tgbotapi.Update) {
 		// проверяем формат и предлагаем сохранить
 		if walletRegex.MatchString(strings.TrimSpace(msg.Text)) {
 			// Проверяем, есть ли у пользователя рефовод
-			ref, err := b.sheets.GetReferrerByID(userID)
+			ref, err := b.store.GetReferrerByID(userID)
 			if err == nil && ref != nil && ref.Wallet == "" {
 				b.sendMessage(msg.Chat.ID, "Обнаружен адрес кошелька. Используйте команду /wallet или кнопку 'Подключить TON-кошелёк' для его сохранения.")
 			}
@@ -132,6 +173,11 @@ func (b *Bot) handleUpdate(update tgbotapi.Update) {
 		return
 	}
 
+	if msg.Text == "Вывести" {
+		b.handlePayoutRequest(msg, userID)
+		return
+	}
+
 	if msg.Text == "Подключить TON-кошелёк" || msg.Text == "Изменить кошелек" {
 		b.handleConnectWallet(msg, userID)
 		return
@@ -151,7 +197,7 @@ func (b *Bot) handleStart(msg *tgbotapi.Message, userID int64, username string)
 	}
 
 	// Обычный /start
-	ref, err := b.sheets.GetReferrerByID(userID)
+	ref, err := b.store.GetReferrerByID(userID)
 	if err != nil {
 		log.Printf("Ошибка получения рефовода: %v", err)
 		b.sendMessage(msg.Chat.ID, "Произошла ошибка. Попробуйте позже.")
@@ -166,7 +212,7 @@ func (b *Bot) handleStart(msg *tgbotapi.Message, userID int64, username string)
 			return
 		}
 
-		ref, err = b.sheets.CreateReferrer(userID, "@"+username)
+		ref, err = b.store.CreateReferrer(userID, "@"+username)
 		if err != nil {
 			log.Printf("Ошибка создания рефовода: %v", err)
 			b.sendMessage(msg.Chat.ID, "Произошла ошибка при регистрации. Попробуйте позже.")
@@ -207,7 +253,7 @@ $1,2 - 100 звёзд</blockquote>
 
 func (b *Bot) handleReferralLink(msg *tgbotapi.Message, userID int64, username string, refCode string) {
 	// Проверяем, не привязан ли уже пользователь
-	invited, err := b.sheets.GetInvitedByUserID(userID)
+	invited, err := b.store.GetInvitedByUserID(userID)
 	if err != nil {
 		log.Printf("Ошибка проверки приглашенного: %v", err)
 		b.sendMessage(msg.Chat.ID, "Произошла ошибка. Попробуйте позже.")
@@ -222,7 +268,7 @@ func (b *Bot) handleReferralLink(msg *tgbotapi.Message, userID int64, username s
 	}
 
 	// Проверяем существование рефовода с таким кодом
-	ref, err := b.sheets.GetReferrerByCode(refCode)
+	ref, err := b.store.GetReferrerByCode(refCode)
 	if err != nil {
 		log.Printf("Ошибка получения рефовода по коду: %v", err)
 		b.sendMessage(msg.Chat.ID, "Произошла ошибка. Попробуйте позже.")
@@ -242,7 +288,13 @@ func (b *Bot) handleReferralLink(msg *tgbotapi.Message, userID int64, username s
 	}
 
 	// Создаем запись в Приглашенные
-	err = b.sheets.CreateInvited(userID, refCode)
+	err = b.store.CreateInvited(userID, refCode)
+	if errors.Is(err, sheets.ErrAlreadyInvited) {
+		// Пользователь успел привязаться в параллельном обновлении
+		b.sendMessage(msg.Chat.ID, "Вы уже привязаны к реферальной программе.")
+		b.showMenu(msg.Chat.ID, "")
+		return
+	}
 	if err != nil {
 		log.Printf("Ошибка создания записи в Приглашенные: %v", err)
 		b.sendMessage(msg.Chat.ID, "Произошла ошибка. Попробуйте позже.")
@@ -250,7 +302,7 @@ func (b *Bot) handleReferralLink(msg *tgbotapi.Message, userID int64, username s
 	}
 
 	// Увеличиваем счетчик рефералов
-	err = b.sheets.IncrementRefCount(refCode)
+	err = b.store.IncrementRefCount(refCode)
 	if err != nil {
 		log.Printf("Ошибка увеличения счетчика рефералов: %v", err)
 		// Не критично, продолжаем
@@ -291,7 +343,7 @@ $1,2 - 100 звёзд</blockquote>
 	}
 
 	// Получаем обновленные данные рефовода (с новым счетчиком)
-	updatedRef, err := b.sheets.GetReferrerByCode(refCode)
+	updatedRef, err := b.store.GetReferrerByCode(refCode)
 	if err != nil {
 		log.Printf("Ошибка получения обновленных данных рефовода: %v", err)
 		updatedRef = ref // Используем старые данные
@@ -301,25 +353,26 @@ $1,2 - 100 звёзд</blockquote>
 		"*⭐️У вас новый реферал!*\n\n"+
 			"%s\n\n"+
 			"*Всего рефералов:* %d\n\n"+
-			"*💸Приглашай друзей обменивать звезды и получай 10%% от прибыли с каждого друга!*\n\n"+
+			"%s\n\n"+
 			"*Ваша реферальная ссылка:*\n\n"+
 			"`%s`\n\n"+
 			"/Мои рефералы",
 		referralUsername,
 		updatedRef.RefCount,
+		inviteSlogan(b.referrerRate(updatedRef)),
 		fmt.Sprintf("https://t.me/%s?start=%s", b.api.Self.UserName, ref.Code),
 	)
 
 	b.sendFormattedMessage(ref.ID, notificationMsg)
 
 	// Если пользователь еще не рефовод, создаем его
-	existingRef, err := b.sheets.GetReferrerByID(userID)
+	existingRef, err := b.store.GetReferrerByID(userID)
 	if err != nil {
 		log.Printf("Ошибка проверки рефовода: %v", err)
 	} else if existingRef == nil {
 		// Создаем рефовода, если username есть
 		if username != "" {
-			_, err = b.sheets.CreateReferrer(userID, "@"+username)
+			_, err = b.store.CreateReferrer(userID, "@"+username)
 			if err != nil {
 				log.Printf("Ошибка создания рефовода: %v", err)
 			}
@@ -345,7 +398,10 @@ func (b *Bot) updateUsernameIfChanged(ref *sheets.Referrer, currentUsername stri
 	if storedUsername != currentUsernameWithAt {
 		log.Printf("Обновление username для ID %d: %s -> %s", ref.ID, storedUsername, currentUsernameWithAt)
 		ref.Username = currentUsernameWithAt
-		err := b.sheets.UpdateReferrer(ref)
+		_, err := b.store.ModifyReferrer(ref.ID, func(r *sheets.Referrer) error {
+			r.Username = currentUsernameWithAt
+			return nil
+		})
 		if err != nil {
 			log.Printf("Ошибка обновления username: %v", err)
 		} else {
@@ -355,7 +411,7 @@ func (b *Bot) updateUsernameIfChanged(ref *sheets.Referrer, currentUsername stri
 }
 
 func (b *Bot) handleInviteFriends(msg *tgbotapi.Message, userID int64, username string) {
-	ref, err := b.sheets.GetReferrerByID(userID)
+	ref, err := b.store.GetReferrerByID(userID)
 	if err != nil {
 		log.Printf("Ошибка получения рефовода: %v", err)
 		b.sendMessage(msg.Chat.ID, "Произошла ошибка. Попробуйте позже.")
@@ -369,7 +425,7 @@ func (b *Bot) handleInviteFriends(msg *tgbotapi.Message, userID int64, username
 			return
 		}
 
-		ref, err = b.sheets.CreateReferrer(userID, "@"+username)
+		ref, err = b.store.CreateReferrer(userID, "@"+username)
 		if err != nil {
 			log.Printf("Ошибка создания рефовода: %v", err)
 			b.sendMessage(msg.Chat.ID, "Произошла ошибка. Попробуйте позже.")
@@ -390,9 +446,10 @@ func (b *Bot) handleInviteFriends(msg *tgbotapi.Message, userID int64, username
 	refLink := fmt.Sprintf("https://t.me/%s?start=%s", botUsername, ref.Code)
 
 	message := fmt.Sprintf(
-		"*💸Приглашай друзей обменивать звезды и получай 10%% от прибыли с каждого друга!*\n\n"+
+		"%s\n\n"+
 			"*Ваша реферальная ссылка:*\n\n"+
 			"`%s`",
+		inviteSlogan(b.referrerRate(ref)),
 		refLink,
 	)
 
@@ -400,7 +457,7 @@ func (b *Bot) handleInviteFriends(msg *tgbotapi.Message, userID int64, username
 }
 
 func (b *Bot) handleMyReferrals(msg *tgbotapi.Message, userID int64) {
-	ref, err := b.sheets.GetReferrerByID(userID)
+	ref, err := b.store.GetReferrerByID(userID)
 	if err != nil {
 		log.Printf("Ошибка получения рефовода: %v", err)
 		b.sendMessage(msg.Chat.ID, "Произошла ошибка. Попробуйте позже.")
@@ -417,7 +474,7 @@ func (b *Bot) handleMyReferrals(msg *tgbotapi.Message, userID int64) {
 	if username != "" {
 		b.updateUsernameIfChanged(ref, username)
 		// Перечитываем данные после обновления
-		ref, err = b.sheets.GetReferrerByID(userID)
+		ref, err = b.store.GetReferrerByID(userID)
 		if err != nil {
 			log.Printf("Ошибка перечитывания рефовода: %v", err)
 		}
@@ -431,11 +488,17 @@ func (b *Bot) handleMyReferrals(msg *tgbotapi.Message, userID int64) {
 	message := fmt.Sprintf(
 		"<b>📊 Статистика рефералов</b>\n\n"+
 			"<b>Количество рефералов:</b> %d\n"+
-			"<b>Ожидает выплаты:</b> %.2f USDT\n"+
-			"<b>Выплачено:</b> %.2f USDT\n"+
+			"%s"+
+			"<b>Ожидает выплаты:</b> %s USDT\n"+
+			"%s"+
+			"%s"+
+			"<b>Выплачено:</b> %s USDT\n"+
 			"<b>Кошелёк:</b> %s",
 		ref.RefCount,
+		b.tierInfo(ref),
 		ref.PendingPayout,
+		b.holdInfo(ref),
+		b.payoutRequestInfo(ref),
 		ref.PaidOut,
 		walletInfo,
 	)
@@ -444,7 +507,7 @@ func (b *Bot) handleMyReferrals(msg *tgbotapi.Message, userID int64) {
 }
 
 func (b *Bot) handleConnectWallet(msg *tgbotapi.Message, userID int64) {
-	ref, err := b.sheets.GetReferrerByID(userID)
+	ref, err := b.store.GetReferrerByID(userID)
 	if err != nil {
 		log.Printf("Ошибка получения рефовода: %v", err)
 		b.sendMessage(msg.Chat.ID, "Произошла ошибка. Попробуйте позже.")
@@ -481,7 +544,7 @@ func (b *Bot) handleWalletInput(msg *tgbotapi.Message, userID int64) {
 	wallet := strings.TrimSpace(msg.Text)
 
 	// Если пользователь отправил команду или кнопку, отменяем ввод
-	if msg.Text == "Пригласить друзей" || msg.Text == "Мои рефералы" || msg.Text == "Подключить TON-кошелёк" || msg.Text == "Изменить кошелек" || msg.IsCommand() {
+	if msg.Text == "Пригласить друзей" || msg.Text == "Мои рефералы" || msg.Text == "Вывести" || msg.Text == "Подключить TON-кошелёк" || msg.Text == "Изменить кошелек" || msg.IsCommand() {
 		return
 	}
 
@@ -494,7 +557,7 @@ func (b *Bot) handleWalletInput(msg *tgbotapi.Message, userID int64) {
 		return
 	}
 
-	ref, err := b.sheets.GetReferrerByID(userID)
+	ref, err := b.store.GetReferrerByID(userID)
 	if err != nil {
 		log.Printf("Ошибка получения рефовода: %v", err)
 		b.sendMessage(msg.Chat.ID, "Произошла ошибка. Попробуйте позже.")
@@ -506,8 +569,10 @@ func (b *Bot) handleWalletInput(msg *tgbotapi.Message, userID int64) {
 		return
 	}
 
-	ref.Wallet = wallet
-	err = b.sheets.UpdateReferrer(ref)
+	_, err = b.store.ModifyReferrer(ref.ID, func(r *sheets.Referrer) error {
+		r.Wallet = wallet
+		return nil
+	})
 	if err != nil {
 		log.Printf("Ошибка обновления кошелька: %v", err)
 		b.sendMessage(msg.Chat.ID, "Произошла ошибка при сохранении кошелька. Попробуйте позже.")
@@ -520,7 +585,7 @@ func (b *Bot) handleWalletInput(msg *tgbotapi.Message, userID int64) {
 func (b *Bot) showMenu(chatID int64, text string) {
 	// Получаем информацию о рефоводе для определения текста кнопки кошелька
 	// В Telegram chatID == userID для личных чатов
-	ref, err := b.sheets.GetReferrerByID(chatID)
+	ref, err := b.store.GetReferrerByID(chatID)
 	walletButtonText := "Подключить TON-кошелёк"
 	if err == nil && ref != nil && ref.Wallet != "" {
 		walletButtonText = "Изменить кошелек"
@@ -532,6 +597,9 @@ func (b *Bot) showMenu(chatID int64, text string) {
 		),
 		tgbotapi.NewKeyboardButtonRow(
 			tgbotapi.NewKeyboardButton("Мои рефералы"),
+			tgbotapi.NewKeyboardButton("Вывести"),
+		),
+		tgbotapi.NewKeyboardButtonRow(
 			tgbotapi.NewKeyboardButton(walletButtonText),
 		),
 	)
@@ -621,7 +689,7 @@ func (b *Bot) startSyncWorker() {
 	time.Sleep(1 * time.Minute)
 
 	// Обновляем кэш перед первой синхронизацией
-	if err := b.sheets.LoadCache(); err != nil {
+	if err := b.store.LoadCache(); err != nil {
 		log.Printf("Ошибка обновления кэша: %v", err)
 	}
 
@@ -629,7 +697,7 @@ func (b *Bot) startSyncWorker() {
 
 	for range ticker.C {
 		// Обновляем кэш каждые 2 часа вместе с синхронизацией
-		if err := b.sheets.LoadCache(); err != nil {
+		if err := b.store.LoadCache(); err != nil {
 			log.Printf("Ошибка обновления кэша: %v", err)
 		}
 		b.syncWithdrawals()
@@ -669,7 +737,7 @@ func (b *Bot) updatePendingPayouts() {
 		}
 	}()
 
-	err := b.sheets.UpdatePendingPayouts()
+	err := b.store.UpdatePendingPayouts()
 	if err != nil {
 		log.Printf("Ошибка обновления столбца 'Ожидает выплаты': %v", err)
 	} else {
@@ -677,6 +745,18 @@ func (b *Bot) updatePendingPayouts() {
 	}
 }
 
+// reloadRates перечитывает ставки бонусов; при ошибке продолжаем с прежними
+func (b *Bot) reloadRates() {
+	changed, err := config.ReloadRates()
+	if err != nil {
+		log.Printf("⚠️ Не удалось перечитать ставки, действуют прежние (%s): %v", config.CurrentRates(), err)
+		return
+	}
+	if changed {
+		log.Printf("📝 Ставки бонусов изменились: %s", config.CurrentRates())
+	}
+}
+
 func (b *Bot) syncWithdrawals() {
 	log.Printf("Начало синхронизации выводов...")
 
@@ -686,8 +766,17 @@ func (b *Bot) syncWithdrawals() {
 		}
 	}()
 
+	// Ставки берем из .env на момент синхронизации, чтобы их можно было менять без перезапуска
+	b.reloadRates()
+
+	// Сначала завершаем начисления, прерванные при прошлом запуске или синхронизации
+	b.replayAccruals()
+
+	// Списываем бонусы по сделкам, которые удалили из Выводы или уменьшили
+	b.clawbackChangedDeals()
+
 	// Получаем новые выводы
-	withdrawals, err := b.sheets.GetNewWithdrawals()
+	withdrawals, err := b.store.GetNewWithdrawals()
 	if err != nil {
 		log.Printf("Ошибка получения новых выводов: %v", err)
 		return
@@ -713,12 +802,18 @@ func (b *Bot) syncWithdrawals() {
 }
 
 func (b *Bot) processWithdrawal(withdrawal sheets.Withdrawal) error {
-	log.Printf("Обработка вывода: DealID=%s, UserID=%d (из колонки B листа Выводы), Profit=%.2f",
+	log.Printf("Обработка вывода: DealID=%s, UserID=%d (из колонки B листа Выводы), Profit=%s",
 		withdrawal.DealID, withdrawal.UserID, withdrawal.Profit)
 
+	// Начисление по сделке уже начато и будет завершено из журнала
+	if b.accruals.has(withdrawal.DealID) {
+		log.Printf("⚠️ Начисление по сделке %s уже в журнале, пропускаем", withdrawal.DealID)
+		return nil
+	}
+
 	// Шаг 1: Находим реферала по ID пользователя в Приглашенные
 	// Сверяем ID пользователя из колонки B листа "Выводы" с колонкой A листа "Приглашенные"
-	invited, err := b.sheets.GetInvitedByUserID(withdrawal.UserID)
+	invited, err := b.store.GetInvitedByUserID(withdrawal.UserID)
 	if err != nil {
 		return fmt.Errorf("ошибка поиска приглашенного: %w", err)
 	}
@@ -732,9 +827,30 @@ func (b *Bot) processWithdrawal(withdrawal sheets.Withdrawal) error {
 	log.Printf("✅ Найден в Приглашенные: UserID=%d, код пригласившего='%s'",
 		invited.UserID, invited.RefCode)
 
+	// Сделки после окончания окна атрибуции бонуса не дают. Окно сравнивается с датой сделки,
+	// а не с моментом синхронизации: сделка внутри окна, обработанная позже (например, после
+	// простоя бота), бонус дает.
+	if deadline, ok := attributionDeadline(invited); ok {
+		dealTime := withdrawal.Date
+		if dealTime.IsZero() {
+			dealTime = time.Now()
+			log.Printf("⚠️ Дата сделки %s неизвестна (колонка \"Дата\" листа Выводы пуста), окно атрибуции проверяется по текущему времени",
+				withdrawal.DealID)
+		}
+		if dealTime.After(deadline) {
+			log.Printf("⚠️ Сделка %s от %s вне окна атрибуции: пользователь %d приглашен %s, бонусы начислялись до %s (%d дн.), пропускаем",
+				withdrawal.DealID, dealTime.Format("02.01.2006 15:04"), invited.UserID, invited.InvitedAt.Format("02.01.2006 15:04"),
+				deadline.Format("02.01.2006 15:04"), config.AppConfig.AttributionWindowDays)
+			return nil
+		}
+	} else if config.AppConfig.AttributionWindowDays > 0 {
+		log.Printf("⚠️ Дата приглашения пользователя %d неизвестна, окно атрибуции к сделке %s не применяется",
+			invited.UserID, withdrawal.DealID)
+	}
+
 	// Шаг 2: Получаем рефовода по коду пригласившего
 	log.Printf("🔍 Поиск рефовода с кодом '%s' в таблице Рефоводы...", invited.RefCode)
-	ref, err := b.sheets.GetReferrerByCode(invited.RefCode)
+	ref, err := b.store.GetReferrerByCode(invited.RefCode)
 	if err != nil {
 		log.Printf("❌ Ошибка получения рефовода с кодом '%s': %v", invited.RefCode, err)
 		return fmt.Errorf("ошибка получения рефовода: %w", err)
@@ -748,41 +864,88 @@ func (b *Bot) processWithdrawal(withdrawal sheets.Withdrawal) error {
 
 	log.Printf("✅ Рефовод найден: ID=%d, Code=%s, Username=%s", ref.ID, ref.Code, ref.Username)
 
-	// Шаг 3: Считаем бонус (10% от прибыли)
-	bonus := withdrawal.Profit * 0.1
-	log.Printf("💰 Расчет бонуса: прибыль=%.2f, бонус (10%%)=%.2f USDT", withdrawal.Profit, bonus)
+	// Шаг 3: Считаем бонус (процент от прибыли по ставке рефовода), округляя до цента.
+	// Ступень ставки определяется прибылью рефералов до этой сделки.
+	volume, err := b.store.ReferredProfit(ref.Code)
+	if err != nil {
+		return fmt.Errorf("ошибка расчета прибыли рефералов: %w", err)
+	}
+	rate := commissionRate(ref, volume)
+	bonus := withdrawal.Profit.MulPercent(rate).RoundCents()
+	log.Printf("💰 Расчет бонуса: прибыль=%s, бонус (%s%%)=%s USDT", withdrawal.Profit, rate, bonus)
 
-	// Шаг 4: Создаем запись в Рефералы
+	// Шаг 4: Готовим запись для листа Рефералы
 	referral := &sheets.Referral{
 		RefID:   withdrawal.UserID, // ID реферала (из колонки B Выводы)
 		RefCode: invited.RefCode,   // Код пригласившего (из колонки B Приглашенные)
 		Profit:  withdrawal.Profit, // Прибыль (из колонки D Выводы)
 		DealID:  withdrawal.DealID, // ID сделки (из колонки A Выводы)
-		Bonus:   bonus,             // Бонус рефоводу (10% от прибыли)
+		Bonus:   bonus,             // Бонус рефоводу (процент от прибыли)
 		Date:    time.Now().Format("02.01.2006 15:04"),
-	}
+		Rate:    rate, // Примененная ставка
+		Level:   1,
+	}
+	accruals := []accrual{{
+		DealID:     withdrawal.DealID,
+		Level:      1,
+		ReferrerID: ref.ID,
+		Referral:   referral,
+	}}
+
+	// Шаг 5: Второй уровень - бонус рефоводу, пригласившему рефовода
+	if rate2 := config.CurrentRates().Level2CommissionPercent; rate2 > 0 {
+		visited := map[int64]bool{withdrawal.UserID: true, ref.ID: true}
+		upline, err := b.uplineReferrers(ref.ID, 1, visited)
+		if err != nil {
+			return err
+		}
+		for _, up := range upline {
+			exists, err := b.store.HasReferral(withdrawal.DealID, 2)
+			if err != nil {
+				return fmt.Errorf("ошибка проверки сделки в Рефералы: %w", err)
+			}
+			if exists {
+				log.Printf("Начисление второго уровня по сделке %s уже есть, пропускаем", withdrawal.DealID)
+				continue
+			}
 
-	err = b.sheets.CreateReferral(referral)
-	if err != nil {
-		return fmt.Errorf("ошибка создания записи в Рефералы: %w", err)
+			bonus2 := withdrawal.Profit.MulPercent(rate2).RoundCents()
+			log.Printf("💰 Второй уровень: рефовод %d (код %s), бонус (%s%%)=%s USDT", up.ID, up.Code, rate2, bonus2)
+
+			level2 := *referral
+			level2.RefCode = up.Code
+			level2.Bonus = bonus2
+			level2.Rate = rate2
+			level2.Level = 2
+			accruals = append(accruals, accrual{
+				DealID:     withdrawal.DealID,
+				Level:      2,
+				ReferrerID: up.ID,
+				Referral:   &level2,
+			})
+		}
 	}
 
-	log.Printf("✅ Запись создана в Рефералы: RefID=%d, RefCode=%s, DealID=%s, Bonus=%.2f",
-		referral.RefID, referral.RefCode, referral.DealID, referral.Bonus)
-
-	// Шаг 5: Добавляем бонус к ожидающей выплате рефовода
-	oldPayout := ref.PendingPayout
-	ref.PendingPayout += bonus
-	err = b.sheets.UpdateReferrer(ref)
-	if err != nil {
-		return fmt.Errorf("ошибка обновления рефовода: %w", err)
+	// Все уровни попадают в журнал до записи в хранилище: верхние уровни первыми, так как
+	// сделка считается обработанной по записи первого уровня. После сбоя между записями
+	// в журнале сделка будет обработана заново, а уже начисленные уровни пропущены.
+	for i := len(accruals) - 1; i >= 0; i-- {
+		accruals[i].State = accrualStarted
+		if err := b.accruals.record(accruals[i]); err != nil {
+			return err
+		}
 	}
 
-	log.Printf("✅ Рефовод обновлен: ID=%d, код=%s, ожидает выплаты: %.2f → %.2f USDT",
-		ref.ID, ref.Code, oldPayout, ref.PendingPayout)
+	// Шаги 6-7: По каждому уровню создаем запись в Рефералы и добавляем бонус к ожидающей выплате.
+	// Оба шага идут через журнал, поэтому при сбое между ними начисление продолжится.
+	for _, a := range accruals {
+		if err := b.applyAccrual(a); err != nil {
+			return err
+		}
+	}
 
-	log.Printf("✅ Вывод полностью обработан: сделка %s, реферал %d, бонус %.2f USDT",
-		withdrawal.DealID, withdrawal.UserID, bonus)
+	log.Printf("✅ Вывод полностью обработан: сделка %s, реферал %d, бонус %s USDT, уровней: %d",
+		withdrawal.DealID, withdrawal.UserID, bonus, len(accruals))
 
 	return nil
 }
@@ -0,0 +1,147 @@
+package bot
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"ss_ref_bot/config"
+	"ss_ref_bot/money"
+	"ss_ref_bot/sheets"
+	"ss_ref_bot/sqlite"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// TestMain отключает логи бота: тесты проверяют хранилище и отправленные сообщения
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// sentRequest - вызов Bot API, полученный фейковым Telegram
+type sentRequest struct {
+	Method string
+	Params map[string]string
+}
+
+// fakeTelegram отвечает на вызовы Bot API и запоминает их
+type fakeTelegram struct {
+	mu       sync.Mutex
+	requests []sentRequest
+}
+
+func (f *fakeTelegram) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+
+	params := make(map[string]string)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		r.ParseMultipartForm(1 << 20)
+	} else {
+		r.ParseForm()
+	}
+	for key, values := range r.Form {
+		params[key] = values[0]
+	}
+
+	f.mu.Lock()
+	f.requests = append(f.requests, sentRequest{Method: method, Params: params})
+	f.mu.Unlock()
+
+	var result interface{} = map[string]interface{}{
+		"message_id": 1,
+		"date":       0,
+		"chat":       map[string]interface{}{"id": 1, "type": "private"},
+	}
+	if method == "getMe" {
+		result = map[string]interface{}{"id": 1, "is_bot": true, "first_name": "test", "username": "test_bot"}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "result": result})
+}
+
+// sent возвращает вызовы метода (например, "sendMessage")
+func (f *fakeTelegram) sent(method string) []sentRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var result []sentRequest
+	for _, r := range f.requests {
+		if r.Method == method {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// newTestBot создает бота с базой SQLite во временном каталоге и фейковым Telegram
+func newTestBot(t *testing.T) (*Bot, *sqlite.SQLiteStore, *fakeTelegram) {
+	t.Helper()
+
+	dir := t.TempDir()
+	config.AppConfig = &config.Config{
+		AccrualJournalPath: filepath.Join(dir, "accruals.jsonl"),
+	}
+	config.SetRates(config.Rates{CommissionPercent: 10 * money.Percent(money.USDT)})
+
+	store, err := sqlite.NewSQLiteStore(filepath.Join(dir, "bot.db"), nil, false)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	tg := &fakeTelegram{}
+	server := httptest.NewServer(tg)
+	t.Cleanup(server.Close)
+
+	api, err := tgbotapi.NewBotAPIWithClient("test-token", server.URL+"/bot%s/%s", server.Client())
+	if err != nil {
+		t.Fatalf("NewBotAPIWithClient: %v", err)
+	}
+
+	accruals, err := openAccrualJournal(config.AppConfig.AccrualJournalPath)
+	if err != nil {
+		t.Fatalf("openAccrualJournal: %v", err)
+	}
+
+	b := &Bot{
+		api:              api,
+		store:            store,
+		waitingForWallet: make(map[int64]bool),
+		waitingForReason: make(map[int64]pendingRejection),
+		accruals:         accruals,
+	}
+	return b, store, tg
+}
+
+// newFundedReferrer создает рефовода 111 с кошельком wallet и начислением 20 USDT по сделке D-1
+func newFundedReferrer(t *testing.T, store *sqlite.SQLiteStore, wallet string) *sheets.Referrer {
+	t.Helper()
+
+	ref, err := store.CreateReferrer(111, "@ref")
+	if err != nil {
+		t.Fatalf("CreateReferrer: %v", err)
+	}
+	if err := store.AppendLedgerEntry(sheets.NewAccrualEntry(ref.ID, 20*money.USDT, "D-1", 1, "сделка")); err != nil {
+		t.Fatalf("AppendLedgerEntry: %v", err)
+	}
+	if _, _, err := syncLedgerBalance(store, ref.ID); err != nil {
+		t.Fatalf("syncLedgerBalance: %v", err)
+	}
+	ref, err = store.ModifyReferrer(ref.ID, func(r *sheets.Referrer) error {
+		r.Wallet = wallet
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ModifyReferrer: %v", err)
+	}
+	return ref
+}
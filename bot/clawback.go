@@ -0,0 +1,159 @@
+package bot
+
+import (
+	"fmt"
+	"log"
+
+	"ss_ref_bot/money"
+	"ss_ref_bot/sheets"
+)
+
+// clawbackAbsentSyncs - сколько синхронизаций подряд сделки не должно быть в листе Выводы,
+// чтобы считать ее удаленной. Разовая пропажа строки (правка листа, архивация, сбой
+// IMPORTRANGE) бонус не списывает.
+const clawbackAbsentSyncs = 3
+
+// clawbackChangedDeals сверяет начисления с листом Выводы и списывает лишнюю часть бонуса
+// записью в Журнале, уведомляя рефовода. Основания для списания:
+//   - строка сделки есть, а прибыль по ней уменьшена (прибыль <= 0 - сторно, бонус списывается целиком);
+//   - сделки нет в листе clawbackAbsentSyncs синхронизаций подряд.
+//
+// Некорректная строка (например, опечатка в ID пользователя) основанием не считается.
+// Уже списанное по сделке учитывается, поэтому повторная сверка ничего не меняет.
+func (b *Bot) clawbackChangedDeals() {
+	withdrawals, err := b.store.GetWithdrawals()
+	if err != nil {
+		log.Printf("Ошибка чтения листа Выводы для сверки сделок: %v", err)
+		return
+	}
+	referrals, err := b.store.GetReferrals()
+	if err != nil {
+		log.Printf("Ошибка чтения начислений для сверки сделок: %v", err)
+		return
+	}
+
+	byDeal := make(map[string]sheets.Withdrawal, len(withdrawals))
+	for _, w := range withdrawals {
+		byDeal[w.DealID] = w
+	}
+
+	// Пустой лист или пропажа большей части сделок - скорее сбой IMPORTRANGE, чем отмены
+	removed := make(map[string]bool)
+	processed := make(map[string]bool)
+	for _, r := range referrals {
+		processed[r.DealID] = true
+		if _, ok := byDeal[r.DealID]; !ok {
+			removed[r.DealID] = true
+		}
+	}
+	if len(removed) > 0 && (len(withdrawals) == 0 || len(removed)*2 > len(processed)) {
+		log.Printf("❌ Из листа Выводы пропало %d из %d обработанных сделок, списания не выполняются - проверьте лист",
+			len(removed), len(processed))
+		return
+	}
+
+	// Считаем синхронизации подряд без сделки; вернувшаяся сделка счетчик сбрасывает
+	absent := make(map[string]int, len(removed))
+	for dealID := range removed {
+		absent[dealID] = b.absentDeals[dealID] + 1
+		if absent[dealID] < clawbackAbsentSyncs {
+			log.Printf("📝 Сделки %s нет в листе Выводы (%d из %d синхронизаций подряд), списание отложено",
+				dealID, absent[dealID], clawbackAbsentSyncs)
+		}
+	}
+	b.absentDeals = absent
+
+	for _, r := range referrals {
+		w, ok := byDeal[r.DealID]
+		var target money.Amount
+		var reason string
+		switch {
+		case !ok:
+			if absent[r.DealID] < clawbackAbsentSyncs {
+				continue
+			}
+			reason = fmt.Sprintf("сделка %s удалена из листа Выводы", r.DealID)
+		case w.Invalid != "":
+			// Причина уже записана в лог при чтении листа
+			continue
+		case w.Profit <= 0:
+			reason = fmt.Sprintf("сделка %s отменена (сторно): прибыль %s USDT", r.DealID, w.Profit)
+		case w.Profit < r.Profit:
+			target = r.Bonus.MulRatio(int64(w.Profit), int64(r.Profit)).RoundCents()
+			reason = fmt.Sprintf("прибыль по сделке %s уменьшена: %s → %s USDT", r.DealID, r.Profit, w.Profit)
+		default:
+			continue
+		}
+
+		if err := b.clawback(r, target, reason); err != nil {
+			log.Printf("❌ Ошибка списания по сделке %s (уровень %d): %v", r.DealID, r.Level, err)
+		}
+	}
+}
+
+// clawback уменьшает бонус по начислению r до target за вычетом уже списанного
+func (b *Bot) clawback(r sheets.Referral, target money.Amount, reason string) error {
+	// Начисление еще не завершено - сверим после его завершения
+	if b.accruals.has(r.DealID) {
+		return nil
+	}
+
+	ref, err := b.store.GetReferrerByCode(r.RefCode)
+	if err != nil {
+		return fmt.Errorf("ошибка получения рефовода: %w", err)
+	}
+	if ref == nil {
+		log.Printf("⚠️ Рефовод с кодом '%s' не найден, списание по сделке %s пропущено", r.RefCode, r.DealID)
+		return nil
+	}
+
+	// Под balanceMu: одобрение выплаты не должно проверить остаток до списания, а выплатить после
+	balanceMu.Lock()
+	defer balanceMu.Unlock()
+
+	entries, err := b.store.LedgerEntries(ref.ID)
+	if err != nil {
+		return fmt.Errorf("ошибка чтения журнала: %w", err)
+	}
+	var clawed money.Amount
+	for _, e := range entries {
+		if e.Type == sheets.EntryClawback && e.DealID == r.DealID {
+			if e.Debit == sheets.ReferrerAccount(ref.ID) {
+				clawed += e.Amount
+			} else {
+				clawed -= e.Amount
+			}
+		}
+	}
+
+	amount := r.Bonus - clawed - target
+	if amount <= 0 {
+		return nil
+	}
+
+	entry := sheets.NewLedgerEntry(sheets.EntryClawback, ref.ID, amount, r.DealID, reason)
+	if err := b.store.AppendLedgerEntry(entry); err != nil {
+		return fmt.Errorf("ошибка записи списания в Журнал: %w", err)
+	}
+
+	// Остаток пересчитывается по Журналу, поэтому повтор после сбоя не спишет дважды
+	pending := ref.PendingPayout - amount
+	updated, _, err := syncLedgerBalanceLocked(b.store, ref.ID)
+	if err != nil {
+		// Списание уже в Журнале: остаток будет пересчитан по нему при ближайшем обновлении
+		log.Printf("❌ Ошибка обновления рефовода %d после списания: %v", ref.ID, err)
+	} else {
+		pending = updated.PendingPayout
+	}
+
+	log.Printf("💰 Списание по сделке %s: рефовод %d, %s USDT (%s), ожидает выплаты: %s USDT",
+		r.DealID, ref.ID, amount, reason, pending)
+
+	b.sendHTMLMessage(ref.ID, fmt.Sprintf(
+		"<b>⚠️ Бонус по сделке реферала уменьшен</b>\n\n"+
+			"<b>Списано:</b> %s USDT\n"+
+			"<b>Причина:</b> %s\n"+
+			"<b>Ожидает выплаты:</b> %s USDT",
+		amount, reason, pending))
+	return nil
+}
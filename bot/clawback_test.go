@@ -0,0 +1,101 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"ss_ref_bot/money"
+	"ss_ref_bot/sheets"
+	"ss_ref_bot/sqlite"
+)
+
+// withdrawalsStore подменяет лист Выводы: остальные данные берутся из базы
+type withdrawalsStore struct {
+	*sqlite.SQLiteStore
+	withdrawals []sheets.Withdrawal
+}
+
+func (s *withdrawalsStore) GetWithdrawals() ([]sheets.Withdrawal, error) {
+	return s.withdrawals, nil
+}
+
+func TestClawbackChangedDeals(t *testing.T) {
+	deals := func(change func(w *sheets.Withdrawal) bool) []sheets.Withdrawal {
+		var result []sheets.Withdrawal
+		for i := 1; i <= 3; i++ {
+			w := sheets.Withdrawal{DealID: fmt.Sprintf("D-%d", i), UserID: int64(1000 + i), Profit: 100 * money.USDT}
+			if w.DealID != "D-1" || change(&w) {
+				result = append(result, w)
+			}
+		}
+		return result
+	}
+	unchanged := deals(func(w *sheets.Withdrawal) bool { return true })
+	removed := deals(func(w *sheets.Withdrawal) bool { return false })
+	reduced := deals(func(w *sheets.Withdrawal) bool { w.Profit = 50 * money.USDT; return true })
+	storno := deals(func(w *sheets.Withdrawal) bool { w.Profit = 0; return true })
+	invalid := deals(func(w *sheets.Withdrawal) bool {
+		w.UserID, w.Invalid = 0, "ID пользователя: некорректный ID"
+		return true
+	})
+
+	// Три сделки по 100 USDT прибыли, бонус 10% - по 10 USDT
+	for _, tc := range []struct {
+		name      string
+		syncs     [][]sheets.Withdrawal
+		pending   money.Amount
+		clawbacks int
+	}{
+		{name: "сделки без изменений", syncs: [][]sheets.Withdrawal{unchanged, unchanged}, pending: 30 * money.USDT},
+		{name: "прибыль уменьшена", syncs: [][]sheets.Withdrawal{reduced}, pending: 25 * money.USDT, clawbacks: 1},
+		{name: "повторная сверка не списывает дважды", syncs: [][]sheets.Withdrawal{reduced, reduced, reduced}, pending: 25 * money.USDT, clawbacks: 1},
+		{name: "сторно", syncs: [][]sheets.Withdrawal{storno, storno}, pending: 20 * money.USDT, clawbacks: 1},
+		{name: "сделка пропала на одну синхронизацию", syncs: [][]sheets.Withdrawal{removed}, pending: 30 * money.USDT},
+		{name: "сделка удалена", syncs: [][]sheets.Withdrawal{removed, removed, removed, removed}, pending: 20 * money.USDT, clawbacks: 1},
+		{name: "сделка вернулась до списания", syncs: [][]sheets.Withdrawal{removed, removed, unchanged, removed, removed}, pending: 30 * money.USDT},
+		{name: "некорректная строка", syncs: [][]sheets.Withdrawal{invalid, invalid, invalid}, pending: 30 * money.USDT},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, store, tg := newTestBot(t)
+
+			ref, err := store.CreateReferrer(111, "@ref")
+			if err != nil {
+				t.Fatalf("CreateReferrer: %v", err)
+			}
+			for _, w := range unchanged {
+				if err := store.CreateInvited(w.UserID, ref.Code); err != nil {
+					t.Fatalf("CreateInvited: %v", err)
+				}
+				if err := b.processWithdrawal(w); err != nil {
+					t.Fatalf("processWithdrawal: %v", err)
+				}
+			}
+
+			fake := &withdrawalsStore{SQLiteStore: store}
+			b.store = fake
+			for _, withdrawals := range tc.syncs {
+				fake.withdrawals = withdrawals
+				b.clawbackChangedDeals()
+			}
+
+			got, err := store.GetReferrerByID(ref.ID)
+			if err != nil {
+				t.Fatalf("GetReferrerByID: %v", err)
+			}
+			if got.PendingPayout != tc.pending {
+				t.Errorf("ожидает выплаты = %s, ожидалось %s", got.PendingPayout, tc.pending)
+			}
+
+			var notices int
+			for _, msg := range tg.sent("sendMessage") {
+				if strings.Contains(msg.Params["text"], "Бонус по сделке реферала уменьшен") {
+					notices++
+				}
+			}
+			if notices != tc.clawbacks {
+				t.Errorf("уведомлений о списании %d, ожидалось %d", notices, tc.clawbacks)
+			}
+		})
+	}
+}
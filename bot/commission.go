@@ -0,0 +1,134 @@
+package bot
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"ss_ref_bot/config"
+	"ss_ref_bot/money"
+	"ss_ref_bot/sheets"
+)
+
+// commissionRate возвращает ставку рефовода при суммарной прибыли его рефералов volume:
+// индивидуальную из "Ставки", иначе ступень из COMMISSION_TIERS, иначе общую COMMISSION_PERCENT
+func commissionRate(ref *sheets.Referrer, volume money.Amount) money.Percent {
+	if ref != nil && ref.Rate > 0 {
+		return ref.Rate
+	}
+
+	rates := config.CurrentRates()
+	rate := rates.CommissionPercent
+	for _, tier := range rates.CommissionTiers {
+		if volume >= tier.From {
+			rate = tier.Rate
+		}
+	}
+	return rate
+}
+
+// nextCommissionTier возвращает ближайшую ступень выше текущей. Для индивидуальной ставки
+// ступеней нет.
+func nextCommissionTier(ref *sheets.Referrer, volume money.Amount) (config.CommissionTier, bool) {
+	if ref != nil && ref.Rate > 0 {
+		return config.CommissionTier{}, false
+	}
+
+	for _, tier := range config.CurrentRates().CommissionTiers {
+		if tier.From > volume {
+			return tier, true
+		}
+	}
+	return config.CommissionTier{}, false
+}
+
+// referrerRate возвращает текущую ставку рефовода. Если прибыль рефералов прочитать
+// не удалось, ступень считается по нулевой прибыли.
+func (b *Bot) referrerRate(ref *sheets.Referrer) money.Percent {
+	volume, err := b.store.ReferredProfit(ref.Code)
+	if err != nil {
+		log.Printf("Ошибка расчета прибыли рефералов %s: %v", ref.Code, err)
+	}
+	return commissionRate(ref, volume)
+}
+
+// inviteSlogan - призыв приглашать друзей с текущей ставкой рефовода,
+// чтобы текст всегда совпадал с фактическим начислением
+func inviteSlogan(rate money.Percent) string {
+	return fmt.Sprintf("*💸Приглашай друзей обменивать звезды и получай %s%% от прибыли с каждого друга!*", rate)
+}
+
+// tierInfo - строки статистики о ставке рефовода и прогрессе до следующей ступени (HTML)
+func (b *Bot) tierInfo(ref *sheets.Referrer) string {
+	if ref.Rate > 0 {
+		return fmt.Sprintf("<b>Ставка:</b> %s%% (индивидуальная)\n", ref.Rate)
+	}
+
+	volume, err := b.store.ReferredProfit(ref.Code)
+	if err != nil {
+		log.Printf("Ошибка расчета прибыли рефералов %s: %v", ref.Code, err)
+		return ""
+	}
+
+	tiers := config.CurrentRates().CommissionTiers
+	info := fmt.Sprintf("<b>Ставка:</b> %s%%\n", commissionRate(ref, volume))
+	if len(tiers) == 0 {
+		return info
+	}
+
+	info += fmt.Sprintf("<b>Прибыль рефералов:</b> %s USDT\n", volume)
+	if next, ok := nextCommissionTier(ref, volume); ok {
+		info += fmt.Sprintf("<b>До ставки %s%%:</b> ещё %s USDT прибыли рефералов\n", next.Rate, next.From-volume)
+	} else {
+		info += "🏆 У вас максимальная ставка\n"
+	}
+	return info
+}
+
+// attributionDeadline возвращает момент, до которого сделки приглашенного дают бонус
+// (ATTRIBUTION_WINDOW_DAYS). ok = false - окна нет или дата приглашения неизвестна.
+func attributionDeadline(invited *sheets.Invited) (deadline time.Time, ok bool) {
+	days := config.AppConfig.AttributionWindowDays
+	if days <= 0 || invited.InvitedAt.IsZero() {
+		return time.Time{}, false
+	}
+	return invited.InvitedAt.AddDate(0, 0, days), true
+}
+
+// uplineReferrers возвращает рефоводов над рефоводом с ID userID: пригласившего его,
+// затем пригласившего того и так далее, не больше depth. visited - пользователи, уже
+// вошедшие в цепочку (сам реферал и рефоводы нижних уровней). Цепочка обрывается на
+// пользователе без пригласившего, на неизвестном коде и на цикле, поэтому никто не получает
+// бонус дважды по одной сделке и за свою же сделку.
+func (b *Bot) uplineReferrers(userID int64, depth int, visited map[int64]bool) ([]*sheets.Referrer, error) {
+	var chain []*sheets.Referrer
+	for current := userID; len(chain) < depth; {
+		invited, err := b.store.GetInvitedByUserID(current)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка поиска пригласившего пользователя %d: %w", current, err)
+		}
+		if invited == nil {
+			break
+		}
+
+		ref, err := b.store.GetReferrerByCode(invited.RefCode)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка получения рефовода: %w", err)
+		}
+		if ref == nil {
+			log.Printf("⚠️ Рефовод с кодом '%s', пригласивший пользователя %d, не найден в таблице Рефоводы",
+				invited.RefCode, current)
+			break
+		}
+		if visited[ref.ID] {
+			log.Printf("⚠️ Цикл в цепочке приглашений: рефовод %d (код %s) уже есть в цепочке, дальше не идем",
+				ref.ID, ref.Code)
+			break
+		}
+
+		visited[ref.ID] = true
+		chain = append(chain, ref)
+		current = ref.ID
+	}
+	return chain, nil
+}
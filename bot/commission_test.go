@@ -0,0 +1,100 @@
+package bot
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ss_ref_bot/config"
+	"ss_ref_bot/money"
+	"ss_ref_bot/sheets"
+)
+
+func TestRatesAreReloadedFromEnvFile(t *testing.T) {
+	b, _, _ := newTestBot(t)
+
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd: %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("Chdir: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	writeEnv := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, ".env"), []byte(content), 0o600); err != nil {
+			t.Fatalf("запись .env: %v", err)
+		}
+	}
+	percent := func(s string) money.Percent {
+		p, err := money.ParsePercent(s)
+		if err != nil {
+			t.Fatalf("ParsePercent(%q): %v", s, err)
+		}
+		return p
+	}
+
+	// Новая ставка из .env действует со следующей синхронизации без перезапуска
+	writeEnv("COMMISSION_PERCENT=12.5\nCOMMISSION_TIERS=1000:15\n")
+	b.reloadRates()
+	if got := commissionRate(nil, 0); got != percent("12.5") {
+		t.Errorf("ставка после перечитывания %s, ожидалось 12.5", got)
+	}
+	if got := commissionRate(nil, 1000*money.USDT); got != percent("15") {
+		t.Errorf("ставка ступени после перечитывания %s, ожидалось 15", got)
+	}
+
+	// Некорректное значение не сбрасывает действующие ставки
+	writeEnv("COMMISSION_PERCENT=abc\n")
+	b.reloadRates()
+	if got := commissionRate(nil, 0); got != percent("12.5") {
+		t.Errorf("ставка после некорректного .env %s, ожидались прежние 12.5", got)
+	}
+}
+
+func TestAttributionWindowUsesDealDate(t *testing.T) {
+	// Приглашен 10 дней назад, окно 7 дней: срок уже прошел к моменту синхронизации
+	invitedAt := time.Now().AddDate(0, 0, -10).Truncate(time.Second)
+	deadline := invitedAt.AddDate(0, 0, 7)
+
+	for _, tc := range []struct {
+		name     string
+		date     time.Time
+		credited bool
+	}{
+		{name: "сделка внутри окна, обработана после срока", date: deadline.Add(-time.Minute), credited: true},
+		{name: "сделка ровно в конце окна", date: deadline, credited: true},
+		{name: "сделка после окна", date: deadline.Add(time.Second)},
+		{name: "дата сделки неизвестна", date: time.Time{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, store, _ := newTestBot(t)
+			config.AppConfig.AttributionWindowDays = 7
+
+			ref, err := store.CreateReferrer(111, "@ref")
+			if err != nil {
+				t.Fatalf("CreateReferrer: %v", err)
+			}
+			if _, _, err := store.ImportInvited([]sheets.Invited{{UserID: 1001, RefCode: ref.Code, InvitedAt: invitedAt}}); err != nil {
+				t.Fatalf("ImportInvited: %v", err)
+			}
+
+			err = b.processWithdrawal(sheets.Withdrawal{DealID: "D-1", UserID: 1001, Profit: 100 * money.USDT, Date: tc.date})
+			if err != nil {
+				t.Fatalf("processWithdrawal: %v", err)
+			}
+
+			credited, err := store.HasReferral("D-1", 1)
+			if err != nil {
+				t.Fatalf("HasReferral: %v", err)
+			}
+			if credited != tc.credited {
+				t.Errorf("начисление по сделке: %v, ожидалось %v", credited, tc.credited)
+			}
+		})
+	}
+}
@@ -0,0 +1,346 @@
+package bot
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"ss_ref_bot/config"
+	"ss_ref_bot/money"
+	"ss_ref_bot/sheets"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// PayoutLine - строка выгрузки для массовой отправки: кошелек, сумма в USDT и комментарий к переводу
+type PayoutLine struct {
+	Address string       `json:"address"`
+	Amount  money.Amount `json:"amount"`
+	Comment string       `json:"comment"`
+}
+
+// PayoutExport - параметры выгрузки выплат
+type PayoutExport struct {
+	Balances  bool         // перед выгрузкой оформить доступные остатки рефоводов одобренными заявками
+	MinAmount money.Amount // порог доступного остатка при Balances
+	Reviewer  string       // кем одобряются заявки по остаткам при Balances
+	Since     time.Time    // заявки, одобренные не раньше этого момента; нулевое - все
+	ExportID  string       // повторить выгрузку с этим ID, ничего не меняя; пустое - новая выгрузка
+	Format    string       // "csv" или "json"
+}
+
+// PayoutBatch - результат выгрузки: ее ID (записан в выгруженных заявках) и строки
+type PayoutBatch struct {
+	ID    string
+	Lines []PayoutLine
+}
+
+// ExportPayouts собирает выгрузку. Новая выгрузка включает только одобренные и еще не
+// выгруженные заявки и сразу переводит их в статус "выгружена" с ID выгрузки, поэтому
+// повторный запуск их не включит и одна заявка не будет оплачена дважды. С ExportID
+// повторно собирается уже сделанная выгрузка (например, если файл потерялся).
+// Заявки с некорректным адресом кошелька не выгружаются и пишутся в лог.
+func ExportPayouts(store Store, opts PayoutExport) (*PayoutBatch, error) {
+	if opts.ExportID != "" {
+		return exportedPayoutBatch(store, opts.ExportID)
+	}
+
+	if opts.Balances {
+		if err := approveBalancePayouts(store, opts.MinAmount, opts.Reviewer); err != nil {
+			return nil, err
+		}
+	}
+
+	requests, err := store.GetPayoutRequests()
+	if err != nil {
+		return nil, err
+	}
+
+	batch := &PayoutBatch{ID: newExportID()}
+	for _, req := range requests {
+		if req.Status != sheets.PayoutApproved || req.ReviewedAt.Before(opts.Since) {
+			continue
+		}
+
+		// Одобренная заявка без выплаты в Журнале не выгружается: ее сумма все еще числится к выплате
+		recorded, err := payoutRecorded(store, &req)
+		if err != nil {
+			return nil, err
+		}
+		if !recorded {
+			log.Printf("❌ Заявка %s одобрена, но выплаты по ней нет в Журнале, заявка не выгружена", req.ID)
+			continue
+		}
+
+		line, err := payoutLine(store, &req)
+		if err != nil {
+			return nil, err
+		}
+		if !walletRegex.MatchString(line.Address) {
+			log.Printf("⚠️ Некорректный кошелёк '%s' в заявке %s (%s USDT), заявка не выгружена", line.Address, req.ID, line.Amount)
+			continue
+		}
+
+		// Отмечаем до попадания в файл: заявка, которую параллельно выгрузил кто-то другой, пропускается
+		if _, err := store.MarkPayoutExported(req.ID, batch.ID); err != nil {
+			if errors.Is(err, sheets.ErrPayoutRequestNotApproved) {
+				log.Printf("⚠️ Заявка %s пропущена: %v", req.ID, err)
+				continue
+			}
+			return nil, fmt.Errorf("ошибка отметки заявки %s (уже отмеченные заявки можно выгрузить повторно по ID %s): %w",
+				req.ID, batch.ID, err)
+		}
+		batch.Lines = append(batch.Lines, line)
+	}
+	return batch, nil
+}
+
+// exportedPayoutBatch - заявки, выгруженные ранее с ID exportID
+func exportedPayoutBatch(store Store, exportID string) (*PayoutBatch, error) {
+	requests, err := store.GetPayoutRequests()
+	if err != nil {
+		return nil, err
+	}
+
+	batch := &PayoutBatch{ID: exportID}
+	for _, req := range requests {
+		if req.Status != sheets.PayoutExported || req.ExportID != exportID {
+			continue
+		}
+		line, err := payoutLine(store, &req)
+		if err != nil {
+			return nil, err
+		}
+		batch.Lines = append(batch.Lines, line)
+	}
+	return batch, nil
+}
+
+// payoutLine - строка выгрузки по заявке; комментарий - реферальный код рефовода
+func payoutLine(store Store, req *sheets.PayoutRequest) (PayoutLine, error) {
+	comment := req.ID
+	ref, err := store.GetReferrerByID(req.ReferrerID)
+	if err != nil {
+		return PayoutLine{}, fmt.Errorf("ошибка получения рефовода %d: %w", req.ReferrerID, err)
+	}
+	if ref != nil && ref.Code != "" {
+		comment = ref.Code
+	}
+	return PayoutLine{Address: req.Wallet, Amount: req.Amount, Comment: comment}, nil
+}
+
+// payoutRecorded сообщает, есть ли в Журнале выплата по заявке
+func payoutRecorded(store Store, req *sheets.PayoutRequest) (bool, error) {
+	entries, err := store.LedgerEntries(req.ReferrerID)
+	if err != nil {
+		return false, fmt.Errorf("ошибка чтения журнала рефовода %d: %w", req.ReferrerID, err)
+	}
+	id := sheets.NewPayoutEntry(req, "").ID
+	for _, e := range entries {
+		if e.ID == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// approveBalancePayouts создает и одобряет заявки на доступные остатки рефоводов с кошельком,
+// у которых доступно к выплате не меньше min: выплата записывается в Журнал так же, как при
+// одобрении заявки в чате администраторов, и остаток повторно не выгрузится. Рефоводы с
+// необработанной заявкой пропускаются - ее рассматривают администраторы.
+func approveBalancePayouts(store Store, min money.Amount, reviewer string) error {
+	referrers, err := store.GetReferrers()
+	if err != nil {
+		return err
+	}
+
+	for i := range referrers {
+		ref := &referrers[i]
+		if ref.Wallet == "" {
+			continue
+		}
+
+		balance, open, err := payoutBalance(store, ref)
+		if err != nil {
+			return fmt.Errorf("ошибка расчета остатка рефовода %d: %w", ref.ID, err)
+		}
+		if open != nil {
+			log.Printf("⚠️ У рефовода %d есть необработанная заявка %s, остаток не выгружен", ref.ID, open.ID)
+			continue
+		}
+		if balance.Available <= 0 || balance.Available < min {
+			continue
+		}
+		if !walletRegex.MatchString(ref.Wallet) {
+			log.Printf("⚠️ Некорректный кошелёк '%s' у рефовода %d (%s USDT), остаток не выгружен", ref.Wallet, ref.ID, balance.Available)
+			continue
+		}
+
+		req := sheets.NewPayoutRequest(ref, balance.Available)
+		if err := store.CreatePayoutRequest(&req); err != nil {
+			if errors.Is(err, sheets.ErrPayoutRequestOpen) {
+				log.Printf("⚠️ У рефовода %d появилась заявка на выплату, остаток не выгружен", ref.ID)
+				continue
+			}
+			return fmt.Errorf("ошибка создания заявки рефовода %d: %w", ref.ID, err)
+		}
+
+		_, err = approvePayoutRequest(store, req.ID, reviewer)
+		switch {
+		case errors.Is(err, errPayoutUnavailable):
+			// Остаток уменьшился (списание) между расчетом и одобрением: заявку закрываем
+			log.Printf("⚠️ Заявка %s по остатку не одобрена: %v", req.ID, err)
+			if _, err := store.ResolvePayoutRequest(req.ID, sheets.PayoutRejected, reviewer, "остаток изменился при выгрузке"); err != nil {
+				return fmt.Errorf("ошибка отклонения заявки %s: %w", req.ID, err)
+			}
+			continue
+		case errors.Is(err, errPayoutNotRecorded):
+			// Без выплаты в Журнале остаток остается к выплате: заявку закрываем и прерываем
+			// выгрузку, чтобы не выгрузить сумму, которую можно запросить еще раз
+			if _, rejectErr := store.ResolvePayoutRequest(req.ID, sheets.PayoutRejected, reviewer, "выплата не записана в Журнал"); rejectErr != nil {
+				log.Printf("❌ Заявка %s без выплаты в Журнале не отклонена: %v", req.ID, rejectErr)
+			}
+			return fmt.Errorf("ошибка одобрения заявки %s: %w", req.ID, err)
+		case err != nil:
+			return fmt.Errorf("ошибка одобрения заявки %s: %w", req.ID, err)
+		}
+
+		log.Printf("💰 Остаток рефовода %d оформлен заявкой %s: %s USDT", ref.ID, req.ID, req.Amount)
+	}
+	return nil
+}
+
+// newExportID - ID выгрузки вида E-1A2B3C4D
+func newExportID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return "E-" + strings.ToUpper(hex.EncodeToString(b))
+}
+
+// WritePayouts записывает выгрузку в формате CSV (заголовок address,amount,comment и строка
+// на перевод, сумма с точкой) или JSON (массив объектов с теми же полями)
+func WritePayouts(w io.Writer, lines []PayoutLine, format string) error {
+	switch format {
+	case "csv", "":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"address", "amount", "comment"})
+		for _, line := range lines {
+			cw.Write([]string{line.Address, line.Amount.String(), line.Comment})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return fmt.Errorf("ошибка записи CSV: %w", err)
+		}
+		return nil
+	case "json":
+		if lines == nil {
+			lines = []PayoutLine{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(lines); err != nil {
+			return fmt.Errorf("ошибка записи JSON: %w", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("неизвестный формат %q (допустимо: csv, json)", format)
+	}
+}
+
+// PayoutTotal - сумма всех строк выгрузки
+func PayoutTotal(lines []PayoutLine) money.Amount {
+	var total money.Amount
+	for _, line := range lines {
+		total += line.Amount
+	}
+	return total
+}
+
+// handleExport отправляет выгрузку выплат документом. Доступна только в чате администраторов
+// пользователям из ADMIN_USER_IDS. Аргументы в любом порядке: balances (сначала оформить
+// заявками доступные остатки), порог остатка, дата 02.01.2006 (заявки, одобренные с этого дня),
+// ID прошлой выгрузки E-... (повторить ее), json или csv.
+func (b *Bot) handleExport(msg *tgbotapi.Message) {
+	if !isAdmin(msg.From.ID) {
+		log.Printf("⚠️ Выгрузка выплат запрошена пользователем %d не из ADMIN_USER_IDS", msg.From.ID)
+		b.sendMessage(msg.Chat.ID, "Недостаточно прав для выгрузки выплат.")
+		return
+	}
+
+	opts := PayoutExport{MinAmount: config.AppConfig.MinPayout, Reviewer: reviewerName(msg.From), Format: "csv"}
+	for _, arg := range strings.Fields(msg.CommandArguments()) {
+		switch strings.ToLower(arg) {
+		case "csv", "json":
+			opts.Format = strings.ToLower(arg)
+			continue
+		case "balances", "остатки":
+			opts.Balances = true
+			continue
+		}
+
+		if strings.HasPrefix(strings.ToUpper(arg), "E-") {
+			opts.ExportID = strings.ToUpper(arg)
+		} else if since, err := time.ParseInLocation("02.01.2006", arg, time.Local); err == nil {
+			opts.Since = since
+		} else if amount, err := money.Parse(arg); err == nil {
+			opts.MinAmount = amount
+		} else {
+			b.sendMessage(msg.Chat.ID, "Использование: /export [balances] [порог] [дата 02.01.2006] [E-ID] [csv|json]\n\n"+
+				"Выгружаются одобренные и еще не выгруженные заявки (с даты, если она указана), после чего "+
+				"они получают статус \"выгружена\". С balances доступные остатки не меньше порога (по умолчанию "+
+				"MIN_PAYOUT) сначала оформляются одобренными заявками. С ID прошлой выгрузки она повторяется без изменений.")
+			return
+		}
+	}
+
+	batch, err := ExportPayouts(b.store, opts)
+	if err != nil {
+		log.Printf("❌ Ошибка выгрузки выплат: %v", err)
+		b.sendMessage(msg.Chat.ID, "Произошла ошибка при выгрузке. Попробуйте позже.")
+		return
+	}
+	if len(batch.Lines) == 0 {
+		if opts.ExportID != "" {
+			b.sendMessage(msg.Chat.ID, fmt.Sprintf("Выгрузка %s не найдена.", opts.ExportID))
+		} else {
+			b.sendMessage(msg.Chat.ID, "Нечего выгружать: подходящих выплат нет.")
+		}
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := WritePayouts(&buf, batch.Lines, opts.Format); err != nil {
+		log.Printf("❌ Ошибка выгрузки выплат: %v", err)
+		b.sendMessage(msg.Chat.ID, fmt.Sprintf("Произошла ошибка при выгрузке. Повторите ее командой /export %s", batch.ID))
+		return
+	}
+
+	total := PayoutTotal(batch.Lines)
+	log.Printf("💰 Выгрузка выплат %s для %d: %d строк, %s USDT", batch.ID, msg.From.ID, len(batch.Lines), total)
+
+	doc := tgbotapi.NewDocument(msg.Chat.ID, tgbotapi.FileBytes{
+		Name:  payoutExportFileName(batch.ID, opts.Format),
+		Bytes: buf.Bytes(),
+	})
+	doc.Caption = fmt.Sprintf("Выгрузка %s. Выплат: %d, сумма: %s USDT", batch.ID, len(batch.Lines), total)
+	if _, err := b.api.Send(doc); err != nil {
+		log.Printf("Ошибка отправки выгрузки %s: %v", batch.ID, err)
+		b.sendMessage(msg.Chat.ID, fmt.Sprintf("Не удалось отправить файл. Повторите выгрузку командой /export %s", batch.ID))
+	}
+}
+
+// payoutExportFileName - имя файла выгрузки, например payouts-E-1A2B3C4D.csv
+func payoutExportFileName(exportID, format string) string {
+	if format == "" {
+		format = "csv"
+	}
+	return fmt.Sprintf("payouts-%s.%s", exportID, format)
+}
@@ -0,0 +1,214 @@
+package bot
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"ss_ref_bot/money"
+	"ss_ref_bot/sheets"
+	"ss_ref_bot/sqlite"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+var testWallet = "UQ" + strings.Repeat("A", 46)
+
+// newExportFixture создает рефовода с кошельком и начислением 20 USDT без заявок
+func newExportFixture(t *testing.T) (*Bot, *sqlite.SQLiteStore, *fakeTelegram, *sheets.Referrer) {
+	t.Helper()
+
+	b, store, tg := newTestBot(t)
+	setTestAdmins()
+	return b, store, tg, newFundedReferrer(t, store, testWallet)
+}
+
+// approvedRequest создает и одобряет заявку рефовода на сумму amount
+func approvedRequest(t *testing.T, store *sqlite.SQLiteStore, ref *sheets.Referrer, amount money.Amount) *sheets.PayoutRequest {
+	t.Helper()
+
+	req := sheets.NewPayoutRequest(ref, amount)
+	if err := store.CreatePayoutRequest(&req); err != nil {
+		t.Fatalf("CreatePayoutRequest: %v", err)
+	}
+	approved, err := approvePayoutRequest(store, req.ID, "@admin")
+	if err != nil {
+		t.Fatalf("approvePayoutRequest: %v", err)
+	}
+	return approved
+}
+
+// sendExport отправляет команду /export в чат администраторов от имени пользователя
+func sendExport(b *Bot, userID int64, args string) {
+	text := strings.TrimSpace("/export " + args)
+	b.handleExport(&tgbotapi.Message{
+		Text:     text,
+		Entities: []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: len("/export")}},
+		From:     &tgbotapi.User{ID: userID, UserName: "admin"},
+		Chat:     &tgbotapi.Chat{ID: testAdminChatID},
+	})
+}
+
+func TestExportPayoutsOnce(t *testing.T) {
+	_, store, _, ref := newExportFixture(t)
+	req := approvedRequest(t, store, ref, 15*money.USDT)
+
+	first, err := ExportPayouts(store, PayoutExport{})
+	if err != nil {
+		t.Fatalf("первая выгрузка: %v", err)
+	}
+	if len(first.Lines) != 1 || first.Lines[0].Address != testWallet || first.Lines[0].Amount != 15*money.USDT {
+		t.Fatalf("первая выгрузка: %+v, ожидалась заявка %s на 15 USDT", first.Lines, req.ID)
+	}
+
+	requests, err := store.GetPayoutRequests()
+	if err != nil {
+		t.Fatalf("GetPayoutRequests: %v", err)
+	}
+	if requests[0].Status != sheets.PayoutExported || requests[0].ExportID != first.ID {
+		t.Errorf("заявка: статус %s, выгрузка %q; ожидалось %s и %s", requests[0].Status, requests[0].ExportID, sheets.PayoutExported, first.ID)
+	}
+
+	// Повторный запуск не выгружает ту же заявку второй раз
+	second, err := ExportPayouts(store, PayoutExport{})
+	if err != nil {
+		t.Fatalf("вторая выгрузка: %v", err)
+	}
+	if len(second.Lines) != 0 {
+		t.Errorf("вторая выгрузка: %+v, ожидалась пустая", second.Lines)
+	}
+
+	// Прошлую выгрузку можно получить повторно по ее ID
+	repeated, err := ExportPayouts(store, PayoutExport{ExportID: first.ID})
+	if err != nil {
+		t.Fatalf("повтор выгрузки: %v", err)
+	}
+	if len(repeated.Lines) != 1 || repeated.Lines[0] != first.Lines[0] {
+		t.Errorf("повтор выгрузки: %+v, ожидалось %+v", repeated.Lines, first.Lines)
+	}
+}
+
+func TestExportBalancesOnce(t *testing.T) {
+	_, store, _, _ := newExportFixture(t)
+	opts := PayoutExport{Balances: true, MinAmount: 10 * money.USDT, Reviewer: "export"}
+
+	first, err := ExportPayouts(store, opts)
+	if err != nil {
+		t.Fatalf("первая выгрузка: %v", err)
+	}
+	if len(first.Lines) != 1 || first.Lines[0].Amount != 20*money.USDT {
+		t.Fatalf("первая выгрузка: %+v, ожидался остаток 20 USDT", first.Lines)
+	}
+
+	// Остаток оформлен одобренной заявкой с выплатой в Журнале
+	second, err := ExportPayouts(store, opts)
+	if err != nil {
+		t.Fatalf("вторая выгрузка: %v", err)
+	}
+	if len(second.Lines) != 0 {
+		t.Errorf("вторая выгрузка: %+v, ожидалась пустая", second.Lines)
+	}
+
+	requests, err := store.GetPayoutRequests()
+	if err != nil {
+		t.Fatalf("GetPayoutRequests: %v", err)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("заявок %d, ожидалась 1", len(requests))
+	}
+	status, got, payouts := payoutState(t, store, &requests[0])
+	if status != sheets.PayoutExported || requests[0].ReviewedBy != "export" {
+		t.Errorf("заявка: статус %s, рассмотрел %q; ожидалось %s и export", status, requests[0].ReviewedBy, sheets.PayoutExported)
+	}
+	if payouts != 1 || got.PendingPayout != 0 || got.PaidOut != 20*money.USDT {
+		t.Errorf("выплат в Журнале %d, ожидает выплаты %s, выплачено %s; ожидалось 1, 0 и 20", payouts, got.PendingPayout, got.PaidOut)
+	}
+}
+
+func TestExportBalancesWithoutLedgerEntry(t *testing.T) {
+	_, store, _, _ := newExportFixture(t)
+	noPayoutRetryDelay(t)
+	failing := &failingLedgerStore{SQLiteStore: store, failures: payoutEntryAttempts}
+	opts := PayoutExport{Balances: true, MinAmount: 10 * money.USDT, Reviewer: "export"}
+
+	// Выплата не записана в Журнал: выгрузка прерывается, заявка закрыта
+	if batch, err := ExportPayouts(failing, opts); !errors.Is(err, errPayoutNotRecorded) {
+		t.Fatalf("выгрузка без Журнала: %+v, ошибка %v; ожидалась errPayoutNotRecorded", batch, err)
+	}
+	requests, err := store.GetPayoutRequests()
+	if err != nil {
+		t.Fatalf("GetPayoutRequests: %v", err)
+	}
+	if len(requests) != 1 || requests[0].Status != sheets.PayoutRejected {
+		t.Fatalf("заявки после сбоя: %+v, ожидалась одна отклоненная", requests)
+	}
+
+	// Остаток не потерян и выгружается один раз после восстановления Журнала
+	batch, err := ExportPayouts(failing, opts)
+	if err != nil {
+		t.Fatalf("выгрузка после восстановления: %v", err)
+	}
+	if len(batch.Lines) != 1 || batch.Lines[0].Amount != 20*money.USDT {
+		t.Errorf("выгрузка после восстановления: %+v, ожидался остаток 20 USDT", batch.Lines)
+	}
+}
+
+func TestExportSkipsApprovalWithoutLedgerEntry(t *testing.T) {
+	_, store, _, ref := newExportFixture(t)
+
+	// Заявку одобрили в обход бота: выплаты по ней в Журнале нет
+	req := sheets.NewPayoutRequest(ref, 20*money.USDT)
+	if err := store.CreatePayoutRequest(&req); err != nil {
+		t.Fatalf("CreatePayoutRequest: %v", err)
+	}
+	if _, err := store.ResolvePayoutRequest(req.ID, sheets.PayoutApproved, "@admin", ""); err != nil {
+		t.Fatalf("ResolvePayoutRequest: %v", err)
+	}
+
+	batch, err := ExportPayouts(store, PayoutExport{})
+	if err != nil {
+		t.Fatalf("ExportPayouts: %v", err)
+	}
+	if len(batch.Lines) != 0 {
+		t.Errorf("выгружена заявка без выплаты в Журнале: %+v", batch.Lines)
+	}
+	if status, _, _ := payoutState(t, store, &req); status != sheets.PayoutApproved {
+		t.Errorf("статус заявки %s, ожидалось %s", status, sheets.PayoutApproved)
+	}
+}
+
+func TestExportCommand(t *testing.T) {
+	b, store, tg, ref := newExportFixture(t)
+	req := approvedRequest(t, store, ref, 20*money.USDT)
+
+	// Участник чата администраторов, которого нет в ADMIN_USER_IDS
+	sendExport(b, testAdminUserID+1, "")
+	if docs := tg.sent("sendDocument"); len(docs) != 0 {
+		t.Fatalf("выгрузка отправлена пользователю не из ADMIN_USER_IDS: %+v", docs)
+	}
+	if status, _, _ := payoutState(t, store, req); status != sheets.PayoutApproved {
+		t.Errorf("статус заявки %s, ожидалось %s", status, sheets.PayoutApproved)
+	}
+
+	sendExport(b, testAdminUserID, "json")
+	sendExport(b, testAdminUserID, "json")
+	docs := tg.sent("sendDocument")
+	if len(docs) != 1 {
+		t.Fatalf("отправлено выгрузок %d, ожидалась 1", len(docs))
+	}
+
+	requests, err := store.GetPayoutRequests()
+	if err != nil {
+		t.Fatalf("GetPayoutRequests: %v", err)
+	}
+	exportID := requests[0].ExportID
+	if exportID == "" || !strings.Contains(docs[0].Params["caption"], exportID) {
+		t.Errorf("подпись выгрузки %q, ожидался ID %q", docs[0].Params["caption"], exportID)
+	}
+
+	// Повтор по ID присылает тот же файл
+	sendExport(b, testAdminUserID, strings.ToLower(exportID))
+	if docs := tg.sent("sendDocument"); len(docs) != 2 {
+		t.Errorf("отправлено выгрузок %d, ожидалось 2 после повтора по ID", len(docs))
+	}
+}
@@ -0,0 +1,47 @@
+package bot
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"ss_ref_bot/config"
+	"ss_ref_bot/sheets"
+)
+
+// holdPeriod - сколько начисление удерживается до выплаты (HOLD_DAYS)
+func holdPeriod() time.Duration {
+	return time.Duration(config.AppConfig.HoldDays) * 24 * time.Hour
+}
+
+// holdBalance делит остаток рефовода по журналу на доступный к выплате и удерживаемый
+func holdBalance(store Store, ref *sheets.Referrer) (sheets.HoldBalance, error) {
+	entries, err := store.LedgerEntries(ref.ID)
+	if err != nil {
+		return sheets.HoldBalance{}, fmt.Errorf("ошибка чтения журнала: %w", err)
+	}
+	return sheets.SplitHold(entries, holdPeriod(), time.Now()), nil
+}
+
+// holdInfo возвращает HTML-строки статистики о доступной и удерживаемой сумме.
+// Без срока удержания все начисления доступны сразу и строк нет.
+func (b *Bot) holdInfo(ref *sheets.Referrer) string {
+	if config.AppConfig.HoldDays <= 0 {
+		return ""
+	}
+
+	balance, _, err := payoutBalance(b.store, ref)
+	if err != nil {
+		log.Printf("Ошибка расчета удержания рефовода %d: %v", ref.ID, err)
+		return ""
+	}
+
+	info := fmt.Sprintf("<b>Доступно к выплате:</b> %s USDT\n"+
+		"<b>На удержании (%d дн.):</b> %s USDT\n",
+		balance.Available, config.AppConfig.HoldDays, balance.OnHold)
+	if balance.OnHold > 0 {
+		info += fmt.Sprintf("<b>Ближайшее освобождение:</b> %s — %s USDT\n",
+			balance.NextRelease.Format("02.01.2006"), balance.NextAmount)
+	}
+	return info
+}
@@ -0,0 +1,114 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"ss_ref_bot/config"
+	"ss_ref_bot/sheets"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// payoutBalance возвращает остаток рефовода с учетом удержания и необработанной заявки:
+// сумма заявки заблокирована и в доступное не входит
+func payoutBalance(store Store, ref *sheets.Referrer) (sheets.HoldBalance, *sheets.PayoutRequest, error) {
+	balance, err := holdBalance(store, ref)
+	if err != nil {
+		return balance, nil, err
+	}
+
+	open, err := store.OpenPayoutRequest(ref.ID)
+	if err != nil {
+		return balance, nil, fmt.Errorf("ошибка чтения заявки на выплату: %w", err)
+	}
+	if open != nil {
+		balance.Available -= open.Amount
+		if balance.Available < 0 {
+			balance.Available = 0
+		}
+	}
+	return balance, open, nil
+}
+
+// payoutRequestInfo возвращает HTML-строку статистики о необработанной заявке на выплату
+func (b *Bot) payoutRequestInfo(ref *sheets.Referrer) string {
+	open, err := b.store.OpenPayoutRequest(ref.ID)
+	if err != nil {
+		log.Printf("Ошибка чтения заявки рефовода %d: %v", ref.ID, err)
+		return ""
+	}
+	if open == nil {
+		return ""
+	}
+	return fmt.Sprintf("<b>В заявке на выплату:</b> %s USDT (%s, %s)\n", open.Amount, open.ID, open.Status)
+}
+
+// handlePayoutRequest создает заявку на выплату всей доступной суммы на привязанный кошелек
+func (b *Bot) handlePayoutRequest(msg *tgbotapi.Message, userID int64) {
+	ref, err := b.store.GetReferrerByID(userID)
+	if err != nil {
+		log.Printf("Ошибка получения рефовода: %v", err)
+		b.sendMessage(msg.Chat.ID, "Произошла ошибка. Попробуйте позже.")
+		return
+	}
+
+	if ref == nil {
+		b.sendMessage(msg.Chat.ID, "Вы еще не зарегистрированы как рефовод. Используйте команду /start.")
+		return
+	}
+
+	if ref.Wallet == "" {
+		b.sendMessage(msg.Chat.ID, "Для вывода подключите TON-кошелёк: кнопка 'Подключить TON-кошелёк' или команда /wallet.")
+		return
+	}
+
+	balance, open, err := payoutBalance(b.store, ref)
+	if err != nil {
+		log.Printf("Ошибка расчета доступной суммы рефовода %d: %v", ref.ID, err)
+		b.sendMessage(msg.Chat.ID, "Произошла ошибка. Попробуйте позже.")
+		return
+	}
+
+	if open != nil {
+		b.sendMessage(msg.Chat.ID, fmt.Sprintf(
+			"У вас уже есть заявка %s на %s USDT от %s, она ожидает обработки. Новую заявку можно будет создать после ее рассмотрения.",
+			open.ID, open.Amount, open.Time.Format("02.01.2006 15:04")))
+		return
+	}
+
+	if balance.Available < config.AppConfig.MinPayout {
+		text := fmt.Sprintf("Минимальная сумма вывода - %s USDT. Доступно к выплате: %s USDT.",
+			config.AppConfig.MinPayout, balance.Available)
+		if balance.OnHold > 0 {
+			text += fmt.Sprintf("\nЕще %s USDT на удержании, ближайшие %s USDT освободятся %s.",
+				balance.OnHold, balance.NextAmount, balance.NextRelease.Format("02.01.2006"))
+		}
+		b.sendMessage(msg.Chat.ID, text)
+		return
+	}
+
+	req := sheets.NewPayoutRequest(ref, balance.Available)
+	if err := b.store.CreatePayoutRequest(&req); err != nil {
+		if errors.Is(err, sheets.ErrPayoutRequestOpen) {
+			b.sendMessage(msg.Chat.ID, "У вас уже есть заявка на выплату, она ожидает обработки.")
+			return
+		}
+		log.Printf("Ошибка создания заявки на выплату: %v", err)
+		b.sendMessage(msg.Chat.ID, "Произошла ошибка при создании заявки. Попробуйте позже.")
+		return
+	}
+
+	log.Printf("💰 Заявка на выплату %s: рефовод %d, %s USDT на %s", req.ID, ref.ID, req.Amount, req.Wallet)
+	b.notifyAdmins(&req)
+
+	b.sendHTMLMessage(msg.Chat.ID, fmt.Sprintf(
+		"<b>✅ Заявка на выплату создана</b>\n\n"+
+			"<b>Номер:</b> %s\n"+
+			"<b>Сумма:</b> %s USDT\n"+
+			"<b>Кошелёк:</b> %s\n"+
+			"<b>Статус:</b> %s\n\n"+
+			"Сумма заблокирована до обработки заявки.",
+		req.ID, req.Amount, req.Wallet, req.Status))
+}
@@ -0,0 +1,66 @@
+package bot
+
+import (
+	"ss_ref_bot/money"
+	"ss_ref_bot/sheets"
+)
+
+// Store описывает хранилище данных реферальной программы, с которым работает бот.
+// Основная реализация - *sheets.SheetsClient, но бот может работать с любым
+// бэкендом (или фейком в тестах), реализующим этот интерфейс.
+type Store interface {
+	// LoadCache перечитывает данные из источника (если бэкенд использует кэш)
+	LoadCache() error
+
+	GetReferrerByID(userID int64) (*sheets.Referrer, error)
+	GetReferrerByCode(code string) (*sheets.Referrer, error)
+	// GetReferrers возвращает всех рефоводов
+	GetReferrers() ([]sheets.Referrer, error)
+	CreateReferrer(userID int64, username string) (*sheets.Referrer, error)
+	UpdateReferrer(ref *sheets.Referrer) error
+	// ModifyReferrer атомарно применяет fn к актуальным данным рефовода и сохраняет результат
+	ModifyReferrer(userID int64, fn func(ref *sheets.Referrer) error) (*sheets.Referrer, error)
+	IncrementRefCount(refCode string) error
+
+	GetInvitedByUserID(userID int64) (*sheets.Invited, error)
+	// CreateInvited возвращает ошибку sheets.ErrAlreadyInvited, если пользователь уже привязан
+	CreateInvited(userID int64, refCode string) error
+
+	GetNewWithdrawals() ([]sheets.Withdrawal, error)
+	// GetWithdrawals возвращает все сделки листа Выводы, включая уже обработанные
+	GetWithdrawals() ([]sheets.Withdrawal, error)
+	// GetReferrals возвращает все записи о начислениях по сделкам
+	GetReferrals() ([]sheets.Referral, error)
+	CreateReferral(ref *sheets.Referral) error
+	// HasReferral сообщает, есть ли уже запись о начислении по сделке на уровне level
+	HasReferral(dealID string, level int) (bool, error)
+	// ReferredProfit возвращает суммарную прибыль прямых рефералов с кодом refCode по уже начисленным сделкам
+	ReferredProfit(refCode string) (money.Amount, error)
+	// AppendLedgerEntry добавляет запись в журнал движения денег; запись с существующим ID пропускается
+	AppendLedgerEntry(entry sheets.LedgerEntry) error
+	// LedgerEntries возвращает записи журнала по рефоводу
+	LedgerEntries(referrerID int64) ([]sheets.LedgerEntry, error)
+
+	// CreatePayoutRequest сохраняет заявку на выплату; если у рефовода уже есть
+	// необработанная заявка, возвращает ошибку sheets.ErrPayoutRequestOpen
+	CreatePayoutRequest(req *sheets.PayoutRequest) error
+	// OpenPayoutRequest возвращает необработанную заявку рефовода или nil
+	OpenPayoutRequest(referrerID int64) (*sheets.PayoutRequest, error)
+	// ResolvePayoutRequest одобряет или отклоняет заявку в статусе "ожидает"; если заявку
+	// уже рассмотрели, возвращает ее вместе с ошибкой sheets.ErrPayoutRequestResolved
+	ResolvePayoutRequest(id string, status sheets.PayoutStatus, reviewer, reason string) (*sheets.PayoutRequest, error)
+	// ReopenPayoutRequest возвращает одобренную заявку в статус "ожидает"; если заявка
+	// не одобрена, возвращает ее вместе с ошибкой sheets.ErrPayoutRequestNotApproved
+	ReopenPayoutRequest(id string) (*sheets.PayoutRequest, error)
+	// MarkPayoutExported переводит одобренную заявку в статус "выгружена" с ID выгрузки exportID;
+	// если заявка уже выгружена или не одобрена, возвращает ее вместе с ошибкой
+	// sheets.ErrPayoutRequestNotApproved
+	MarkPayoutExported(id, exportID string) (*sheets.PayoutRequest, error)
+	// GetPayoutRequests возвращает все заявки на выплату в порядке создания
+	GetPayoutRequests() ([]sheets.PayoutRequest, error)
+
+	UpdatePendingPayouts() error
+}
+
+// Проверяем на этапе компиляции, что SheetsClient реализует Store
+var _ Store = (*sheets.SheetsClient)(nil)
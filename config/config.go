@@ -1,9 +1,16 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"ss_ref_bot/money"
 
 	"github.com/joho/godotenv"
 )
@@ -13,11 +20,163 @@ type Config struct {
 	SpreadsheetID    string
 	CredentialsPath  string
 	SyncIntervalHours int
+
+	// Хранилище: "sheets" (Google Таблица) или "sqlite" (локальная база)
+	Storage      string
+	SQLitePath   string
+	SheetsMirror bool // при Storage=sqlite дублировать изменения в Google Таблицу
+
+	// Ограничения Sheets API
+	SheetsRequestsPerMinute int
+	SheetsMaxRetries        int
+
+	// Отложенная запись в Sheets: интервал отправки (0 - писать сразу), порог и файл очереди
+	SheetsFlushIntervalSeconds int
+	SheetsFlushSize            int
+	SheetsSpoolPath            string
+
+	// Названия листов (пусто - название по умолчанию)
+	SheetReferrers      string
+	SheetInvited        string
+	SheetReferrals      string
+	SheetWithdrawals    string
+	SheetLedger         string
+	SheetPayoutRequests string
+
+	// Отдельная таблица с листом Выводы (пусто - та же, что SpreadsheetID)
+	WithdrawalsSpreadsheetID string
+
+	// Файл журнала незавершенных начислений бонусов
+	AccrualJournalPath string
+
+	// Ставки бонусов хранятся отдельно (CurrentRates): они перечитываются без перезапуска
+
+	// Сколько дней после приглашения сделки реферала приносят бонус; 0 - без ограничения
+	AttributionWindowDays int
+	// Сколько дней начисление удерживается, прежде чем станет доступно к выплате; 0 - сразу
+	HoldDays int
+	// Минимальная сумма заявки на выплату
+	MinPayout money.Amount
+	// Чат, куда приходят заявки на выплату с кнопками одобрения; 0 - заявки только в таблице
+	AdminChatID int64
+	// Пользователи, которые могут одобрять и отклонять заявки и выгружать выплаты в чате администраторов
+	AdminUserIDs []int64
+
+	// Явное расположение колонок: "Лист.поле" -> буква колонки.
+	// Колонки, которых здесь нет, находятся по заголовкам.
+	ColumnOverrides map[string]string
+}
+
+// CommissionTier - ступень ставки: Rate действует, когда суммарная прибыль рефералов не меньше From
+type CommissionTier struct {
+	From money.Amount
+	Rate money.Percent
+}
+
+// Rates - ставки бонусов. В отличие от остальных настроек они перечитываются
+// перед каждой синхронизацией (ReloadRates) и меняются без перезапуска бота.
+type Rates struct {
+	// Бонус рефоводу в процентах от прибыли реферала; используется и в расчете, и в текстах бота
+	CommissionPercent money.Percent
+	// Ступени ставки по суммарной прибыли рефералов (по возрастанию порога); пусто - без ступеней
+	CommissionTiers []CommissionTier
+	// Бонус пригласившему рефовода (второй уровень) в процентах от прибыли реферала; 0 - отключен
+	Level2CommissionPercent money.Percent
+}
+
+// String описывает ставки для логов: "10%, ступени 0:10 1000:12, второй уровень 2%"
+func (r Rates) String() string {
+	s := fmt.Sprintf("%s%%", r.CommissionPercent)
+	if len(r.CommissionTiers) > 0 {
+		s += ", ступени"
+		for _, tier := range r.CommissionTiers {
+			s += fmt.Sprintf(" %s:%s", tier.From, tier.Rate)
+		}
+	}
+	return s + fmt.Sprintf(", второй уровень %s%%", r.Level2CommissionPercent)
 }
 
 var AppConfig *Config
 
+var (
+	ratesMu sync.RWMutex
+	rates   Rates
+
+	// rateKeysFromEnv - ставки, заданные в окружении процесса при запуске.
+	// Как и при запуске, они важнее значений из .env.
+	rateKeysFromEnv = make(map[string]bool)
+)
+
+var rateKeys = []string{"COMMISSION_PERCENT", "COMMISSION_TIERS", "LEVEL2_COMMISSION_PERCENT"}
+
+// CurrentRates возвращает действующие ставки бонусов
+func CurrentRates() Rates {
+	ratesMu.RLock()
+	defer ratesMu.RUnlock()
+	return rates
+}
+
+// SetRates заменяет действующие ставки
+func SetRates(r Rates) {
+	ratesMu.Lock()
+	defer ratesMu.Unlock()
+	rates = r
+}
+
+// ReloadRates перечитывает ставки из .env (ставки из окружения процесса не меняются).
+// При ошибке действующие ставки остаются прежними. changed = true, если ставки изменились.
+func ReloadRates() (changed bool, err error) {
+	file, err := godotenv.Read()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, fmt.Errorf("ошибка чтения .env: %w", err)
+	}
+
+	lookup := func(key, defaultValue string) string {
+		if rateKeysFromEnv[key] {
+			return getEnv(key, defaultValue)
+		}
+		if value := file[key]; value != "" {
+			return value
+		}
+		return defaultValue
+	}
+
+	reloaded, err := parseRates(lookup)
+	if err != nil {
+		return false, err
+	}
+
+	ratesMu.Lock()
+	defer ratesMu.Unlock()
+	changed = reloaded.String() != rates.String()
+	rates = reloaded
+	return changed, nil
+}
+
+// Load загружает конфигурацию для запуска бота
 func Load() error {
+	if err := load(); err != nil {
+		return err
+	}
+
+	if AppConfig.TelegramToken == "" {
+		return &ConfigError{Message: "TELEGRAM_BOT_TOKEN не установлен"}
+	}
+
+	return nil
+}
+
+// LoadForCLI загружает конфигурацию для служебных команд, которым не нужен токен бота
+func LoadForCLI() error {
+	return load()
+}
+
+func load() error {
+	// Запоминаем ставки из окружения процесса до того, как .env дополнит окружение
+	for _, key := range rateKeys {
+		_, rateKeysFromEnv[key] = os.LookupEnv(key)
+	}
+
 	// Загружаем .env файл, если он существует
 	if err := godotenv.Load(); err != nil {
 		log.Printf("Предупреждение: .env файл не найден, используем переменные окружения")
@@ -28,13 +187,86 @@ func Load() error {
 		SpreadsheetID:     getEnv("SPREADSHEET_ID", ""),
 		CredentialsPath:   getEnv("GOOGLE_CREDENTIALS_PATH", "credentials.json"),
 		SyncIntervalHours: getEnvInt("SYNC_INTERVAL_HOURS", 2),
+		Storage:           getEnv("STORAGE", "sheets"),
+		SQLitePath:        getEnv("SQLITE_PATH", "ss_ref_bot.db"),
+		SheetsMirror:      getEnvBool("SHEETS_MIRROR", false),
+
+		SheetsRequestsPerMinute: getEnvInt("SHEETS_REQUESTS_PER_MINUTE", 60),
+		SheetsMaxRetries:        getEnvInt("SHEETS_MAX_RETRIES", 5),
+
+		SheetsFlushIntervalSeconds: getEnvInt("SHEETS_FLUSH_INTERVAL_SECONDS", 5),
+		SheetsFlushSize:            getEnvInt("SHEETS_FLUSH_SIZE", 50),
+		SheetsSpoolPath:            getEnv("SHEETS_SPOOL_PATH", "sheets_spool.jsonl"),
+
+		SheetReferrers:           getEnv("SHEET_REFERRERS", ""),
+		SheetInvited:             getEnv("SHEET_INVITED", ""),
+		SheetReferrals:           getEnv("SHEET_REFERRALS", ""),
+		SheetWithdrawals:         getEnv("SHEET_WITHDRAWALS", ""),
+		SheetLedger:              getEnv("SHEET_LEDGER", ""),
+		SheetPayoutRequests:      getEnv("SHEET_PAYOUT_REQUESTS", ""),
+		WithdrawalsSpreadsheetID: getEnv("WITHDRAWALS_SPREADSHEET_ID", ""),
+		AccrualJournalPath:       getEnv("ACCRUAL_JOURNAL_PATH", "accruals.jsonl"),
 	}
 
-	if AppConfig.TelegramToken == "" {
-		return &ConfigError{Message: "TELEGRAM_BOT_TOKEN не установлен"}
+	overrides, err := parseColumnOverrides(getEnv("SHEET_COLUMNS", ""))
+	if err != nil {
+		return &ConfigError{Message: fmt.Sprintf("некорректный SHEET_COLUMNS: %v", err)}
+	}
+	AppConfig.ColumnOverrides = overrides
+
+	initialRates, err := parseRates(getEnv)
+	if err != nil {
+		return err
+	}
+	SetRates(initialRates)
+
+	AppConfig.AttributionWindowDays = getEnvInt("ATTRIBUTION_WINDOW_DAYS", 0)
+	if AppConfig.AttributionWindowDays < 0 {
+		return &ConfigError{Message: fmt.Sprintf("ATTRIBUTION_WINDOW_DAYS не может быть отрицательным, получено %d", AppConfig.AttributionWindowDays)}
+	}
+
+	AppConfig.HoldDays = getEnvInt("HOLD_DAYS", 0)
+	if AppConfig.HoldDays < 0 {
+		return &ConfigError{Message: fmt.Sprintf("HOLD_DAYS не может быть отрицательным, получено %d", AppConfig.HoldDays)}
+	}
+
+	minPayout, err := money.Parse(getEnv("MIN_PAYOUT", "10"))
+	if err != nil {
+		return &ConfigError{Message: fmt.Sprintf("некорректный MIN_PAYOUT: %v", err)}
+	}
+	if minPayout <= 0 {
+		return &ConfigError{Message: fmt.Sprintf("MIN_PAYOUT должен быть больше 0, получено %s", minPayout)}
+	}
+	AppConfig.MinPayout = minPayout
+
+	if value := getEnv("ADMIN_CHAT_ID", ""); value != "" {
+		adminChatID, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return &ConfigError{Message: fmt.Sprintf("некорректный ADMIN_CHAT_ID: %v", err)}
+		}
+		AppConfig.AdminChatID = adminChatID
 	}
 
-	if AppConfig.SpreadsheetID == "" {
+	for _, value := range strings.Split(getEnv("ADMIN_USER_IDS", ""), ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		adminUserID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return &ConfigError{Message: fmt.Sprintf("некорректный ADMIN_USER_IDS: %v", err)}
+		}
+		AppConfig.AdminUserIDs = append(AppConfig.AdminUserIDs, adminUserID)
+	}
+	if AppConfig.AdminChatID != 0 && len(AppConfig.AdminUserIDs) == 0 {
+		return &ConfigError{Message: "ADMIN_USER_IDS обязателен, если задан ADMIN_CHAT_ID: укажите ID администраторов, которые рассматривают заявки"}
+	}
+
+	if AppConfig.Storage != "sheets" && AppConfig.Storage != "sqlite" {
+		return &ConfigError{Message: fmt.Sprintf("неизвестное хранилище STORAGE=%s (допустимо: sheets, sqlite)", AppConfig.Storage)}
+	}
+
+	// Хранилищу SQLite без зеркала Google Таблица не нужна
+	if AppConfig.SpreadsheetID == "" && (AppConfig.Storage == "sheets" || AppConfig.SheetsMirror) {
 		return &ConfigError{Message: "SPREADSHEET_ID не установлен"}
 	}
 
@@ -62,6 +294,105 @@ func getEnvInt(key string, defaultValue int) int {
 	return result
 }
 
+func getEnvBool(key string, defaultValue bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	result, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Ошибка парсинга %s, используем значение по умолчанию: %t", key, defaultValue)
+		return defaultValue
+	}
+	return result
+}
+
+// parseRates читает и проверяет ставки бонусов; get возвращает значение переменной или значение по умолчанию
+func parseRates(get func(key, defaultValue string) string) (Rates, error) {
+	var r Rates
+
+	commission, err := money.ParsePercent(get("COMMISSION_PERCENT", "10"))
+	if err != nil {
+		return r, &ConfigError{Message: fmt.Sprintf("некорректный COMMISSION_PERCENT: %v", err)}
+	}
+	if commission <= 0 || commission > 100*money.Percent(money.USDT) {
+		return r, &ConfigError{Message: fmt.Sprintf("COMMISSION_PERCENT должен быть больше 0 и не больше 100, получено %s", commission)}
+	}
+	r.CommissionPercent = commission
+
+	tiers, err := parseCommissionTiers(get("COMMISSION_TIERS", ""))
+	if err != nil {
+		return r, &ConfigError{Message: fmt.Sprintf("некорректный COMMISSION_TIERS: %v", err)}
+	}
+	r.CommissionTiers = tiers
+
+	level2, err := money.ParsePercent(get("LEVEL2_COMMISSION_PERCENT", "0"))
+	if err != nil {
+		return r, &ConfigError{Message: fmt.Sprintf("некорректный LEVEL2_COMMISSION_PERCENT: %v", err)}
+	}
+	if level2 < 0 || level2 > 100*money.Percent(money.USDT) {
+		return r, &ConfigError{Message: fmt.Sprintf("LEVEL2_COMMISSION_PERCENT должен быть от 0 до 100, получено %s", level2)}
+	}
+	r.Level2CommissionPercent = level2
+
+	return r, nil
+}
+
+// parseColumnOverrides разбирает строку вида "Рефоводы.wallet=H, Выводы.profit=E"
+func parseColumnOverrides(value string) (map[string]string, error) {
+	overrides := make(map[string]string)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		key, letter, ok := strings.Cut(item, "=")
+		key = strings.TrimSpace(key)
+		letter = strings.ToUpper(strings.TrimSpace(letter))
+		if !ok || !strings.Contains(key, ".") || letter == "" {
+			return nil, fmt.Errorf("ожидается формат Лист.поле=Колонка, получено %q", item)
+		}
+		overrides[key] = letter
+	}
+	return overrides, nil
+}
+
+// parseCommissionTiers разбирает ступени вида "0:10,1000:12,5000:15" (порог прибыли в USDT:ставка в %)
+func parseCommissionTiers(value string) ([]CommissionTier, error) {
+	var tiers []CommissionTier
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		from, rate, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, fmt.Errorf("ожидается формат порог:ставка, получено %q", item)
+		}
+
+		tier := CommissionTier{}
+		var err error
+		if tier.From, err = money.Parse(from); err != nil || tier.From < 0 {
+			return nil, fmt.Errorf("некорректный порог в %q", item)
+		}
+		if tier.Rate, err = money.ParsePercent(rate); err != nil || tier.Rate <= 0 || tier.Rate > 100*money.Percent(money.USDT) {
+			return nil, fmt.Errorf("ставка в %q должна быть больше 0 и не больше 100", item)
+		}
+		tiers = append(tiers, tier)
+	}
+
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].From < tiers[j].From })
+	for i := 1; i < len(tiers); i++ {
+		if tiers[i].From == tiers[i-1].From {
+			return nil, fmt.Errorf("порог %s указан дважды", tiers[i].From)
+		}
+	}
+	return tiers, nil
+}
+
 type ConfigError struct {
 	Message string
 }
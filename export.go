@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"ss_ref_bot/bot"
+	"ss_ref_bot/config"
+	"ss_ref_bot/money"
+)
+
+// runExport выгружает выплаты для массовой отправки в CSV или JSON. Выгруженные заявки
+// получают статус "выгружена", повторный запуск их не включит; --repeat повторяет выгрузку.
+// Пример: ss_ref_bot export [--balances [--min 10]] [--since 02.01.2006] [--repeat E-1A2B3C4D] [--format json] [--out payouts.csv]
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	balances := fs.Bool("balances", false, "перед выгрузкой оформить доступные остатки рефоводов одобренными заявками")
+	minAmount := fs.String("min", "", "порог доступного остатка для --balances, USDT (по умолчанию MIN_PAYOUT)")
+	since := fs.String("since", "", "выгрузить заявки, одобренные с этой даты (02.01.2006)")
+	repeat := fs.String("repeat", "", "повторить выгрузку с этим ID (E-...), ничего не меняя")
+	format := fs.String("format", "csv", "формат файла: csv или json")
+	out := fs.String("out", "", "файл для выгрузки (по умолчанию - стандартный вывод)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := config.LoadForCLI(); err != nil {
+		return fmt.Errorf("ошибка загрузки конфигурации: %w", err)
+	}
+
+	opts := bot.PayoutExport{
+		Balances:  *balances,
+		MinAmount: config.AppConfig.MinPayout,
+		Reviewer:  "export",
+		ExportID:  strings.ToUpper(*repeat),
+		Format:    *format,
+	}
+	if *minAmount != "" {
+		amount, err := money.Parse(*minAmount)
+		if err != nil {
+			return fmt.Errorf("некорректный --min: %w", err)
+		}
+		opts.MinAmount = amount
+	}
+	if *since != "" {
+		t, err := time.ParseInLocation("02.01.2006", *since, time.Local)
+		if err != nil {
+			return fmt.Errorf("некорректная дата --since, ожидается формат 02.01.2006: %w", err)
+		}
+		opts.Since = t
+	}
+	if opts.Format != "csv" && opts.Format != "json" {
+		return fmt.Errorf("неизвестный формат %q (допустимо: csv, json)", opts.Format)
+	}
+
+	sheetsClient, err := newOptionalSheetsClient(false)
+	if err != nil {
+		return fmt.Errorf("ошибка создания клиента Google Sheets: %w", err)
+	}
+
+	store, closeStore, err := openStore(sheetsClient)
+	if err != nil {
+		return fmt.Errorf("ошибка открытия базы SQLite: %w", err)
+	}
+	defer closeStore()
+
+	// Файл создаем до выгрузки: выгруженные заявки сразу получают статус "выгружена"
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return fmt.Errorf("ошибка создания файла выгрузки: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	batch, err := bot.ExportPayouts(store, opts)
+	if err != nil {
+		return err
+	}
+
+	if err := bot.WritePayouts(w, batch.Lines, opts.Format); err != nil {
+		return fmt.Errorf("%w (повторить: --repeat %s)", err, batch.ID)
+	}
+
+	// Итог пишем в stderr, чтобы не смешивать с выгрузкой в стандартном выводе
+	fmt.Fprintf(os.Stderr, "Выгрузка %s. Выгружено выплат: %d, сумма: %s USDT\n", batch.ID, len(batch.Lines), bot.PayoutTotal(batch.Lines))
+	return nil
+}
@@ -5,6 +5,7 @@ go 1.22
 require (
 	github.com/go-telegram-bot-api/telegram-bot-api/v5 v5.5.1
 	github.com/joho/godotenv v1.5.1
+	github.com/mattn/go-sqlite3 v1.14.32
 	google.golang.org/api v0.169.0
 )
 
@@ -1,36 +1,51 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"ss_ref_bot/bot"
 	"ss_ref_bot/config"
 	"ss_ref_bot/sheets"
+	"ss_ref_bot/sqlite"
 )
 
 func main() {
+	// Служебные команды: ss_ref_bot <команда> [флаги]
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatalf("Ошибка выполнения команды %s: %v", os.Args[1], err)
+		}
+		return
+	}
+
 	// Загружаем конфигурацию
 	if err := config.Load(); err != nil {
 		log.Fatalf("Ошибка загрузки конфигурации: %v", err)
 	}
 
-	// Создаем клиент Google Sheets
-	sheetsClient, err := sheets.NewSheetsClient(
-		config.AppConfig.SpreadsheetID,
-		config.AppConfig.CredentialsPath,
-	)
+	// Создаем клиент Google Sheets (хранилищу SQLite без SPREADSHEET_ID он не нужен)
+	sheetsClient, err := newOptionalSheetsClient(true)
 	if err != nil {
 		log.Fatalf("Ошибка создания клиента Google Sheets: %v", err)
 	}
 
-	// Проверяем наличие файла credentials
-	if _, err := os.Stat(config.AppConfig.CredentialsPath); os.IsNotExist(err) {
-		log.Fatalf("Файл credentials не найден: %s", config.AppConfig.CredentialsPath)
+	// Периодически пишем в лог счетчики вызовов Sheets API
+	if sheetsClient != nil {
+		go logSheetsStats(sheetsClient)
+	}
+
+	// Выбираем хранилище
+	store, closeStore, err := openStore(sheetsClient)
+	if err != nil {
+		log.Fatalf("Ошибка открытия базы SQLite: %v", err)
 	}
+	defer closeStore()
 
 	// Создаем бота
-	telegramBot, err := bot.NewBot(config.AppConfig.TelegramToken, sheetsClient)
+	telegramBot, err := bot.NewBot(config.AppConfig.TelegramToken, store)
 	if err != nil {
 		log.Fatalf("Ошибка создания бота: %v", err)
 	}
@@ -42,3 +57,90 @@ func main() {
 		log.Fatalf("Ошибка запуска бота: %v", err)
 	}
 }
+
+// runCommand выполняет служебную команду вместо запуска бота
+func runCommand(name string, args []string) error {
+	switch name {
+	case "migrate":
+		return runMigrate(args)
+	case "reconcile":
+		return runReconcile(args)
+	case "export":
+		return runExport(args)
+	default:
+		return fmt.Errorf("неизвестная команда %q (доступные команды: migrate, reconcile, export)", name)
+	}
+}
+
+// openStore возвращает хранилище по STORAGE: Google Таблицу или базу SQLite
+// (с зеркалом в таблицу по SHEETS_MIRROR) и функцию его закрытия.
+// sheetsClient может быть nil только для SQLite.
+func openStore(sheetsClient *sheets.SheetsClient) (bot.Store, func(), error) {
+	if config.AppConfig.Storage != "sqlite" {
+		return sheetsClient, func() {}, nil
+	}
+
+	sqliteStore, err := sqlite.NewSQLiteStore(config.AppConfig.SQLitePath, sheetsClient, config.AppConfig.SheetsMirror)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Printf("Используется хранилище SQLite: %s (зеркало в Google Таблицу: %t)",
+		config.AppConfig.SQLitePath, config.AppConfig.SheetsMirror)
+	if sheetsClient == nil {
+		log.Printf("Google Таблица не подключена: сделки читаются из таблицы withdrawals базы")
+	}
+	return sqliteStore, func() { sqliteStore.Close() }, nil
+}
+
+// newOptionalSheetsClient создает клиент Google Sheets, если задан SPREADSHEET_ID,
+// иначе возвращает nil (допустимо только для STORAGE=sqlite без зеркала)
+func newOptionalSheetsClient(queued bool) (*sheets.SheetsClient, error) {
+	if config.AppConfig.SpreadsheetID == "" {
+		return nil, nil
+	}
+
+	if _, err := os.Stat(config.AppConfig.CredentialsPath); os.IsNotExist(err) {
+		return nil, fmt.Errorf("файл credentials не найден: %s", config.AppConfig.CredentialsPath)
+	}
+	return newSheetsClient(queued)
+}
+
+// newSheetsClient создает клиент Google Sheets по текущей конфигурации.
+// queued = true - отложенная запись через очередь и файл spool (только для бота).
+// Команды CLI пишут синхронно и без spool: иначе они переотправили бы незавершенные
+// записи бота и подменили бы файл, в который он дописывает.
+func newSheetsClient(queued bool) (*sheets.SheetsClient, error) {
+	opts := sheets.Options{
+		SpreadsheetID:            config.AppConfig.SpreadsheetID,
+		CredentialsPath:          config.AppConfig.CredentialsPath,
+		WithdrawalsSpreadsheetID: config.AppConfig.WithdrawalsSpreadsheetID,
+		SheetNames: sheets.SheetNames{
+			Referrers:      config.AppConfig.SheetReferrers,
+			Invited:        config.AppConfig.SheetInvited,
+			Referrals:      config.AppConfig.SheetReferrals,
+			Withdrawals:    config.AppConfig.SheetWithdrawals,
+			Ledger:         config.AppConfig.SheetLedger,
+			PayoutRequests: config.AppConfig.SheetPayoutRequests,
+		},
+		ColumnOverrides:   config.AppConfig.ColumnOverrides,
+		RequestsPerMinute: config.AppConfig.SheetsRequestsPerMinute,
+		MaxRetries:        config.AppConfig.SheetsMaxRetries,
+	}
+	if queued {
+		opts.FlushInterval = time.Duration(config.AppConfig.SheetsFlushIntervalSeconds) * time.Second
+		opts.FlushSize = config.AppConfig.SheetsFlushSize
+		opts.SpoolPath = config.AppConfig.SheetsSpoolPath
+	}
+	return sheets.NewSheetsClient(opts)
+}
+
+// logSheetsStats раз в час пишет в лог количество и время вызовов Sheets API
+func logSheetsStats(sheetsClient *sheets.SheetsClient) {
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		log.Printf("Статистика Sheets API: %s", sheetsClient.StatsSummary())
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"ss_ref_bot/config"
+	"ss_ref_bot/sheets"
+	"ss_ref_bot/sqlite"
+)
+
+// runMigrate переносит листы Рефоводы, Приглашенные и Рефералы в новое хранилище.
+// Пример: ss_ref_bot migrate --to sqlite://ss_ref_bot.db
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	to := fs.String("to", "", "целевое хранилище, например sqlite://ss_ref_bot.db")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	dbPath, ok := strings.CutPrefix(*to, "sqlite://")
+	if !ok || dbPath == "" {
+		return fmt.Errorf("укажите целевое хранилище в формате --to sqlite://путь/к/базе.db")
+	}
+
+	if err := config.LoadForCLI(); err != nil {
+		return fmt.Errorf("ошибка загрузки конфигурации: %w", err)
+	}
+
+	sheetsClient, err := newSheetsClient(false)
+	if err != nil {
+		return fmt.Errorf("ошибка создания клиента Google Sheets: %w", err)
+	}
+
+	store, err := sqlite.NewSQLiteStore(dbPath, nil, false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	before, err := store.Totals()
+	if err != nil {
+		return err
+	}
+
+	referrers, rejectedReferrers, err := sheetsClient.ReadReferrers()
+	if err != nil {
+		return err
+	}
+	importedReferrers, conflictsReferrers, err := store.ImportReferrers(referrers)
+	if err != nil {
+		return err
+	}
+	printMigrateResult("Рефоводы", len(referrers)+len(rejectedReferrers), importedReferrers, rejectedReferrers, conflictsReferrers)
+
+	invited, rejectedInvited, err := sheetsClient.ReadInvited()
+	if err != nil {
+		return err
+	}
+	importedInvited, conflictsInvited, err := store.ImportInvited(invited)
+	if err != nil {
+		return err
+	}
+	printMigrateResult("Приглашенные", len(invited)+len(rejectedInvited), importedInvited, rejectedInvited, conflictsInvited)
+
+	referrals, rejectedReferrals, err := sheetsClient.ReadReferrals()
+	if err != nil {
+		return err
+	}
+	importedReferrals, conflictsReferrals, err := store.ImportReferrals(referrals)
+	if err != nil {
+		return err
+	}
+	printMigrateResult("Рефералы", len(referrals)+len(rejectedReferrals), importedReferrals, rejectedReferrals, conflictsReferrals)
+
+	// Сверяем прирост базы с прочитанными строками: количество записей и суммы должны совпасть
+	after, err := store.Totals()
+	if err != nil {
+		return err
+	}
+	expected := sqlite.ExpectedTotals(referrers, conflictsReferrers, invited, conflictsInvited, referrals, conflictsReferrals)
+	if diffs := expected.Mismatches(after.Sub(before)); len(diffs) > 0 {
+		return fmt.Errorf("сверка после переноса не сошлась:\n  - %s", strings.Join(diffs, "\n  - "))
+	}
+
+	fmt.Printf("Сверка: рефоводов %d (ожидает выплаты %s), приглашенных %d, начислений %d (прибыль %s, бонусы %s) - совпадает\n",
+		expected.Referrers, expected.Pending, expected.Invited, expected.Referrals, expected.Profit, expected.Bonus)
+	return nil
+}
+
+func printMigrateResult(sheet string, total, imported int, rejected []sheets.RejectedRow, conflicts []sqlite.ImportRejection) {
+	fmt.Printf("%s: прочитано строк %d, перенесено %d, отклонено %d\n",
+		sheet, total, imported, len(rejected)+len(conflicts))
+	for _, r := range rejected {
+		fmt.Printf("  - %s\n", r)
+	}
+	for _, c := range conflicts {
+		fmt.Printf("  - %s, %s: %s\n", sheet, c.Key, c.Reason)
+	}
+}
@@ -0,0 +1,254 @@
+// Package money хранит суммы в USDT с фиксированной точностью - в микро-USDT.
+// Сложение и вычитание сумм точные; округление выполняется только явно.
+package money
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Amount - сумма в микро-USDT (1 USDT = 1 000 000)
+type Amount int64
+
+const (
+	Micro Amount = 1
+	Cent  Amount = 10000
+	USDT  Amount = 1000000
+)
+
+// Количество знаков после запятой, которое хранит Amount
+const decimals = 6
+
+// FromFloat переводит сумму в USDT из float64, округляя до микро-USDT.
+// Используется для значений, которые приходят из Sheets API и SQLite как числа.
+func FromFloat(f float64) Amount {
+	return Amount(math.Round(f * float64(USDT)))
+}
+
+// Parse разбирает десятичную запись суммы в USDT: "12.5", "-0,35", "1 234.56".
+// Знаки после шестого округляются (половина - от нуля).
+func Parse(s string) (Amount, error) {
+	s = strings.TrimSpace(s)
+	s = strings.NewReplacer(" ", "", "\u00a0", "", ",", ".").Replace(s)
+	if s == "" {
+		return 0, fmt.Errorf("пустая сумма")
+	}
+
+	negative := false
+	switch s[0] {
+	case '-':
+		negative = true
+		s = s[1:]
+	case '+':
+		s = s[1:]
+	}
+
+	intPart, fracPart, _ := strings.Cut(s, ".")
+	if intPart == "" && fracPart == "" || !isDigits(intPart) || !isDigits(fracPart) {
+		// Экспоненциальная запись и т.п. - через float64
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, fmt.Errorf("некорректная сумма %q", s)
+		}
+		if negative {
+			f = -f
+		}
+		return FromFloat(f), nil
+	}
+
+	var units int64
+	if intPart != "" {
+		v, err := strconv.ParseInt(intPart, 10, 64)
+		if err != nil || v > math.MaxInt64/int64(USDT) {
+			return 0, fmt.Errorf("слишком большая сумма %q", s)
+		}
+		units = v * int64(USDT)
+	}
+
+	roundUp := len(fracPart) > decimals && fracPart[decimals] >= '5'
+	if len(fracPart) > decimals {
+		fracPart = fracPart[:decimals]
+	}
+	if fracPart != "" {
+		fracPart += strings.Repeat("0", decimals-len(fracPart))
+		v, _ := strconv.ParseInt(fracPart, 10, 64)
+		units += v
+	}
+	if roundUp {
+		units++
+	}
+
+	if negative {
+		units = -units
+	}
+	return Amount(units), nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Float64 возвращает сумму в USDT для записи в таблицу или базу
+func (a Amount) Float64() float64 {
+	return float64(a) / float64(USDT)
+}
+
+// String возвращает сумму в USDT: не меньше двух знаков после запятой,
+// лишние нули в конце отбрасываются ("12.50", "0.123456")
+func (a Amount) String() string {
+	sign := ""
+	u := uint64(a)
+	if a < 0 {
+		sign = "-"
+		u = uint64(-a)
+	}
+
+	frac := fmt.Sprintf("%06d", u%uint64(USDT))
+	frac = strings.TrimRight(frac, "0")
+	for len(frac) < 2 {
+		frac += "0"
+	}
+	return fmt.Sprintf("%s%d.%s", sign, u/uint64(USDT), frac)
+}
+
+// Round округляет сумму до кратного unit (половина - от нуля)
+func (a Amount) Round(unit Amount) Amount {
+	if unit <= 0 {
+		return a
+	}
+	half := unit / 2
+	if a < 0 {
+		return -((-a + half) / unit * unit)
+	}
+	return (a + half) / unit * unit
+}
+
+// RoundCents округляет сумму до цента (половина - от нуля). По этому правилу
+// округляются начисления перед записью, поэтому остатки всегда в целых центах.
+func (a Amount) RoundCents() Amount {
+	return a.Round(Cent)
+}
+
+// MulRatio умножает сумму на num/den с округлением до микро-USDT (половина - от нуля)
+func (a Amount) MulRatio(num, den int64) Amount {
+	if den == 0 {
+		panic("money: деление на ноль")
+	}
+	if den < 0 {
+		num, den = -num, -den
+	}
+
+	product := new(big.Int).Mul(big.NewInt(int64(a)), big.NewInt(num))
+	negative := product.Sign() < 0
+	product.Abs(product)
+
+	// (|a*num| + den/2) / den
+	product.Add(product, big.NewInt(den/2))
+	product.Quo(product, big.NewInt(den))
+	if negative {
+		product.Neg(product)
+	}
+	return Amount(product.Int64())
+}
+
+// Value сохраняет сумму в базе целым числом микро-USDT (колонки INTEGER),
+// поэтому суммы и SUM в базе точные
+func (a Amount) Value() (driver.Value, error) {
+	return int64(a), nil
+}
+
+// Scan читает сумму из базы: целое число - микро-USDT, дробное (старые колонки REAL) - USDT
+func (a *Amount) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*a = 0
+	case float64:
+		*a = FromFloat(v)
+	case int64:
+		*a = Amount(v)
+	case []byte:
+		return a.Scan(string(v))
+	case string:
+		parsed, err := Parse(v)
+		if err != nil {
+			return err
+		}
+		*a = parsed
+	default:
+		return fmt.Errorf("money: неподдерживаемый тип %T", src)
+	}
+	return nil
+}
+
+// MarshalJSON записывает сумму числом в USDT, как раньше записывался float64
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalJSON читает сумму из числа или строки в USDT
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "null" || s == "" {
+		*a = 0
+		return nil
+	}
+	parsed, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// Percent - процентная ставка с той же точностью, что и Amount (10% = 10 000 000)
+type Percent int64
+
+// ParsePercent разбирает ставку в процентах: "10", "7,5", "12.5%"
+func ParsePercent(s string) (Percent, error) {
+	a, err := Parse(strings.TrimSuffix(strings.TrimSpace(s), "%"))
+	if err != nil {
+		return 0, fmt.Errorf("некорректная ставка %q", s)
+	}
+	return Percent(a), nil
+}
+
+// String возвращает ставку без лишних нулей: "10", "7.5"
+func (p Percent) String() string {
+	s := Amount(p).String()
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// MulPercent возвращает p процентов от суммы с округлением до микро-USDT
+func (a Amount) MulPercent(p Percent) Amount {
+	return a.MulRatio(int64(p), 100*int64(USDT))
+}
+
+// Value сохраняет ставку в базе целым числом миллионных долей процента
+func (p Percent) Value() (driver.Value, error) {
+	return int64(p), nil
+}
+
+// Scan читает ставку из базы
+func (p *Percent) Scan(src interface{}) error {
+	return (*Amount)(p).Scan(src)
+}
+
+// MarshalJSON записывает ставку числом процентов
+func (p Percent) MarshalJSON() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalJSON читает ставку из числа или строки процентов
+func (p *Percent) UnmarshalJSON(data []byte) error {
+	return (*Amount)(p).UnmarshalJSON(data)
+}
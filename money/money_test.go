@@ -0,0 +1,120 @@
+package money
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Amount
+	}{
+		{"12.5", 12500000},
+		{"-0,35", -350000},
+		{"1 234.56", 1234560000},
+		{"0.0000015", 2},
+		{"7", 7000000},
+		{".25", 250000},
+		{"1e-2", 10000},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q) = %d, ожидалось %d", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "abc", "1.2.3"} {
+		if _, err := Parse(in); err == nil {
+			t.Errorf("Parse(%q): ожидалась ошибка", in)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := map[Amount]string{
+		12500000: "12.50",
+		-350000:  "-0.35",
+		123456:   "0.123456",
+		0:        "0.00",
+	}
+	for a, want := range tests {
+		if got := a.String(); got != want {
+			t.Errorf("Amount(%d).String() = %q, ожидалось %q", a, got, want)
+		}
+	}
+}
+
+func TestRoundingRules(t *testing.T) {
+	if got := Amount(12345).RoundCents(); got != 10000 {
+		t.Errorf("0.012345 до цента = %s", got)
+	}
+	if got := Amount(15000).RoundCents(); got != 20000 {
+		t.Errorf("0.015 до цента = %s, половина округляется от нуля", got)
+	}
+	if got := Amount(-15000).RoundCents(); got != -20000 {
+		t.Errorf("-0.015 до цента = %s, половина округляется от нуля", got)
+	}
+	if got := FromFloat(33.33).MulRatio(10, 100); got != 3333000 {
+		t.Errorf("10%% от 33.33 = %s", got)
+	}
+
+	rate, err := ParsePercent("7,5%")
+	if err != nil || rate.String() != "7.5" {
+		t.Fatalf("ParsePercent: %v, %s", err, rate)
+	}
+	if got := FromFloat(33.33).MulPercent(rate).RoundCents(); got != FromFloat(2.5) {
+		t.Errorf("7.5%% от 33.33 = %s, ожидалось 2.50", got)
+	}
+}
+
+func TestBonusesSumWithoutDrift(t *testing.T) {
+	// 0.1 * 0.3 в float64 дает 0.030000000000000002; тысячи таких сделок расходились с таблицей
+	var total Amount
+	profit := FromFloat(0.3)
+	for i := 0; i < 100000; i++ {
+		total += profit.MulRatio(10, 100).RoundCents()
+	}
+	if total != 3000*USDT {
+		t.Errorf("сумма бонусов = %s, ожидалось 3000.00", total)
+	}
+}
+
+func TestJSONCompatibleWithFloat(t *testing.T) {
+	var v struct{ Bonus Amount }
+	if err := json.Unmarshal([]byte(`{"Bonus": 1.5}`), &v); err != nil || v.Bonus != 1500000 {
+		t.Fatalf("чтение числа: %v, %s", err, v.Bonus)
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil || string(data) != `{"Bonus":1.50}` {
+		t.Errorf("запись: %s, %v", data, err)
+	}
+}
+
+func TestDatabaseValueIsMicroUSDT(t *testing.T) {
+	v, err := FromFloat(12.345678).Value()
+	if err != nil || v != int64(12345678) {
+		t.Fatalf("Value = %v (%T), %v; ожидалось int64 12345678", v, v, err)
+	}
+
+	for _, tc := range []struct {
+		src  interface{}
+		want Amount
+	}{
+		{int64(12345678), FromFloat(12.345678)}, // колонка INTEGER: микро-USDT
+		{0.3, FromFloat(0.3)},                   // старая колонка REAL: USDT
+		{[]byte("1.5"), FromFloat(1.5)},
+		{nil, 0},
+	} {
+		var a Amount
+		if err := a.Scan(tc.src); err != nil || a != tc.want {
+			t.Errorf("Scan(%v) = %s, %v; ожидалось %s", tc.src, a, err, tc.want)
+		}
+	}
+}
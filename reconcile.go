@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"ss_ref_bot/config"
+)
+
+// runReconcile сверяет балансы рефоводов с листом Приглашенные и Журналом.
+// Пример: ss_ref_bot reconcile [--apply]
+func runReconcile(args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	apply := fs.Bool("apply", false, "записать исправленные значения в таблицу")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := config.LoadForCLI(); err != nil {
+		return fmt.Errorf("ошибка загрузки конфигурации: %w", err)
+	}
+
+	// Сверка исправляет лист Рефоводы; в SQLite остатки пересчитываются по журналу базы
+	// при каждом обновлении "Ожидает выплаты", а лист - лишь зеркало
+	if config.AppConfig.Storage == "sqlite" {
+		return fmt.Errorf("reconcile сверяет Google Таблицу и при STORAGE=sqlite не применяется: " +
+			"остатки в базе пересчитываются по журналу автоматически")
+	}
+
+	sheetsClient, err := newSheetsClient(false)
+	if err != nil {
+		return fmt.Errorf("ошибка создания клиента Google Sheets: %w", err)
+	}
+
+	report, err := sheetsClient.Reconcile()
+	if err != nil {
+		return err
+	}
+
+	for _, d := range report.Diffs {
+		fmt.Printf("Рефовод %d (%s, строка %d):\n", d.ID, d.Code, d.Row)
+		if d.RefCountChanged() {
+			fmt.Printf("  Количество рефералов: %d -> %d\n", d.RefCount, d.ExpectedRefCount)
+		}
+		if d.PendingChanged() {
+			fmt.Printf("  Ожидает выплаты: %s -> %s (начислено %s, выплачено %s, разница %s)\n",
+				d.Pending, d.ExpectedPending, d.Earned, d.Paid, d.ExpectedPending-d.Pending)
+		}
+		if d.PaidChanged() {
+			fmt.Printf("  Выплачено: %s -> %s (по Журналу)\n", d.PaidOut, d.Paid)
+		}
+	}
+	for _, code := range report.UnknownCodes {
+		fmt.Printf("⚠️ Код %s встречается в Приглашенные или Рефералы, но рефовода с таким кодом нет\n", code)
+	}
+
+	for _, e := range report.LedgerEntries {
+		fmt.Printf("В Журнал: %s рефоводу %d, %s (%s)\n", e.Type, e.ReferrerID, e.Amount, e.Reason)
+	}
+
+	fmt.Printf("Проверено рефоводов: %d, с расхождениями: %d, недостает записей в Журнале: %d\n",
+		report.Checked, len(report.Diffs), len(report.LedgerEntries))
+
+	if len(report.Diffs) == 0 && len(report.LedgerEntries) == 0 {
+		return nil
+	}
+	if !*apply {
+		fmt.Println("Для записи исправлений запустите: reconcile --apply")
+		return nil
+	}
+
+	cells, err := sheetsClient.ApplyReconcile(report)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Исправления записаны, обновлено ячеек: %d\n", cells)
+	return nil
+}
@@ -0,0 +1,103 @@
+package sheets
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentReferralsAreNotLost(t *testing.T) {
+	const referrals = 100
+
+	f, sc := newFixture(t, Options{FlushInterval: 10 * time.Millisecond}, func(f *fakeSpreadsheet) {
+		f.addRow(referrersSchema.Name, "111", "@ref", "ABC123", "", 0, 0, 0)
+	})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, referrals)
+	for i := 0; i < referrals; i++ {
+		wg.Add(1)
+		go func(userID int64) {
+			defer wg.Done()
+			if err := sc.CreateInvited(userID, "ABC123"); err != nil {
+				errs <- err
+				return
+			}
+			if err := sc.IncrementRefCount("ABC123"); err != nil {
+				errs <- err
+			}
+		}(int64(1000 + i))
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("ошибка обработки реферала: %v", err)
+	}
+
+	if err := sc.Flush(); err != nil {
+		t.Fatalf("ошибка отправки очереди: %v", err)
+	}
+
+	// Каждый приглашенный должен попасть в свою строку
+	seen := make(map[string]bool)
+	for _, row := range f.dataRows(invitedSchema.Name) {
+		id := getStringValue(row[0])
+		if seen[id] {
+			t.Errorf("приглашенный %s записан дважды", id)
+		}
+		seen[id] = true
+	}
+	for i := 0; i < referrals; i++ {
+		if id := fmt.Sprintf("%d", 1000+i); !seen[id] {
+			t.Errorf("приглашенный %s потерян", id)
+		}
+	}
+
+	if got := getIntValue(f.cell(referrersSchema.Name, 2, 4)); got != referrals {
+		t.Errorf("счетчик рефералов в таблице = %d, ожидалось %d", got, referrals)
+	}
+
+	ref, _ := sc.GetReferrerByCode("ABC123")
+	if ref.RefCount != referrals {
+		t.Errorf("счетчик рефералов в кэше = %d, ожидалось %d", ref.RefCount, referrals)
+	}
+}
+
+func TestConcurrentInviteOfSameUser(t *testing.T) {
+	f, sc := newFixture(t, Options{}, func(f *fakeSpreadsheet) {
+		f.addRow(referrersSchema.Name, "111", "@ref", "ABC123", "", 0, 0, 0)
+	})
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created, duplicates := 0, 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := sc.CreateInvited(2000, "ABC123")
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				created++
+			case errors.Is(err, ErrAlreadyInvited):
+				duplicates++
+			default:
+				t.Errorf("неожиданная ошибка: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if created != 1 || duplicates != 9 {
+		t.Errorf("создано=%d, дубликатов=%d; ожидалось 1 и 9", created, duplicates)
+	}
+	if rows := f.dataRows(invitedSchema.Name); len(rows) != 1 {
+		t.Errorf("строк в Приглашенные = %d, ожидалась 1", len(rows))
+	}
+}
@@ -0,0 +1,337 @@
+package sheets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/api/option"
+	"google.golang.org/api/sheets/v4"
+)
+
+const testSpreadsheetID = "test-spreadsheet"
+
+// TestMain отключает логи клиента: тесты проверяют состояние таблицы, а не вывод
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// newFixture создает таблицу со стандартными заголовками, заполняет ее через seed
+// (может быть nil) и подключает к ней клиент
+func newFixture(t *testing.T, opts Options, seed func(f *fakeSpreadsheet)) (*fakeSpreadsheet, *SheetsClient) {
+	t.Helper()
+
+	f := newFakeSpreadsheet()
+	if seed != nil {
+		seed(f)
+	}
+	return f, newTestClient(t, f, opts)
+}
+
+// fakeSpreadsheet - таблица в памяти, отвечающая на запросы Sheets API,
+// которые использует SheetsClient (spreadsheets.get, values.get, values.update, values.batchGet, values.batchUpdate)
+type fakeSpreadsheet struct {
+	mu     sync.Mutex
+	sheets map[string][][]interface{} // название листа -> строки, включая заголовок
+
+	calls    map[string]int   // метод API -> число полученных запросов
+	failures map[string][]int // метод API -> коды ошибок, которыми ответить на следующие запросы
+}
+
+// newFakeSpreadsheet создает таблицу со стандартными заголовками всех листов
+func newFakeSpreadsheet() *fakeSpreadsheet {
+	f := &fakeSpreadsheet{
+		sheets:   make(map[string][][]interface{}),
+		calls:    make(map[string]int),
+		failures: make(map[string][]int),
+	}
+	for _, schema := range []sheetSchema{referrersSchema, invitedSchema, referralsSchema, withdrawalsSchema, ledgerSchema, payoutRequestsSchema} {
+		f.setHeader(schema.Name, schema.header()...)
+	}
+	return f
+}
+
+// setHeader заменяет строку заголовков листа
+func (f *fakeSpreadsheet) setHeader(sheet string, header ...interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.sheets[sheet]) == 0 {
+		f.sheets[sheet] = [][]interface{}{header}
+		return
+	}
+	f.sheets[sheet][0] = header
+}
+
+// addRow дописывает строку в конец листа
+func (f *fakeSpreadsheet) addRow(sheet string, row ...interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sheets[sheet] = append(f.sheets[sheet], row)
+}
+
+// cell возвращает значение ячейки (row - номер строки листа, col - индекс колонки с нуля)
+func (f *fakeSpreadsheet) cell(sheet string, row, col int) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rows := f.sheets[sheet]
+	if row-1 >= len(rows) || col >= len(rows[row-1]) {
+		return nil
+	}
+	return rows[row-1][col]
+}
+
+// dataRows возвращает строки листа без заголовка
+func (f *fakeSpreadsheet) dataRows(sheet string) [][]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rows := f.sheets[sheet]
+	result := make([][]interface{}, 0, len(rows))
+	for _, row := range rows[1:] {
+		result = append(result, append([]interface{}(nil), row...))
+	}
+	return result
+}
+
+// fail задает коды ошибок, которыми ответить на следующие вызовы метода (например, "values.batchUpdate")
+func (f *fakeSpreadsheet) fail(method string, codes ...int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[method] = append(f.failures[method], codes...)
+}
+
+// callCount возвращает число запросов метода, включая завершившиеся ошибкой
+func (f *fakeSpreadsheet) callCount(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[method]
+}
+
+// nextFailure учитывает вызов метода и возвращает заданный для него код ошибки (0 - без ошибки)
+func (f *fakeSpreadsheet) nextFailure(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[method]++
+	codes := f.failures[method]
+	if len(codes) == 0 {
+		return 0
+	}
+	f.failures[method] = codes[1:]
+	return codes[0]
+}
+
+// apiMethod возвращает название метода Sheets API по запросу, как в счетчиках клиента
+func apiMethod(r *http.Request, path string) string {
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+		return "spreadsheets.get"
+	case path == "/values:batchGet":
+		return "values.batchGet"
+	case path == "/values:batchUpdate":
+		return "values.batchUpdate"
+	case strings.HasPrefix(path, "/values/") && r.Method == http.MethodGet:
+		return "values.get"
+	case strings.HasPrefix(path, "/values/") && r.Method == http.MethodPut:
+		return "values.update"
+	}
+	return r.Method + " " + path
+}
+
+// newTestClient запускает фейковый сервер и создает клиент, работающий с ним
+func newTestClient(t *testing.T, f *fakeSpreadsheet, opts Options) *SheetsClient {
+	t.Helper()
+
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	service, err := sheets.NewService(context.Background(),
+		option.WithEndpoint(server.URL+"/"),
+		option.WithHTTPClient(server.Client()),
+		option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("ошибка создания сервиса: %v", err)
+	}
+
+	opts.SpreadsheetID = testSpreadsheetID
+	if opts.RequestsPerMinute == 0 {
+		opts.RequestsPerMinute = 1000000
+	}
+
+	client, err := newSheetsClient(service, opts)
+	if err != nil {
+		t.Fatalf("ошибка создания клиента: %v", err)
+	}
+	return client
+}
+
+func (f *fakeSpreadsheet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix := "/v4/spreadsheets/" + testSpreadsheetID
+	path := strings.TrimPrefix(r.URL.Path, prefix)
+
+	if code := f.nextFailure(apiMethod(r, path)); code != 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		fmt.Fprintf(w, `{"error":{"code":%d,"message":"injected failure"}}`, code)
+		return
+	}
+
+	var resp interface{}
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+		resp = f.spreadsheet()
+	case path == "/values:batchGet" && r.Method == http.MethodGet:
+		var ranges []*sheets.ValueRange
+		for _, a1 := range r.URL.Query()["ranges"] {
+			ranges = append(ranges, f.read(a1))
+		}
+		resp = &sheets.BatchGetValuesResponse{ValueRanges: ranges}
+	case path == "/values:batchUpdate" && r.Method == http.MethodPost:
+		var body sheets.BatchUpdateValuesRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var cells int64
+		for _, data := range body.Data {
+			cells += f.write(data.Range, data.Values)
+		}
+		resp = &sheets.BatchUpdateValuesResponse{TotalUpdatedCells: cells}
+	case strings.HasPrefix(path, "/values/") && r.Method == http.MethodGet:
+		resp = f.read(strings.TrimPrefix(path, "/values/"))
+	case strings.HasPrefix(path, "/values/") && r.Method == http.MethodPut:
+		var body sheets.ValueRange
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a1 := strings.TrimPrefix(path, "/values/")
+		resp = &sheets.UpdateValuesResponse{UpdatedRange: a1, UpdatedCells: f.write(a1, body.Values)}
+	default:
+		http.Error(w, "unsupported request: "+r.Method+" "+r.URL.Path, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (f *fakeSpreadsheet) spreadsheet() *sheets.Spreadsheet {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	result := &sheets.Spreadsheet{}
+	for name := range f.sheets {
+		result.Sheets = append(result.Sheets, &sheets.Sheet{Properties: &sheets.SheetProperties{Title: name}})
+	}
+	return result
+}
+
+// read возвращает значения диапазона, обрезая пустые строки и ячейки в конце, как Sheets API
+func (f *fakeSpreadsheet) read(a1 string) *sheets.ValueRange {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sheet, c1, r1, c2, r2 := parseA1(a1)
+	rows := f.sheets[sheet]
+	if r2 < 0 || r2 > len(rows) {
+		r2 = len(rows)
+	}
+
+	var values [][]interface{}
+	for r := r1; r <= r2; r++ {
+		src := rows[r-1]
+		end := c2
+		if end < 0 || end >= len(src) {
+			end = len(src) - 1
+		}
+
+		var row []interface{}
+		for c := c1; c <= end; c++ {
+			row = append(row, src[c])
+		}
+		for len(row) > 0 && (row[len(row)-1] == nil || row[len(row)-1] == "") {
+			row = row[:len(row)-1]
+		}
+		values = append(values, row)
+	}
+
+	for len(values) > 0 && len(values[len(values)-1]) == 0 {
+		values = values[:len(values)-1]
+	}
+
+	return &sheets.ValueRange{Range: a1, Values: values}
+}
+
+// write записывает значения начиная с левой верхней ячейки диапазона; nil пропускается
+func (f *fakeSpreadsheet) write(a1 string, values [][]interface{}) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sheet, c1, r1, _, _ := parseA1(a1)
+	rows := f.sheets[sheet]
+
+	var cells int64
+	for i, row := range values {
+		r := r1 + i
+		for len(rows) < r {
+			rows = append(rows, nil)
+		}
+		for j, value := range row {
+			if value == nil {
+				continue
+			}
+			c := c1 + j
+			for len(rows[r-1]) <= c {
+				rows[r-1] = append(rows[r-1], nil)
+			}
+			rows[r-1][c] = value
+			cells++
+		}
+	}
+
+	f.sheets[sheet] = rows
+	return cells
+}
+
+// parseA1 разбирает диапазон вида 'Лист'!A2:G, 'Лист'!A5 или 'Лист'!1:1.
+// Открытые границы возвращаются как -1; колонки - с нуля, строки - с единицы.
+func parseA1(a1 string) (sheet string, c1, r1, c2, r2 int) {
+	i := strings.LastIndex(a1, "!")
+	sheet = strings.ReplaceAll(strings.Trim(a1[:i], "'"), "''", "'")
+
+	parts := strings.SplitN(a1[i+1:], ":", 2)
+	c1, r1 = parseCell(parts[0])
+	if c1 < 0 {
+		c1 = 0
+	}
+	if r1 < 0 {
+		r1 = 1
+	}
+	if len(parts) == 1 {
+		return sheet, c1, r1, c1, r1
+	}
+
+	c2, r2 = parseCell(parts[1])
+	return sheet, c1, r1, c2, r2
+}
+
+func parseCell(cell string) (col, row int) {
+	letters := strings.TrimRight(cell, "0123456789")
+	col, row = -1, -1
+	if letters != "" {
+		col, _ = columnIndex(letters)
+	}
+	if digits := cell[len(letters):]; digits != "" {
+		row, _ = strconv.Atoi(digits)
+	}
+	return col, row
+}
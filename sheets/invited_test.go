@@ -0,0 +1,84 @@
+package sheets
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInvitedDateIsRecorded(t *testing.T) {
+	f, sc := newFixture(t, Options{}, func(f *fakeSpreadsheet) {
+		// Старый лист без колонки "Дата приглашения" и приглашенный без даты
+		f.setHeader(invitedSchema.Name, "ID пользователя", "Код пригласившего")
+		f.addRow(invitedSchema.Name, "1001", "ABC123")
+		f.addRow(referrersSchema.Name, "111", "@blogger", "ABC123", "", 1, 0, 0)
+	})
+
+	if got := f.cell(invitedSchema.Name, 1, 2); got != "Дата приглашения" {
+		t.Fatalf("заголовок Приглашенные!C1 = %v, ожидалась новая колонка", got)
+	}
+
+	before := time.Now().Truncate(time.Second)
+	if err := sc.CreateInvited(1002, "ABC123"); err != nil {
+		t.Fatalf("ошибка создания приглашенного: %v", err)
+	}
+	if err := sc.Flush(); err != nil {
+		t.Fatalf("ошибка отправки очереди: %v", err)
+	}
+	if err := sc.LoadCache(); err != nil {
+		t.Fatalf("ошибка загрузки кэша: %v", err)
+	}
+
+	old, _ := sc.GetInvitedByUserID(1001)
+	if !old.InvitedAt.IsZero() {
+		t.Errorf("дата старого приглашения = %v, ожидалась нулевая", old.InvitedAt)
+	}
+	inv, _ := sc.GetInvitedByUserID(1002)
+	if inv.InvitedAt.Before(before) || inv.InvitedAt.After(time.Now()) {
+		t.Errorf("дата приглашения = %v, ожидалось текущее время", inv.InvitedAt)
+	}
+
+	for _, s := range []string{"05.03.2025 14:30:15", " 05.03.2025 14:30 "} {
+		if _, ok := parseSheetTime(s); !ok {
+			t.Errorf("дата %q не разобрана", s)
+		}
+	}
+	if _, ok := parseSheetTime("2025-03-05"); ok {
+		t.Errorf("неожиданно разобран формат ISO")
+	}
+}
+
+func TestWithdrawalDateIsRead(t *testing.T) {
+	f, sc := newFixture(t, Options{}, func(f *fakeSpreadsheet) {
+		f.addRow(withdrawalsSchema.Name, "D-1", "1001", 10, "05.03.2025 14:30")
+		f.addRow(withdrawalsSchema.Name, "D-2", "1002", 10)
+		f.addRow(withdrawalsSchema.Name, "D-3", "1003", 10, "вчера")
+	})
+
+	withdrawals, err := sc.GetWithdrawals()
+	if err != nil {
+		t.Fatalf("GetWithdrawals: %v", err)
+	}
+	if len(withdrawals) != 3 {
+		t.Fatalf("выводов %d, ожидалось 3", len(withdrawals))
+	}
+	if want := time.Date(2025, 3, 5, 14, 30, 0, 0, time.Local); !withdrawals[0].Date.Equal(want) {
+		t.Errorf("дата сделки D-1 = %v, ожидалось %v", withdrawals[0].Date, want)
+	}
+	for _, w := range withdrawals[1:] {
+		if !w.Date.IsZero() {
+			t.Errorf("дата сделки %s = %v, ожидалась неизвестная", w.DealID, w.Date)
+		}
+	}
+
+	// Лист Выводы без колонки "Дата" только читается: колонка не добавляется
+	f, sc = newFixture(t, Options{}, func(f *fakeSpreadsheet) {
+		f.setHeader(withdrawalsSchema.Name, "ID сделки", "ID пользователя", "Прибыль")
+		f.addRow(withdrawalsSchema.Name, "D-1", "1001", 10)
+	})
+	if got := f.cell(withdrawalsSchema.Name, 1, 3); got != nil {
+		t.Errorf("в лист Выводы добавлена колонка %v", got)
+	}
+	if withdrawals, err := sc.GetWithdrawals(); err != nil || len(withdrawals) != 1 || !withdrawals[0].Date.IsZero() {
+		t.Errorf("GetWithdrawals без колонки Дата: %+v, %v", withdrawals, err)
+	}
+}
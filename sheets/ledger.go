@@ -0,0 +1,425 @@
+package sheets
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"ss_ref_bot/money"
+)
+
+// LedgerEntryType - тип записи журнала
+type LedgerEntryType string
+
+const (
+	EntryAccrual    LedgerEntryType = "начисление"    // бонус за сделку реферала
+	EntryPayout     LedgerEntryType = "выплата"       // выплата рефоводу
+	EntryAdjustment LedgerEntryType = "корректировка" // ручное изменение остатка
+	EntryClawback   LedgerEntryType = "списание"      // отмена ранее начисленного бонуса
+)
+
+// Счета журнала. Каждая запись переносит сумму со счета дебета на счет кредита;
+// остаток рефовода - кредит его счета минус дебет.
+const (
+	ProgramAccount = "программа" // расходы реферальной программы
+	PayoutAccount  = "выплаты"   // деньги, отправленные рефоводам
+)
+
+// ReferrerAccount - счет рефовода в журнале
+func ReferrerAccount(referrerID int64) string {
+	return fmt.Sprintf("рефовод:%d", referrerID)
+}
+
+// LedgerEntry - запись журнала движения денег. Записи только добавляются;
+// ошибки исправляются новой записью (корректировкой или списанием).
+type LedgerEntry struct {
+	ID         string
+	Time       time.Time
+	Type       LedgerEntryType
+	ReferrerID int64
+	Debit      string
+	Credit     string
+	Amount     money.Amount // всегда положительная, направление задают счета
+	DealID     string
+	Reason     string
+}
+
+// NewLedgerEntry создает запись с проводкой по типу операции. Для корректировки amount
+// может быть отрицательным (уменьшение остатка). Начисление по сделке получает ID по сделке,
+// поэтому повторная запись того же начисления отбрасывается.
+func NewLedgerEntry(entryType LedgerEntryType, referrerID int64, amount money.Amount, dealID, reason string) LedgerEntry {
+	entry := LedgerEntry{
+		ID:         newLedgerEntryID(entryType, dealID),
+		Time:       time.Now(),
+		Type:       entryType,
+		ReferrerID: referrerID,
+		DealID:     dealID,
+		Reason:     reason,
+	}
+	entry.Debit, entry.Credit, entry.Amount = postingAccounts(entryType, referrerID, amount)
+	return entry
+}
+
+// postingAccounts возвращает счета дебета и кредита для операции и положительную сумму
+func postingAccounts(entryType LedgerEntryType, referrerID int64, amount money.Amount) (debit, credit string, positive money.Amount) {
+	account := ReferrerAccount(referrerID)
+	switch entryType {
+	case EntryPayout:
+		debit, credit = account, PayoutAccount
+	case EntryClawback:
+		debit, credit = account, ProgramAccount
+	default: // начисление и корректировка в пользу рефовода
+		debit, credit = ProgramAccount, account
+	}
+
+	if amount < 0 {
+		debit, credit = credit, debit
+		amount = -amount
+	}
+	return debit, credit, amount
+}
+
+// NewAccrualEntry создает начисление по сделке на указанном уровне партнерской цепочки.
+// У каждого уровня свой ID, поэтому начисления разным рефоводам по одной сделке не склеиваются.
+func NewAccrualEntry(referrerID int64, amount money.Amount, dealID string, level int, reason string) LedgerEntry {
+	entry := NewLedgerEntry(EntryAccrual, referrerID, amount, dealID, reason)
+	entry.ID = accrualEntryID(dealID, level)
+	return entry
+}
+
+// NewPayoutEntry создает выплату по одобренной заявке. ID записи - по заявке,
+// поэтому выплата по одной заявке не может попасть в журнал дважды.
+func NewPayoutEntry(req *PayoutRequest, reason string) LedgerEntry {
+	entry := NewLedgerEntry(EntryPayout, req.ReferrerID, req.Amount, "", reason)
+	entry.ID = "payout:" + req.ID
+	return entry
+}
+
+// accrualEntryID - ID начисления по сделке; у первого уровня ID без номера уровня,
+// как и у записей, сделанных до появления уровней
+func accrualEntryID(dealID string, level int) string {
+	return "accrual:" + referralKey(dealID, level)
+}
+
+func newLedgerEntryID(entryType LedgerEntryType, dealID string) string {
+	if entryType == EntryAccrual && dealID != "" {
+		return accrualEntryID(dealID, 1)
+	}
+
+	prefix := map[LedgerEntryType]string{
+		EntryAccrual:    "accrual",
+		EntryPayout:     "payout",
+		EntryAdjustment: "adjustment",
+		EntryClawback:   "clawback",
+	}[entryType]
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	return prefix + ":" + hex.EncodeToString(b)
+}
+
+// LedgerBalance - остаток рефовода по записям журнала
+type LedgerBalance struct {
+	Accrued money.Amount // начислено с учетом корректировок и списаний
+	Paid    money.Amount // выплачено
+}
+
+// Pending - сумма к выплате: начислено минус выплачено
+func (b LedgerBalance) Pending() money.Amount {
+	return b.Accrued - b.Paid
+}
+
+// Apply учитывает запись в остатке рефовода
+func (b *LedgerBalance) Apply(e LedgerEntry) {
+	delta := e.referrerDelta()
+	if e.Type == EntryPayout {
+		b.Paid -= delta
+	} else {
+		b.Accrued += delta
+	}
+}
+
+// referrerDelta - изменение счета рефовода по записи: кредит увеличивает, дебет уменьшает
+func (e LedgerEntry) referrerDelta() money.Amount {
+	account := ReferrerAccount(e.ReferrerID)
+
+	var delta money.Amount
+	if e.Credit == account {
+		delta += e.Amount
+	}
+	if e.Debit == account {
+		delta -= e.Amount
+	}
+	return delta
+}
+
+// HoldBalance - остаток к выплате с учетом срока удержания начислений
+type HoldBalance struct {
+	Available   money.Amount // можно выплатить
+	OnHold      money.Amount // начислено, но срок удержания еще не прошел
+	NextRelease time.Time    // когда освободятся ближайшие начисления (нулевое - удержанных нет)
+	NextAmount  money.Amount // сколько освободится в день NextRelease
+}
+
+// SplitHold делит остаток рефовода по записям журнала на доступный и удерживаемый:
+// начисление становится доступным через hold после записи. Корректировки, списания
+// и выплаты действуют сразу, поэтому на удержании не больше, чем остаток к выплате.
+func SplitHold(entries []LedgerEntry, hold time.Duration, now time.Time) HoldBalance {
+	var balance LedgerBalance
+	var result HoldBalance
+	var releases []LedgerEntry
+	for _, e := range entries {
+		balance.Apply(e)
+		if e.Type != EntryAccrual || e.referrerDelta() <= 0 || !e.Time.Add(hold).After(now) {
+			continue
+		}
+
+		result.OnHold += e.referrerDelta()
+		releases = append(releases, e)
+		if release := e.Time.Add(hold); result.NextRelease.IsZero() || release.Before(result.NextRelease) {
+			result.NextRelease = release
+		}
+	}
+
+	pending := balance.Pending()
+	if pending < 0 {
+		pending = 0
+	}
+	if result.OnHold > pending {
+		result.OnHold = pending
+	}
+	result.Available = pending - result.OnHold
+
+	y, m, d := result.NextRelease.Date()
+	for _, e := range releases {
+		if ry, rm, rd := e.Time.Add(hold).Date(); ry == y && rm == m && rd == d {
+			result.NextAmount += e.referrerDelta()
+		}
+	}
+	if result.NextAmount > result.OnHold {
+		result.NextAmount = result.OnHold
+	}
+	return result
+}
+
+// AppendLedgerEntry добавляет запись в лист Журнал. Запись с уже существующим ID пропускается.
+func (sc *SheetsClient) AppendLedgerEntry(e LedgerEntry) error {
+	layout := sc.ledgerLayout
+	unlock := sc.sheetLocks.lock(layout.name)
+	defer unlock()
+
+	sc.cacheMutex.RLock()
+	exists := sc.ledgerIDs[e.ID]
+	sc.cacheMutex.RUnlock()
+	if exists {
+		log.Printf("Запись журнала %s уже есть, пропускаем", e.ID)
+		return nil
+	}
+
+	rowIndex, err := sc.reserveRow(layout, colEntryID)
+	if err != nil {
+		return fmt.Errorf("ошибка поиска пустой строки: %w", err)
+	}
+
+	row := layout.row(map[string]interface{}{
+		colEntryID:  e.ID,
+		colTime:     e.Time.Format(sheetTimeFormat),
+		colType:     string(e.Type),
+		colReferrer: fmt.Sprintf("%d", e.ReferrerID),
+		colDebit:    e.Debit,
+		colCredit:   e.Credit,
+		colAmount:   e.Amount.Float64(),
+		colDealID:   e.DealID,
+		colReason:   e.Reason,
+	})
+
+	log.Printf("📝 Запись в Журнал (строка %d): %s %s, рефовод=%d, сумма=%s, %s -> %s",
+		rowIndex, e.ID, e.Type, e.ReferrerID, e.Amount, e.Debit, e.Credit)
+
+	if err := sc.writeRow(layout, rowIndex, row); err != nil {
+		log.Printf("❌ Ошибка записи в Журнал: %v", err)
+		return fmt.Errorf("ошибка добавления записи журнала: %w", err)
+	}
+
+	sc.cacheMutex.Lock()
+	sc.cacheLedgerEntry(e)
+	sc.cacheMutex.Unlock()
+
+	return nil
+}
+
+// cacheLedgerEntry учитывает запись журнала в кэше. Вызывается под cacheMutex.
+func (sc *SheetsClient) cacheLedgerEntry(e LedgerEntry) {
+	sc.ledgerIDs[e.ID] = true
+	sc.ledgerEntries[e.ReferrerID] = append(sc.ledgerEntries[e.ReferrerID], e)
+
+	balance, ok := sc.ledgerBalances[e.ReferrerID]
+	if !ok {
+		balance = &LedgerBalance{}
+		sc.ledgerBalances[e.ReferrerID] = balance
+	}
+	balance.Apply(e)
+}
+
+// LedgerEntries возвращает записи журнала по рефоводу
+func (sc *SheetsClient) LedgerEntries(referrerID int64) ([]LedgerEntry, error) {
+	sc.cacheMutex.RLock()
+	defer sc.cacheMutex.RUnlock()
+	return append([]LedgerEntry(nil), sc.ledgerEntries[referrerID]...), nil
+}
+
+// GetLedgerBalance возвращает остаток рефовода по журналу
+func (sc *SheetsClient) GetLedgerBalance(referrerID int64) LedgerBalance {
+	sc.cacheMutex.RLock()
+	defer sc.cacheMutex.RUnlock()
+
+	if balance, ok := sc.ledgerBalances[referrerID]; ok {
+		return *balance
+	}
+	return LedgerBalance{}
+}
+
+// loadLedgerCache загружает Журнал и пересчитывает по нему остатки рефоводов в кэше.
+// Вызывается под cacheMutex после загрузки рефоводов.
+func (sc *SheetsClient) loadLedgerCache() error {
+	layout := sc.ledgerLayout
+	resp, err := execute(sc, "values.get", sc.service.Spreadsheets.Values.Get(sc.spreadsheetID, layout.dataRange()).
+		ValueRenderOption("UNFORMATTED_VALUE").
+		DateTimeRenderOption("FORMATTED_STRING"))
+	if err != nil {
+		return fmt.Errorf("ошибка чтения листа Журнал: %w", err)
+	}
+
+	sc.ledgerIDs = make(map[string]bool)
+	sc.ledgerEntries = make(map[int64][]LedgerEntry)
+	sc.ledgerBalances = make(map[int64]*LedgerBalance)
+	sc.nextFreeRow[layout.name] = nextRowAfter(resp.Values, layout, colEntryID)
+
+	for i, row := range resp.Values {
+		entry, err := sc.parseLedgerRow(row)
+		if err != nil {
+			if !isEmptyRow(row) {
+				log.Printf("⚠️ Пропуск строки %d листа Журнал: %v", i+2, err)
+			}
+			continue
+		}
+
+		sc.cacheLedgerEntry(entry)
+	}
+
+	// Остатки рефоводов - проекция журнала
+	for id, balance := range sc.ledgerBalances {
+		if ref, ok := sc.referrersByID[id]; ok {
+			ref.PendingPayout = balance.Pending()
+			ref.PaidOut = balance.Paid
+		}
+	}
+
+	return nil
+}
+
+// parseLedgerRow разбирает строку листа Журнал. В записях, добавленных вручную,
+// счета можно не указывать - они определяются по типу и знаку суммы.
+func (sc *SheetsClient) parseLedgerRow(row []interface{}) (LedgerEntry, error) {
+	layout := sc.ledgerLayout
+
+	entry := LedgerEntry{
+		ID:     getStringValue(layout.get(row, colEntryID)),
+		Type:   LedgerEntryType(getStringValue(layout.get(row, colType))),
+		Debit:  getStringValue(layout.get(row, colDebit)),
+		Credit: getStringValue(layout.get(row, colCredit)),
+		Amount: getAmountValue(layout.get(row, colAmount)),
+		DealID: getStringValue(layout.get(row, colDealID)),
+		Reason: getStringValue(layout.get(row, colReason)),
+	}
+	if entry.ID == "" {
+		return entry, fmt.Errorf("пустой ID записи")
+	}
+
+	referrerID, err := parseIDValue(layout.get(row, colReferrer))
+	if err != nil {
+		return entry, err
+	}
+	entry.ReferrerID = referrerID
+
+	switch entry.Type {
+	case EntryAccrual, EntryPayout, EntryAdjustment, EntryClawback:
+	default:
+		return entry, fmt.Errorf("неизвестный тип записи %q", entry.Type)
+	}
+
+	if entry.Debit == "" && entry.Credit == "" {
+		entry.Debit, entry.Credit, entry.Amount = postingAccounts(entry.Type, entry.ReferrerID, entry.Amount)
+	}
+
+	if t, ok := parseSheetTime(getStringValue(layout.get(row, colTime))); ok {
+		entry.Time = t
+	}
+
+	return entry, nil
+}
+
+// ledgerBackfill возвращает записи, которых не хватает в Журнале: начисления по строкам
+// листа Рефералы и выплаты, отмеченные в колонке Выплачено сверх учтенных в Журнале.
+// Источник истины для выплат - Журнал: бот записывает в колонку Выплачено сумму его записей
+// "выплата" (там же и выплаты по одобренным заявкам). Перенос из колонки нужен для выплат,
+// отмеченных в ней до появления Журнала; если в колонке меньше, ее исправит пересчет.
+func (sc *SheetsClient) ledgerBackfill(referrers []sheetReferrer, referrals []Referral) []LedgerEntry {
+	sc.cacheMutex.RLock()
+	defer sc.cacheMutex.RUnlock()
+
+	byCode := make(map[string]int64)
+	for _, r := range referrers {
+		byCode[normalizeCode(r.Code)] = r.ID
+	}
+
+	var entries []LedgerEntry
+	for _, referral := range referrals {
+		if sc.ledgerIDs[accrualEntryID(referral.DealID, referral.Level)] {
+			continue
+		}
+
+		referrerID, ok := byCode[normalizeCode(referral.RefCode)]
+		if !ok {
+			continue
+		}
+
+		entry := NewAccrualEntry(referrerID, referral.Bonus, referral.DealID, referral.Level, "перенос из листа Рефералы")
+		if t, ok := parseSheetTime(referral.Date); ok {
+			entry.Time = t
+		}
+		entries = append(entries, entry)
+	}
+
+	for _, r := range referrers {
+		var ledgerPaid money.Amount
+		if balance, ok := sc.ledgerBalances[r.ID]; ok {
+			ledgerPaid = balance.Paid
+		}
+
+		if diff := r.PaidOut - ledgerPaid; diff > 0 {
+			entries = append(entries, NewLedgerEntry(EntryPayout, r.ID, diff, "", "выплата по колонке Выплачено"))
+		}
+	}
+
+	return entries
+}
+
+// projectBalances возвращает остатки рефоводов по журналу с учетом еще не записанных записей
+func (sc *SheetsClient) projectBalances(extra []LedgerEntry) map[int64]LedgerBalance {
+	sc.cacheMutex.RLock()
+	balances := make(map[int64]LedgerBalance, len(sc.ledgerBalances))
+	for id, balance := range sc.ledgerBalances {
+		balances[id] = *balance
+	}
+	sc.cacheMutex.RUnlock()
+
+	for _, e := range extra {
+		balance := balances[e.ReferrerID]
+		balance.Apply(e)
+		balances[e.ReferrerID] = balance
+	}
+	return balances
+}
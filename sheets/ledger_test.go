@@ -0,0 +1,89 @@
+package sheets
+
+import (
+	"testing"
+	"time"
+
+	"ss_ref_bot/money"
+)
+
+func TestLedgerProjectsReferrerBalance(t *testing.T) {
+	f, sc := newFixture(t, Options{}, func(f *fakeSpreadsheet) {
+		f.addRow(referrersSchema.Name, "111", "@ref", "ABC123", "", 1, 0, 0)
+		f.addRow(ledgerSchema.Name, "accrual:D-1", "01.01.2025 10:00:00", "начисление", "111", "программа", "рефовод:111", 10.0, "D-1", "")
+		f.addRow(ledgerSchema.Name, "payout:1", "02.01.2025 10:00:00", "выплата", "111", "рефовод:111", "выплаты", 4.0, "", "")
+		// Ручная корректировка без счетов: знак суммы задает направление
+		f.addRow(ledgerSchema.Name, "manual-1", "03.01.2025 10:00:00", "корректировка", "111", "", "", -1.5, "", "ошибка в сделке")
+	})
+
+	ref, _ := sc.GetReferrerByID(111)
+	if ref.PendingPayout != money.FromFloat(4.5) || ref.PaidOut != 4*money.USDT {
+		t.Fatalf("остаток после загрузки = %s/%s, ожидалось 4.50/4.00", ref.PendingPayout, ref.PaidOut)
+	}
+
+	// Повтор начисления по той же сделке не меняет остаток
+	for i := 0; i < 2; i++ {
+		if err := sc.AppendLedgerEntry(NewLedgerEntry(EntryAccrual, 111, 10*money.USDT, "D-1", "")); err != nil {
+			t.Fatalf("ошибка записи в Журнал: %v", err)
+		}
+	}
+	if err := sc.AppendLedgerEntry(NewLedgerEntry(EntryClawback, 111, 2*money.USDT, "D-1", "сделка отменена")); err != nil {
+		t.Fatalf("ошибка записи в Журнал: %v", err)
+	}
+	if err := sc.Flush(); err != nil {
+		t.Fatalf("ошибка отправки очереди: %v", err)
+	}
+
+	if rows := f.dataRows(ledgerSchema.Name); len(rows) != 4 {
+		t.Errorf("строк в Журнале = %d, ожидалось 4", len(rows))
+	}
+	if got := sc.GetLedgerBalance(111).Pending(); got != money.FromFloat(2.5) {
+		t.Errorf("остаток по Журналу = %s, ожидалось 2.50", got)
+	}
+
+	if err := sc.LoadCache(); err != nil {
+		t.Fatalf("ошибка загрузки кэша: %v", err)
+	}
+	ref, _ = sc.GetReferrerByID(111)
+	if ref.PendingPayout != money.FromFloat(2.5) {
+		t.Errorf("остаток после перезагрузки = %s, ожидалось 2.50", ref.PendingPayout)
+	}
+}
+
+func TestSplitHold(t *testing.T) {
+	now := time.Date(2025, 3, 20, 12, 0, 0, 0, time.Local)
+	hold := 14 * 24 * time.Hour
+	at := func(e LedgerEntry, daysAgo int) LedgerEntry {
+		e.Time = now.AddDate(0, 0, -daysAgo)
+		return e
+	}
+
+	entries := []LedgerEntry{
+		at(NewLedgerEntry(EntryAccrual, 111, 10*money.USDT, "D-1", ""), 30), // давно освобождено
+		at(NewLedgerEntry(EntryAccrual, 111, 3*money.USDT, "D-2", ""), 10),  // освободится через 4 дня
+		at(NewLedgerEntry(EntryAccrual, 111, 2*money.USDT, "D-3", ""), 10),  // в тот же день
+		at(NewLedgerEntry(EntryAccrual, 111, 5*money.USDT, "D-4", ""), 1),   // через 13 дней
+		at(NewLedgerEntry(EntryPayout, 111, 4*money.USDT, "", ""), 2),
+	}
+
+	got := SplitHold(entries, hold, now)
+	if got.OnHold != 10*money.USDT || got.Available != 6*money.USDT {
+		t.Errorf("доступно %s, на удержании %s, ожидалось 6.00 и 10.00", got.Available, got.OnHold)
+	}
+	if want := now.AddDate(0, 0, 4); !got.NextRelease.Equal(want) || got.NextAmount != 5*money.USDT {
+		t.Errorf("ближайшее освобождение %v на %s, ожидалось %v на 5.00", got.NextRelease, got.NextAmount, want)
+	}
+
+	// Списание уменьшает остаток сразу, и удерживать больше остатка нельзя
+	entries = append(entries, at(NewLedgerEntry(EntryClawback, 111, 9*money.USDT, "D-1", ""), 0))
+	got = SplitHold(entries, hold, now)
+	if got.OnHold != 7*money.USDT || got.Available != 0 {
+		t.Errorf("после списания доступно %s, на удержании %s, ожидалось 0 и 7.00", got.Available, got.OnHold)
+	}
+
+	// Без срока удержания все доступно сразу
+	got = SplitHold(entries, 0, now)
+	if got.OnHold != 0 || got.Available != 7*money.USDT || !got.NextRelease.IsZero() {
+		t.Errorf("без удержания: %+v", got)
+	}
+}
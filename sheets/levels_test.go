@@ -0,0 +1,91 @@
+package sheets
+
+import (
+	"testing"
+
+	"ss_ref_bot/money"
+)
+
+func TestReferralLevels(t *testing.T) {
+	f, sc := newFixture(t, Options{}, func(f *fakeSpreadsheet) {
+		// Старый лист Рефералы без колонок "Ставка" и "Уровень", одна сделка до появления уровней
+		f.setHeader(referralsSchema.Name, referralsSchema.header()[:len(referralsSchema.Columns)]...)
+		f.addRow(referralsSchema.Name, "1000", "A1", 20, "D-0", 2, "01.01.2025 09:00")
+		f.addRow(referrersSchema.Name, "111", "@first", "A1", "", 1, 0, 0)
+		f.addRow(referrersSchema.Name, "222", "@second", "B2", "", 1, 0, 0)
+	})
+
+	if got := f.cell(referralsSchema.Name, 1, 7); got != "Уровень" {
+		t.Fatalf("заголовок Рефералы!H1 = %v, ожидалась новая колонка Уровень", got)
+	}
+
+	// Сделка D-1: прямой рефовод A1 и пригласивший его B2
+	first := &Referral{RefID: 1001, RefCode: "A1", Profit: 10 * money.USDT, DealID: "D-1", Bonus: money.USDT, Date: "02.01.2025 10:00", Level: 1}
+	second := &Referral{RefID: 1001, RefCode: "B2", Profit: 10 * money.USDT, DealID: "D-1", Bonus: money.USDT / 2, Date: "02.01.2025 10:00", Level: 2}
+	// Сделка D-2 успела получить только второй уровень
+	orphan := &Referral{RefID: 1002, RefCode: "B2", Profit: 4 * money.USDT, DealID: "D-2", Bonus: money.USDT / 5, Date: "03.01.2025 10:00", Level: 2}
+	for _, r := range []*Referral{first, second, orphan} {
+		if err := sc.CreateReferral(r); err != nil {
+			t.Fatalf("ошибка создания записи: %v", err)
+		}
+	}
+	if err := sc.Flush(); err != nil {
+		t.Fatalf("ошибка отправки очереди: %v", err)
+	}
+
+	if got := f.cell(referralsSchema.Name, 4, 7); got != 2.0 {
+		t.Errorf("уровень в Рефералы!H4 = %v, ожидалось 2", got)
+	}
+
+	check := func(stage string) {
+		t.Helper()
+		for _, tt := range []struct {
+			deal  string
+			level int
+			want  bool
+		}{{"D-0", 1, true}, {"D-0", 2, false}, {"D-1", 1, true}, {"D-1", 2, true}, {"D-2", 1, false}, {"D-2", 2, true}} {
+			if got, _ := sc.HasReferral(tt.deal, tt.level); got != tt.want {
+				t.Errorf("%s: HasReferral(%s, %d) = %v, ожидалось %v", stage, tt.deal, tt.level, got, tt.want)
+			}
+		}
+
+		// Сделка без первого уровня остается новой
+		deals, _ := sc.GetExistingDealIDs()
+		if !deals["D-0"] || !deals["D-1"] || deals["D-2"] {
+			t.Errorf("%s: обработанные сделки = %v, ожидались D-0 и D-1", stage, deals)
+		}
+
+		// Ступени ставки считаются только по прямым рефералам
+		if got, _ := sc.ReferredProfit("A1"); got != 30*money.USDT {
+			t.Errorf("%s: прибыль рефералов A1 = %s, ожидалось 30.00", stage, got)
+		}
+		if got, _ := sc.ReferredProfit("B2"); got != 0 {
+			t.Errorf("%s: прибыль рефералов B2 = %s, ожидалось 0", stage, got)
+		}
+	}
+	check("после записи")
+	if err := sc.LoadCache(); err != nil {
+		t.Fatalf("ошибка загрузки кэша: %v", err)
+	}
+	check("после перезагрузки")
+
+	// В Журнал переносится по начислению на каждый уровень
+	referrers, err := sc.readReferrersSheet()
+	if err != nil {
+		t.Fatalf("ошибка чтения Рефоводы: %v", err)
+	}
+	referrals, _, err := sc.ReadReferrals()
+	if err != nil {
+		t.Fatalf("ошибка чтения Рефералы: %v", err)
+	}
+	entries := sc.ledgerBackfill(referrers, referrals)
+	want := map[string]int64{"accrual:D-0": 111, "accrual:D-1": 111, "accrual:D-1:2": 222, "accrual:D-2:2": 222}
+	if len(entries) != len(want) {
+		t.Fatalf("записей для переноса %d, ожидалось %d: %+v", len(entries), len(want), entries)
+	}
+	for _, e := range entries {
+		if want[e.ID] != e.ReferrerID {
+			t.Errorf("запись %s начислена рефоводу %d, ожидалось %d", e.ID, e.ReferrerID, want[e.ID])
+		}
+	}
+}
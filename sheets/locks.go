@@ -0,0 +1,43 @@
+package sheets
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrAlreadyInvited - пользователь уже привязан к реферальной программе
+var ErrAlreadyInvited = errors.New("пользователь уже привязан к реферальной программе")
+
+// ErrPayoutRequestOpen - у рефовода уже есть необработанная заявка на выплату
+var ErrPayoutRequestOpen = errors.New("у рефовода уже есть заявка на выплату в обработке")
+
+// ErrPayoutRequestResolved - заявка на выплату уже одобрена или отклонена
+var ErrPayoutRequestResolved = errors.New("заявка на выплату уже рассмотрена")
+
+// ErrPayoutRequestNotApproved - заявка не в статусе "одобрена" (уже выгружена или не одобрялась)
+var ErrPayoutRequestNotApproved = errors.New("заявка на выплату не в статусе \"одобрена\"")
+
+// keyedLocks выдает отдельный мьютекс на каждый ключ: операции с разными
+// рефоводами (или листами) идут параллельно, с одним и тем же - по очереди
+type keyedLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func newKeyedLocks() *keyedLocks {
+	return &keyedLocks{locks: make(map[string]*sync.Mutex)}
+}
+
+// lock захватывает мьютекс ключа и возвращает функцию для его освобождения
+func (k *keyedLocks) lock(key string) func() {
+	k.mu.Lock()
+	m, ok := k.locks[key]
+	if !ok {
+		m = &sync.Mutex{}
+		k.locks[key] = m
+	}
+	k.mu.Unlock()
+
+	m.Lock()
+	return m.Unlock
+}
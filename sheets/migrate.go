@@ -0,0 +1,182 @@
+package sheets
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RejectedRow описывает строку листа, которую не удалось разобрать при чтении
+type RejectedRow struct {
+	Sheet  string
+	Row    int // номер строки в листе (с учетом заголовка)
+	Reason string
+}
+
+func (r RejectedRow) String() string {
+	return fmt.Sprintf("%s, строка %d: %s", r.Sheet, r.Row, r.Reason)
+}
+
+// ReadReferrers читает весь лист Рефоводы через parseReferrerRow
+func (sc *SheetsClient) ReadReferrers() ([]Referrer, []RejectedRow, error) {
+	resp, err := execute(sc, "values.get", sc.service.Spreadsheets.Values.Get(sc.spreadsheetID, sc.referrersLayout.dataRange()).
+		ValueRenderOption("UNFORMATTED_VALUE"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("ошибка чтения листа Рефоводы: %w", err)
+	}
+	if err := sc.readFormattedColumn(sc.referrersLayout, colRate, resp.Values); err != nil {
+		return nil, nil, err
+	}
+
+	var referrers []Referrer
+	var rejected []RejectedRow
+	for i, row := range resp.Values {
+		if isEmptyRow(row) {
+			continue
+		}
+
+		ref := sc.parseReferrerRow(row)
+		if ref == nil {
+			rejected = append(rejected, RejectedRow{
+				Sheet:  sc.referrersLayout.name,
+				Row:    i + 2,
+				Reason: fmt.Sprintf("некорректный ID: %q", getStringValue(sc.referrersLayout.get(row, colID))),
+			})
+			continue
+		}
+		if ref.Code == "" {
+			rejected = append(rejected, RejectedRow{Sheet: sc.referrersLayout.name, Row: i + 2, Reason: "пустой код"})
+			continue
+		}
+
+		referrers = append(referrers, *ref)
+	}
+
+	return referrers, rejected, nil
+}
+
+// ReadInvited читает весь лист Приглашенные
+func (sc *SheetsClient) ReadInvited() ([]Invited, []RejectedRow, error) {
+	layout := sc.invitedLayout
+	resp, err := execute(sc, "values.get", sc.service.Spreadsheets.Values.Get(sc.spreadsheetID, layout.dataRange()).
+		ValueRenderOption("UNFORMATTED_VALUE").
+		DateTimeRenderOption("FORMATTED_STRING"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("ошибка чтения листа Приглашенные: %w", err)
+	}
+
+	var invited []Invited
+	var rejected []RejectedRow
+	for i, row := range resp.Values {
+		if isEmptyRow(row) {
+			continue
+		}
+
+		userID, err := parseIDValue(layout.get(row, colUserID))
+		if err != nil {
+			rejected = append(rejected, RejectedRow{Sheet: layout.name, Row: i + 2, Reason: err.Error()})
+			continue
+		}
+
+		refCode := getStringValue(layout.get(row, colRefCode))
+		if refCode == "" {
+			rejected = append(rejected, RejectedRow{Sheet: layout.name, Row: i + 2, Reason: "пустой код пригласившего"})
+			continue
+		}
+
+		inv := Invited{UserID: userID, RefCode: refCode}
+		if t, ok := parseSheetTime(getStringValue(layout.get(row, colInvited))); ok {
+			inv.InvitedAt = t
+		}
+		invited = append(invited, inv)
+	}
+
+	return invited, rejected, nil
+}
+
+// ReadReferrals читает весь лист Рефералы
+func (sc *SheetsClient) ReadReferrals() ([]Referral, []RejectedRow, error) {
+	// Даты начисления читаем строками, а суммы - числами
+	layout := sc.referralsLayout
+	resp, err := execute(sc, "values.get", sc.service.Spreadsheets.Values.Get(sc.spreadsheetID, layout.dataRange()).
+		ValueRenderOption("UNFORMATTED_VALUE").
+		DateTimeRenderOption("FORMATTED_STRING"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("ошибка чтения листа Рефералы: %w", err)
+	}
+	if err := sc.readFormattedColumn(layout, colRate, resp.Values); err != nil {
+		return nil, nil, err
+	}
+
+	var referrals []Referral
+	var rejected []RejectedRow
+	for i, row := range resp.Values {
+		if isEmptyRow(row) {
+			continue
+		}
+		if !layout.has(row, colBonus) {
+			rejected = append(rejected, RejectedRow{Sheet: layout.name, Row: i + 2, Reason: fmt.Sprintf("недостаточно колонок (%d)", len(row))})
+			continue
+		}
+
+		refID, err := parseIDValue(layout.get(row, colRefID))
+		if err != nil {
+			rejected = append(rejected, RejectedRow{Sheet: layout.name, Row: i + 2, Reason: err.Error()})
+			continue
+		}
+
+		referral := Referral{
+			RefID:   refID,
+			RefCode: getStringValue(layout.get(row, colRefCode)),
+			Profit:  getAmountValue(layout.get(row, colProfit)),
+			DealID:  getStringValue(layout.get(row, colDealID)),
+			Bonus:   getAmountValue(layout.get(row, colBonus)),
+			Date:    getStringValue(layout.get(row, colDate)),
+			Rate:    getPercentValue(layout.get(row, colRate)),
+			Level:   getLevelValue(layout.get(row, colLevel)),
+		}
+
+		if referral.DealID == "" {
+			rejected = append(rejected, RejectedRow{Sheet: layout.name, Row: i + 2, Reason: "пустой ID сделки"})
+			continue
+		}
+		if referral.RefCode == "" {
+			rejected = append(rejected, RejectedRow{Sheet: layout.name, Row: i + 2, Reason: "пустой код пригласившего"})
+			continue
+		}
+
+		referrals = append(referrals, referral)
+	}
+
+	return referrals, rejected, nil
+}
+
+// parseIDValue разбирает Telegram ID из ячейки
+func parseIDValue(val interface{}) (int64, error) {
+	switch v := val.(type) {
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case float64:
+		return int64(v), nil
+	}
+
+	// Убираем неразрывные и обычные пробелы
+	idStr := strings.ReplaceAll(getStringValue(val), "\u00a0", "")
+	idStr = strings.ReplaceAll(idStr, " ", "")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("некорректный ID: %q", getStringValue(val))
+	}
+	return id, nil
+}
+
+func isEmptyRow(row []interface{}) bool {
+	for _, v := range row {
+		if getStringValue(v) != "" {
+			return false
+		}
+	}
+	return true
+}
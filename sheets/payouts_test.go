@@ -0,0 +1,85 @@
+package sheets
+
+import (
+	"testing"
+
+	"ss_ref_bot/money"
+)
+
+func TestUpdatePendingPayoutsIsIdempotent(t *testing.T) {
+	f, sc := newFixture(t, Options{}, func(f *fakeSpreadsheet) {
+		// Ожидает выплаты уже испорчено прошлой логикой F = F - G; Выплачено = 7.5
+		f.addRow(referrersSchema.Name, "111", "@ref", "ABC123", "", 2, -30.0, 7.5)
+		f.addRow(referrersSchema.Name, "222", "@other", "XYZ789", "", 0, 0, 0)
+		f.addRow(referralsSchema.Name, "1001", "ABC123", 100.0, "D-1", 10.0, "01.01.2025 10:00")
+		f.addRow(referralsSchema.Name, "1002", "abc123", 50.0, "D-2", 5.0, "02.01.2025 10:00")
+	})
+
+	for run := 1; run <= 3; run++ {
+		if err := sc.UpdatePendingPayouts(); err != nil {
+			t.Fatalf("запуск %d: %v", run, err)
+		}
+
+		if got := getAmountValue(f.cell(referrersSchema.Name, 2, 5)); got != money.FromFloat(7.5) {
+			t.Errorf("запуск %d: Ожидает выплаты = %s, ожидалось 7.50 (15 начислено - 7.5 выплачено)", run, got)
+		}
+		if got := getAmountValue(f.cell(referrersSchema.Name, 3, 5)); got != 0 {
+			t.Errorf("запуск %d: Ожидает выплаты без начислений = %s, ожидалось 0", run, got)
+		}
+
+		ref, _ := sc.GetReferrerByID(111)
+		if ref.PendingPayout != money.FromFloat(7.5) {
+			t.Errorf("запуск %d: Ожидает выплаты в кэше = %s, ожидалось 7.50", run, ref.PendingPayout)
+		}
+	}
+
+	// Новая выплата: Выплачено растет, остаток уменьшается ровно на выплату
+	f.write("'Рефоводы'!G2", [][]interface{}{{12.5}})
+	for run := 1; run <= 2; run++ {
+		if err := sc.UpdatePendingPayouts(); err != nil {
+			t.Fatalf("запуск после выплаты %d: %v", run, err)
+		}
+		if got := getAmountValue(f.cell(referrersSchema.Name, 2, 5)); got != money.FromFloat(2.5) {
+			t.Errorf("запуск после выплаты %d: Ожидает выплаты = %s, ожидалось 2.50", run, got)
+		}
+	}
+
+	// Выплачено меньше, чем в Журнале: колонка исправляется по Журналу, остаток не меняется
+	f.write("'Рефоводы'!G2", [][]interface{}{{1.0}})
+	if err := sc.UpdatePendingPayouts(); err != nil {
+		t.Fatalf("запуск после правки колонки: %v", err)
+	}
+	if got := getAmountValue(f.cell(referrersSchema.Name, 2, 6)); got != money.FromFloat(12.5) {
+		t.Errorf("Выплачено = %s, ожидалось 12.50 по Журналу", got)
+	}
+	if got := getAmountValue(f.cell(referrersSchema.Name, 2, 5)); got != money.FromFloat(2.5) {
+		t.Errorf("Ожидает выплаты = %s, ожидалось 2.50", got)
+	}
+}
+
+func TestReferrerUpdateWritesLedgerPaid(t *testing.T) {
+	f, sc := newFixture(t, Options{}, func(f *fakeSpreadsheet) {
+		// В колонке Выплачено устаревшая формула, по Журналу выплачено 4.00
+		f.addRow(referrersSchema.Name, "111", "@ref", "ABC123", "", 0, 5.0, "=SUM(X2:Z2)")
+		f.addRow(ledgerSchema.Name, "accrual:D-1", "01.01.2025 10:00:00", "начисление", "111", "программа", "рефовод:111", 9.0, "D-1", "")
+		f.addRow(ledgerSchema.Name, "payout:P-1", "02.01.2025 10:00:00", "выплата", "111", "рефовод:111", "выплаты", 4.0, "", "")
+	})
+
+	_, err := sc.ModifyReferrer(111, func(r *Referrer) error {
+		r.Wallet = "UQ-test"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ошибка обновления рефовода: %v", err)
+	}
+	if err := sc.Flush(); err != nil {
+		t.Fatalf("ошибка отправки очереди: %v", err)
+	}
+
+	if got := getAmountValue(f.cell(referrersSchema.Name, 2, 6)); got != 4*money.USDT {
+		t.Errorf("Выплачено = %s, ожидалось 4.00 по Журналу", got)
+	}
+	if got := f.cell(referrersSchema.Name, 2, 3); got != "UQ-test" {
+		t.Errorf("кошелек = %v, ожидалось UQ-test", got)
+	}
+}
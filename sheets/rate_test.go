@@ -0,0 +1,109 @@
+package sheets
+
+import (
+	"testing"
+
+	"ss_ref_bot/money"
+)
+
+func TestRateColumnIsAddedAndRead(t *testing.T) {
+	f, sc := newFixture(t, Options{}, func(f *fakeSpreadsheet) {
+		// Старые листы без колонки "Ставка"; в Рефоводы есть вспомогательная колонка H
+		f.setHeader(referrersSchema.Name, "ID", "Username", "Код", "Кошелёк TON", "Количество рефералов", "Ожидает выплаты", "Выплачено", "Заметки")
+		f.setHeader(referralsSchema.Name, referralsSchema.header()[:len(referralsSchema.Columns)]...)
+		f.addRow(referrersSchema.Name, "111", "@blogger", "ABC123", "", 0, 0, 0, "договор от 01.02")
+	})
+
+	if got := f.cell(referrersSchema.Name, 1, 8); got != "Ставка" {
+		t.Fatalf("заголовок Рефоводы!I1 = %v, ожидалась новая колонка Ставка", got)
+	}
+	if got := f.cell(referralsSchema.Name, 1, 6); got != "Ставка" {
+		t.Fatalf("заголовок Рефералы!G1 = %v, ожидалась новая колонка Ставка", got)
+	}
+
+	// Оператор назначает индивидуальную ставку
+	f.write("'Рефоводы'!I2", [][]interface{}{{"20%"}})
+	if err := sc.LoadCache(); err != nil {
+		t.Fatalf("ошибка загрузки кэша: %v", err)
+	}
+	ref, _ := sc.GetReferrerByID(111)
+	if want, _ := money.ParsePercent("20"); ref.Rate != want {
+		t.Errorf("ставка = %s, ожидалось 20", ref.Rate)
+	}
+
+	// Обновление рефовода не затирает ставку и заметки
+	if _, err := sc.ModifyReferrer(111, func(r *Referrer) error {
+		r.Wallet = "UQ-test"
+		return nil
+	}); err != nil {
+		t.Fatalf("ошибка обновления рефовода: %v", err)
+	}
+	rate, _ := money.ParsePercent("17.5")
+	err := sc.CreateReferral(&Referral{RefID: 1001, RefCode: "ABC123", Profit: 10 * money.USDT, DealID: "D-1", Bonus: money.FromFloat(1.75), Date: "01.01.2025 10:00", Rate: rate})
+	if err != nil {
+		t.Fatalf("ошибка создания записи: %v", err)
+	}
+	if err := sc.Flush(); err != nil {
+		t.Fatalf("ошибка отправки очереди: %v", err)
+	}
+
+	if got := f.cell(referrersSchema.Name, 2, 8); got != "20%" {
+		t.Errorf("ставка в таблице = %v, ожидалось 20%%", got)
+	}
+	if got := f.cell(referrersSchema.Name, 2, 7); got != "договор от 01.02" {
+		t.Errorf("заметки = %v", got)
+	}
+	if got := f.cell(referralsSchema.Name, 2, 6); got != "17.5%" {
+		t.Errorf("примененная ставка в Рефералы = %v, ожидалось 17.5%%", got)
+	}
+	if got, _ := sc.ReferredProfit(" abc123"); got != 10*money.USDT {
+		t.Errorf("прибыль рефералов = %s, ожидалось 10.00", got)
+	}
+	if err := sc.LoadCache(); err != nil {
+		t.Fatalf("ошибка загрузки кэша: %v", err)
+	}
+	if got, _ := sc.ReferredProfit("ABC123"); got != 10*money.USDT {
+		t.Errorf("прибыль рефералов после перезагрузки = %s, ожидалось 10.00", got)
+	}
+
+}
+
+func TestPercentCellIsReadFormatted(t *testing.T) {
+	_, sc := newFixture(t, Options{}, func(f *fakeSpreadsheet) {
+		// Фейковый сервер отдает ячейку как есть: так выглядит FORMATTED_VALUE ячейки в процентном формате
+		f.addRow(referrersSchema.Name, "111", "@small", "ABC123", "", 0, 0, 0, "0,5%")
+		f.addRow(referrersSchema.Name, "222", "@plain", "DEF456", "", 0, 0, 0, "0.5")
+	})
+
+	if err := sc.LoadCache(); err != nil {
+		t.Fatalf("ошибка загрузки кэша: %v", err)
+	}
+	want, _ := money.ParsePercent("0.5")
+	for _, id := range []int64{111, 222} {
+		ref, _ := sc.GetReferrerByID(id)
+		if ref == nil || ref.Rate != want {
+			t.Errorf("рефовод %d: ставка %v, ожидалось 0.5", id, ref)
+		}
+	}
+}
+
+func TestGetPercentValue(t *testing.T) {
+	for _, tt := range []struct {
+		in   interface{}
+		want string
+	}{
+		{0.5, "0.5"},
+		{"0.5", "0.5"},
+		{"0,5%", "0.5"},
+		{5.0, "5"},
+		{"5", "5"},
+		{15.0, "15"},
+		{"12,5%", "12.5"},
+		{"abc", "0"},
+		{nil, "0"},
+	} {
+		if got := getPercentValue(tt.in); got.String() != tt.want {
+			t.Errorf("getPercentValue(%#v) = %s, ожидалось %s", tt.in, got, tt.want)
+		}
+	}
+}
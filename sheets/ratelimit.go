@@ -0,0 +1,217 @@
+package sheets
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	defaultRequestsPerMinute = 60
+	defaultMaxRetries        = 5
+)
+
+// Границы задержки между повторами (переменные, чтобы тесты не ждали секундами)
+var (
+	retryBaseDelay = 1 * time.Second
+	retryMaxDelay  = 32 * time.Second
+)
+
+// tokenBucket ограничивает частоту запросов к Sheets API.
+// Емкость позволяет короткие всплески, средняя скорость соответствует квоте.
+type tokenBucket struct {
+	mu       sync.Mutex
+	tokens   float64
+	capacity float64
+	perSec   float64
+	last     time.Time
+}
+
+func newTokenBucket(requestsPerMinute int) *tokenBucket {
+	if requestsPerMinute <= 0 {
+		requestsPerMinute = defaultRequestsPerMinute
+	}
+
+	capacity := float64(requestsPerMinute) / 6 // всплеск не больше 10 секунд квоты
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	return &tokenBucket{
+		tokens:   capacity,
+		capacity: capacity,
+		perSec:   float64(requestsPerMinute) / 60,
+		last:     time.Now(),
+	}
+}
+
+// wait блокируется, пока в корзине не появится токен
+func (b *tokenBucket) wait() {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.perSec
+		if b.tokens > b.capacity {
+			b.tokens = b.capacity
+		}
+		b.last = now
+
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return
+		}
+
+		delay := time.Duration((1 - b.tokens) / b.perSec * float64(time.Second))
+		b.mu.Unlock()
+		time.Sleep(delay)
+	}
+}
+
+// CallStats - счетчики вызовов одного метода Sheets API
+type CallStats struct {
+	Calls        int64
+	Errors       int64 // вызовы, завершившиеся ошибкой после всех повторов
+	Retries      int64
+	TotalLatency time.Duration // суммарное время, включая повторы и ожидание
+	MaxLatency   time.Duration
+}
+
+// AvgLatency возвращает среднее время вызова
+func (s CallStats) AvgLatency() time.Duration {
+	if s.Calls == 0 {
+		return 0
+	}
+	return s.TotalLatency / time.Duration(s.Calls)
+}
+
+// apiCall - любой вызов Sheets API (Values.Get, Values.Update и т.д.)
+type apiCall[T any] interface {
+	Do(opts ...googleapi.CallOption) (T, error)
+}
+
+// execute выполняет читающий вызов Sheets API с учетом лимита запросов,
+// повторяет его при 429 и 5xx с экспоненциальной задержкой и учитывает время выполнения
+func execute[T any](sc *SheetsClient, name string, call apiCall[T]) (T, error) {
+	return executeWithRetry(sc, name, call, isRetryable)
+}
+
+// executeWrite выполняет изменяющий вызов Sheets API. Повторяется только 429: такой запрос
+// отклонен квотой и не выполнялся. После 5xx или таймаута изменение могло уже примениться,
+// и повтор через десятки секунд перезаписал бы более новые данные, поэтому решение
+// остается за вызывающим (очередь записи оставляет такие записи до следующей отправки).
+func executeWrite[T any](sc *SheetsClient, name string, call apiCall[T]) (T, error) {
+	return executeWithRetry(sc, name, call, isRateLimited)
+}
+
+func executeWithRetry[T any](sc *SheetsClient, name string, call apiCall[T], retryable func(error) bool) (T, error) {
+	start := time.Now()
+	retries := 0
+
+	var resp T
+	var err error
+	for {
+		sc.limiter.wait()
+
+		resp, err = call.Do()
+		if err == nil || !retryable(err) || retries >= sc.maxRetries {
+			break
+		}
+
+		delay := backoffDelay(retries)
+		retries++
+		log.Printf("⚠️ Sheets API %s: %v, повтор %d/%d через %v", name, err, retries, sc.maxRetries, delay)
+		time.Sleep(delay)
+	}
+
+	sc.recordCall(name, time.Since(start), retries, err)
+	return resp, err
+}
+
+// isRetryable определяет, имеет ли смысл повторять запрос
+func isRetryable(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == 429 || apiErr.Code >= 500
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return netErr.Timeout()
+	}
+	return false
+}
+
+// isRateLimited сообщает, что запрос отклонен из-за превышения квоты (429)
+func isRateLimited(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == 429
+}
+
+// backoffDelay - экспоненциальная задержка с полным джиттером
+func backoffDelay(attempt int) time.Duration {
+	maxDelay := retryBaseDelay << attempt
+	if maxDelay > retryMaxDelay || maxDelay <= 0 {
+		maxDelay = retryMaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(maxDelay))) + 100*time.Millisecond
+}
+
+func (sc *SheetsClient) recordCall(name string, latency time.Duration, retries int, err error) {
+	sc.statsMutex.Lock()
+	defer sc.statsMutex.Unlock()
+
+	stats := sc.stats[name]
+	stats.Calls++
+	stats.Retries += int64(retries)
+	stats.TotalLatency += latency
+	if latency > stats.MaxLatency {
+		stats.MaxLatency = latency
+	}
+	if err != nil {
+		stats.Errors++
+	}
+	sc.stats[name] = stats
+}
+
+// Stats возвращает счетчики вызовов Sheets API по методам
+func (sc *SheetsClient) Stats() map[string]CallStats {
+	sc.statsMutex.Lock()
+	defer sc.statsMutex.Unlock()
+
+	stats := make(map[string]CallStats, len(sc.stats))
+	for name, s := range sc.stats {
+		stats[name] = s
+	}
+	return stats
+}
+
+// StatsSummary возвращает счетчики вызовов в виде строки для логов
+func (sc *SheetsClient) StatsSummary() string {
+	stats := sc.Stats()
+	if len(stats) == 0 {
+		return "вызовов Sheets API не было"
+	}
+
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		s := stats[name]
+		lines = append(lines, fmt.Sprintf("%s: вызовов=%d, ошибок=%d, повторов=%d, среднее=%v, максимум=%v",
+			name, s.Calls, s.Errors, s.Retries, s.AvgLatency().Round(time.Millisecond), s.MaxLatency.Round(time.Millisecond)))
+	}
+	return strings.Join(lines, "; ")
+}
@@ -0,0 +1,101 @@
+package sheets
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// fastRetries убирает задержку между повторами на время теста
+func fastRetries(t *testing.T) {
+	base, max := retryBaseDelay, retryMaxDelay
+	retryBaseDelay, retryMaxDelay = time.Millisecond, time.Millisecond
+	t.Cleanup(func() { retryBaseDelay, retryMaxDelay = base, max })
+}
+
+func TestRetryOnRateLimit(t *testing.T) {
+	fastRetries(t)
+
+	f, sc := newFixture(t, Options{}, func(f *fakeSpreadsheet) {
+		f.addRow(referrersSchema.Name, "111", "@ref", "ABC123", "", 0, 0, 0)
+	})
+
+	// Чтение повторяется и при 429, и при 5xx
+	f.fail("values.get", 429, 503)
+	before := f.callCount("values.get")
+	if _, err := sc.GetWithdrawals(); err != nil {
+		t.Fatalf("GetWithdrawals после 429 и 503: %v", err)
+	}
+	if got := f.callCount("values.get") - before; got != 3 {
+		t.Errorf("вызовов values.get %d, ожидалось 3 (две ошибки и успех)", got)
+	}
+
+	// Запись при 429 повторяется: запрос отклонен квотой и не выполнялся
+	f.fail("values.batchUpdate", 429)
+	before = f.callCount("values.batchUpdate")
+	if _, err := sc.CreateReferrer(222, "@new"); err != nil {
+		t.Fatalf("CreateReferrer после 429: %v", err)
+	}
+	if got := f.callCount("values.batchUpdate") - before; got != 2 {
+		t.Errorf("вызовов values.batchUpdate %d, ожидалось 2 (429 и успех)", got)
+	}
+	if stats := sc.Stats()["values.batchUpdate"]; stats.Retries != 1 {
+		t.Errorf("повторов values.batchUpdate %d, ожидался 1", stats.Retries)
+	}
+}
+
+func TestWriteIsNotRetriedOnServerError(t *testing.T) {
+	fastRetries(t)
+
+	f, sc := newFixture(t, Options{}, nil)
+
+	// После 5xx изменение могло примениться: запрос не повторяется сразу
+	f.fail("values.batchUpdate", 500)
+	before := f.callCount("values.batchUpdate")
+	_, err := sc.CreateReferrer(111, "@ref")
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != 500 {
+		t.Fatalf("CreateReferrer: %v, ожидалась ошибка 500", err)
+	}
+	if got := f.callCount("values.batchUpdate") - before; got != 1 {
+		t.Errorf("вызовов values.batchUpdate %d, ожидался 1", got)
+	}
+}
+
+func TestRetriesAreLimited(t *testing.T) {
+	fastRetries(t)
+
+	f, sc := newFixture(t, Options{MaxRetries: 2}, nil)
+
+	f.fail("values.get", 429, 429, 429, 429)
+	before := f.callCount("values.get")
+	if _, err := sc.GetWithdrawals(); err == nil {
+		t.Fatal("GetWithdrawals должен вернуть ошибку после исчерпания повторов")
+	}
+	if got := f.callCount("values.get") - before; got != 3 {
+		t.Errorf("вызовов values.get %d, ожидалось 3 (попытка и два повтора)", got)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	// 6000 запросов в минуту: всплеск до 1000 запросов, затем 100 в секунду
+	b := newTokenBucket(6000)
+
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		b.wait()
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("всплеск в пределах емкости занял %v, ожидалось без ожидания", elapsed)
+	}
+
+	start = time.Now()
+	for i := 0; i < 10; i++ {
+		b.wait()
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("10 запросов сверх емкости заняли %v, ожидалось около 100ms", elapsed)
+	}
+}
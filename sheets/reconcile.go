@@ -0,0 +1,196 @@
+package sheets
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"ss_ref_bot/money"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+// BalanceDiff - расхождение строки Рефоводы с пересчетом по листу Приглашенные и Журналу
+type BalanceDiff struct {
+	Row  int // номер строки в листе Рефоводы
+	ID   int64
+	Code string
+
+	RefCount         int // значение в листе
+	ExpectedRefCount int // число приглашенных с кодом рефовода
+
+	Pending         money.Amount // значение в листе
+	ExpectedPending money.Amount // начислено минус выплачено
+	Earned          money.Amount // начислено по Журналу
+	Paid            money.Amount // выплачено по Журналу
+	PaidOut         money.Amount // "Выплачено" в листе
+}
+
+// RefCountChanged сообщает, расходится ли количество рефералов
+func (d BalanceDiff) RefCountChanged() bool {
+	return d.RefCount != d.ExpectedRefCount
+}
+
+// PendingChanged сообщает, расходится ли сумма к выплате
+func (d BalanceDiff) PendingChanged() bool {
+	return d.Pending != d.ExpectedPending
+}
+
+// PaidChanged сообщает, расходится ли "Выплачено" с Журналом
+func (d BalanceDiff) PaidChanged() bool {
+	return d.PaidOut != d.Paid
+}
+
+// ReconcileReport - результат сверки балансов
+type ReconcileReport struct {
+	Checked int // проверено рефоводов
+	Diffs   []BalanceDiff
+	// Коды из Приглашенные и Рефералы, для которых нет рефовода
+	UnknownCodes []string
+	// Начисления и выплаты, которых не хватает в Журнале
+	LedgerEntries []LedgerEntry
+}
+
+// Reconcile пересчитывает количество рефералов по листу Приглашенные и остатки по Журналу
+// (с учетом еще не перенесенных в него начислений и выплат) и сравнивает с листом Рефоводы
+func (sc *SheetsClient) Reconcile() (*ReconcileReport, error) {
+	// Отложенные изменения должны попасть в таблицу до сверки
+	if err := sc.Flush(); err != nil {
+		return nil, fmt.Errorf("ошибка отправки очереди записи: %w", err)
+	}
+
+	referrers, err := sc.readReferrersSheet()
+	if err != nil {
+		return nil, err
+	}
+	invited, _, err := sc.ReadInvited()
+	if err != nil {
+		return nil, err
+	}
+	referrals, _, err := sc.ReadReferrals()
+	if err != nil {
+		return nil, err
+	}
+
+	invitedCount := make(map[string]int)
+	for _, inv := range invited {
+		invitedCount[normalizeCode(inv.RefCode)]++
+	}
+
+	report := &ReconcileReport{LedgerEntries: sc.ledgerBackfill(referrers, referrals)}
+	balances := sc.projectBalances(report.LedgerEntries)
+
+	known := make(map[string]bool)
+	for _, ref := range referrers {
+		code := normalizeCode(ref.Code)
+		known[code] = true
+		report.Checked++
+
+		balance := balances[ref.ID]
+		diff := BalanceDiff{
+			Row:              ref.Row,
+			ID:               ref.ID,
+			Code:             ref.Code,
+			RefCount:         ref.RefCount,
+			ExpectedRefCount: invitedCount[code],
+			Pending:          ref.PendingPayout,
+			ExpectedPending:  balance.Pending(),
+			Earned:           balance.Accrued,
+			Paid:             balance.Paid,
+			PaidOut:          ref.PaidOut,
+		}
+
+		if diff.RefCountChanged() || diff.PendingChanged() || diff.PaidChanged() {
+			report.Diffs = append(report.Diffs, diff)
+		}
+	}
+
+	unknown := make(map[string]bool)
+	for code := range invitedCount {
+		if !known[code] {
+			unknown[code] = true
+		}
+	}
+	for _, referral := range referrals {
+		if code := normalizeCode(referral.RefCode); !known[code] {
+			unknown[code] = true
+		}
+	}
+	for code := range unknown {
+		report.UnknownCodes = append(report.UnknownCodes, code)
+	}
+	sort.Strings(report.UnknownCodes)
+
+	return report, nil
+}
+
+// ApplyReconcile дописывает недостающие записи в Журнал и записывает исправленные значения
+// "Количество рефералов", "Ожидает выплаты" и "Выплачено" одним BatchUpdate.
+func (sc *SheetsClient) ApplyReconcile(report *ReconcileReport) (int64, error) {
+	for _, entry := range report.LedgerEntries {
+		if err := sc.AppendLedgerEntry(entry); err != nil {
+			return 0, fmt.Errorf("ошибка переноса в Журнал: %w", err)
+		}
+	}
+	if err := sc.Flush(); err != nil {
+		return 0, fmt.Errorf("ошибка отправки очереди записи: %w", err)
+	}
+
+	layout := sc.referrersLayout
+	diffs := report.Diffs
+
+	var updates []*sheets.ValueRange
+	for _, d := range diffs {
+		if d.RefCountChanged() {
+			updates = append(updates, &sheets.ValueRange{
+				Range:  layout.cellRange(colRefCount, d.Row),
+				Values: [][]interface{}{{d.ExpectedRefCount}},
+			})
+		}
+		if d.PendingChanged() {
+			updates = append(updates, &sheets.ValueRange{
+				Range:  layout.cellRange(colPending, d.Row),
+				Values: [][]interface{}{{d.ExpectedPending.Float64()}},
+			})
+		}
+		if d.PaidChanged() {
+			updates = append(updates, &sheets.ValueRange{
+				Range:  layout.cellRange(colPaid, d.Row),
+				Values: [][]interface{}{{d.Paid.Float64()}},
+			})
+		}
+	}
+
+	if len(updates) == 0 {
+		return 0, nil
+	}
+
+	body := &sheets.BatchUpdateValuesRequest{
+		ValueInputOption: "USER_ENTERED",
+		Data:             updates,
+	}
+
+	resp, err := executeWrite(sc, "values.batchUpdate", sc.service.Spreadsheets.Values.BatchUpdate(sc.spreadsheetID, body))
+	if err != nil {
+		return 0, fmt.Errorf("ошибка записи исправленных балансов: %w", err)
+	}
+
+	// Обновляем кэш, чтобы следующие записи строк не вернули старые значения
+	sc.cacheMutex.Lock()
+	for _, d := range diffs {
+		if ref, ok := sc.referrersByID[d.ID]; ok {
+			ref.RefCount = d.ExpectedRefCount
+			ref.PendingPayout = d.ExpectedPending
+			ref.PaidOut = d.Paid
+		}
+	}
+	sc.cacheMutex.Unlock()
+
+	log.Printf("✅ Исправлено балансов: рефоводов=%d, ячеек=%d", len(diffs), resp.TotalUpdatedCells)
+	return resp.TotalUpdatedCells, nil
+}
+
+func normalizeCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
@@ -0,0 +1,59 @@
+package sheets
+
+import (
+	"testing"
+
+	"ss_ref_bot/money"
+)
+
+func TestApplyReconcileWritesOneBatch(t *testing.T) {
+	f, sc := newFixture(t, Options{}, func(f *fakeSpreadsheet) {
+		// В листе 5 рефералов и 1.00 к выплате; по Приглашенные и Журналу - 2 и 6.00
+		f.addRow(referrersSchema.Name, "111", "@ref", "ABC123", "", 5, 1.0, 4.0)
+		f.addRow(referrersSchema.Name, "222", "@other", "XYZ789", "", 0, 0, 0)
+		f.addRow(invitedSchema.Name, "1001", "ABC123")
+		f.addRow(invitedSchema.Name, "1002", "abc123")
+		f.addRow(referralsSchema.Name, "1001", "ABC123", 100.0, "D-1", 10.0, "01.01.2025 10:00")
+		f.addRow(ledgerSchema.Name, "accrual:D-1", "01.01.2025 10:00:00", "начисление", "111", "программа", "рефовод:111", 10.0, "D-1", "")
+		f.addRow(ledgerSchema.Name, "payout:P-1", "02.01.2025 10:00:00", "выплата", "111", "рефовод:111", "выплаты", 4.0, "", "")
+	})
+
+	report, err := sc.Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	if len(report.Diffs) != 1 || len(report.LedgerEntries) != 0 {
+		t.Fatalf("расхождения %+v, недостающие записи %+v; ожидалось одно расхождение", report.Diffs, report.LedgerEntries)
+	}
+
+	before := f.callCount("values.batchUpdate")
+	cells, err := sc.ApplyReconcile(report)
+	if err != nil {
+		t.Fatalf("ApplyReconcile: %v", err)
+	}
+	if got := f.callCount("values.batchUpdate") - before; got != 1 {
+		t.Errorf("вызовов values.batchUpdate %d, ожидался 1", got)
+	}
+	if cells != 2 {
+		t.Errorf("обновлено ячеек %d, ожидалось 2 (E и F)", cells)
+	}
+
+	if got := f.cell(referrersSchema.Name, 2, 4); getIntValue(got) != 2 {
+		t.Errorf("Рефоводы!E2 = %v, ожидалось 2", got)
+	}
+	if got := getAmountValue(f.cell(referrersSchema.Name, 2, 5)); got != 6*money.USDT {
+		t.Errorf("Рефоводы!F2 = %s, ожидалось 6.00", got)
+	}
+	if got := f.cell(referrersSchema.Name, 2, 6); got != 4.0 {
+		t.Errorf("Рефоводы!G2 = %v, Выплачено совпадает с Журналом и не должно меняться", got)
+	}
+
+	// После исправления расхождений нет
+	report, err = sc.Reconcile()
+	if err != nil {
+		t.Fatalf("повторный Reconcile: %v", err)
+	}
+	if len(report.Diffs) != 0 {
+		t.Errorf("расхождения после исправления: %+v", report.Diffs)
+	}
+}
@@ -0,0 +1,408 @@
+package sheets
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"ss_ref_bot/money"
+)
+
+// PayoutStatus - статус заявки на выплату
+type PayoutStatus string
+
+const (
+	PayoutRequested PayoutStatus = "ожидает"   // создана рефоводом, сумма заблокирована
+	PayoutApproved  PayoutStatus = "одобрена"  // выплата подтверждена, но еще не выгружена для отправки
+	PayoutRejected  PayoutStatus = "отклонена" // сумма снова доступна к выплате
+	PayoutExported  PayoutStatus = "выгружена" // попала в выгрузку для массовой отправки
+)
+
+// PayoutRequest - заявка рефовода на выплату из листа Заявки на выплату
+type PayoutRequest struct {
+	ID         string
+	Time       time.Time
+	ReferrerID int64
+	Username   string
+	Wallet     string
+	Amount     money.Amount
+	Status     PayoutStatus
+
+	// Заполняются при рассмотрении заявки
+	ReviewedBy string
+	ReviewedAt time.Time
+	Reason     string // причина отказа
+
+	ExportID string // ID выгрузки, в которую попала заявка
+}
+
+// NewPayoutRequest создает заявку рефовода на сумму amount на его текущий кошелек
+func NewPayoutRequest(ref *Referrer, amount money.Amount) PayoutRequest {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return PayoutRequest{
+		ID:         "P-" + strings.ToUpper(hex.EncodeToString(b)),
+		Time:       time.Now().Truncate(time.Second),
+		ReferrerID: ref.ID,
+		Username:   ref.Username,
+		Wallet:     ref.Wallet,
+		Amount:     amount,
+		Status:     PayoutRequested,
+	}
+}
+
+// CreatePayoutRequest добавляет заявку в лист Заявки на выплату. Если у рефовода уже есть
+// заявка в статусе "ожидает", возвращает ErrPayoutRequestOpen: сумма заблокирована до ее обработки.
+func (sc *SheetsClient) CreatePayoutRequest(req *PayoutRequest) error {
+	layout := sc.payoutRequestsLayout
+	unlock := sc.sheetLocks.lock(layout.name)
+	defer unlock()
+
+	if open, _ := sc.OpenPayoutRequest(req.ReferrerID); open != nil {
+		return fmt.Errorf("заявка %s: %w", open.ID, ErrPayoutRequestOpen)
+	}
+
+	rowIndex, err := sc.reserveRow(layout, colRequestID)
+	if err != nil {
+		return fmt.Errorf("ошибка поиска пустой строки: %w", err)
+	}
+
+	log.Printf("📝 Запись в Заявки на выплату (строка %d): %s, рефовод %d, %s USDT на %s",
+		rowIndex, req.ID, req.ReferrerID, req.Amount, req.Wallet)
+
+	if err := sc.writeRow(layout, rowIndex, sc.payoutRequestRow(req)); err != nil {
+		log.Printf("❌ Ошибка записи в Заявки на выплату: %v", err)
+		return fmt.Errorf("ошибка добавления заявки на выплату: %w", err)
+	}
+
+	sc.cacheMutex.Lock()
+	reqCopy := *req
+	sc.payoutRequests[req.ID] = &reqCopy
+	sc.payoutRequestRows[req.ID] = rowIndex
+	sc.cacheMutex.Unlock()
+
+	return nil
+}
+
+// OpenPayoutRequest возвращает заявку рефовода в статусе "ожидает" или nil, если ее нет
+func (sc *SheetsClient) OpenPayoutRequest(referrerID int64) (*PayoutRequest, error) {
+	sc.cacheMutex.RLock()
+	defer sc.cacheMutex.RUnlock()
+
+	for _, req := range sc.payoutRequests {
+		if req.ReferrerID == referrerID && req.Status == PayoutRequested {
+			reqCopy := *req
+			return &reqCopy, nil
+		}
+	}
+	return nil, nil
+}
+
+// ResolvePayoutRequest переводит заявку из статуса "ожидает" в status и записывает,
+// кто и когда ее рассмотрел. Перед записью статус сверяется с таблицей: если заявку уже
+// рассмотрели (в том числе вручную в листе), возвращает ее вместе с ErrPayoutRequestResolved.
+func (sc *SheetsClient) ResolvePayoutRequest(id string, status PayoutStatus, reviewer, reason string) (*PayoutRequest, error) {
+	layout := sc.payoutRequestsLayout
+	unlock := sc.sheetLocks.lock(layout.name)
+	defer unlock()
+
+	sc.cacheMutex.RLock()
+	cached, ok := sc.payoutRequests[id]
+	var req PayoutRequest
+	if ok {
+		req = *cached
+	}
+	sc.cacheMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("заявка %s не найдена", id)
+	}
+
+	rowIndex, row, err := sc.locatePayoutRequest(id)
+	if err != nil {
+		return nil, err
+	}
+	if row != nil {
+		req.Status = PayoutStatus(strings.ToLower(strings.TrimSpace(getStringValue(layout.get(row, colStatus)))))
+	}
+	if req.Status != PayoutRequested {
+		sc.cacheMutex.Lock()
+		sc.payoutRequests[id].Status = req.Status
+		sc.cacheMutex.Unlock()
+		return &req, fmt.Errorf("заявка %s (%s): %w", id, req.Status, ErrPayoutRequestResolved)
+	}
+
+	req.Status = status
+	req.ReviewedBy = reviewer
+	req.ReviewedAt = time.Now().Truncate(time.Second)
+	req.Reason = reason
+
+	log.Printf("📝 Обновление Заявки на выплату (строка %d): %s -> %s, рассмотрел %s", rowIndex, id, status, reviewer)
+
+	if err := sc.writeRow(layout, rowIndex, sc.payoutRequestRow(&req)); err != nil {
+		log.Printf("❌ Ошибка обновления Заявки на выплату: %v", err)
+		return nil, fmt.Errorf("ошибка обновления заявки на выплату: %w", err)
+	}
+
+	sc.cacheMutex.Lock()
+	reqCopy := req
+	sc.payoutRequests[id] = &reqCopy
+	sc.payoutRequestRows[id] = rowIndex
+	sc.cacheMutex.Unlock()
+
+	return &req, nil
+}
+
+// MarkPayoutExported переводит заявку из статуса "одобрена" в "выгружена" и записывает ID
+// выгрузки. Перед записью статус сверяется с таблицей: если заявка уже выгружена или не
+// одобрена, возвращает ее вместе с ErrPayoutRequestNotApproved - повторно ее не выгружают.
+func (sc *SheetsClient) MarkPayoutExported(id, exportID string) (*PayoutRequest, error) {
+	layout := sc.payoutRequestsLayout
+	unlock := sc.sheetLocks.lock(layout.name)
+	defer unlock()
+
+	sc.cacheMutex.RLock()
+	cached, ok := sc.payoutRequests[id]
+	var req PayoutRequest
+	if ok {
+		req = *cached
+	}
+	sc.cacheMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("заявка %s не найдена", id)
+	}
+
+	rowIndex, row, err := sc.locatePayoutRequest(id)
+	if err != nil {
+		return nil, err
+	}
+	if row != nil {
+		req.Status = PayoutStatus(strings.ToLower(strings.TrimSpace(getStringValue(layout.get(row, colStatus)))))
+		req.ExportID = getStringValue(layout.get(row, colExportID))
+	}
+	if req.Status != PayoutApproved {
+		sc.cacheMutex.Lock()
+		sc.payoutRequests[id].Status = req.Status
+		sc.payoutRequests[id].ExportID = req.ExportID
+		sc.cacheMutex.Unlock()
+		return &req, fmt.Errorf("заявка %s (%s): %w", id, req.Status, ErrPayoutRequestNotApproved)
+	}
+
+	req.Status = PayoutExported
+	req.ExportID = exportID
+
+	log.Printf("📝 Обновление Заявки на выплату (строка %d): %s -> %s, выгрузка %s", rowIndex, id, PayoutExported, exportID)
+
+	if err := sc.writeRow(layout, rowIndex, sc.payoutRequestRow(&req)); err != nil {
+		log.Printf("❌ Ошибка обновления Заявки на выплату: %v", err)
+		return nil, fmt.Errorf("ошибка обновления заявки на выплату: %w", err)
+	}
+
+	sc.cacheMutex.Lock()
+	reqCopy := req
+	sc.payoutRequests[id] = &reqCopy
+	sc.payoutRequestRows[id] = rowIndex
+	sc.cacheMutex.Unlock()
+
+	return &req, nil
+}
+
+// ReopenPayoutRequest возвращает одобренную заявку в статус "ожидает" и стирает, кто и когда
+// ее рассмотрел: так отменяется одобрение, выплата по которому не попала в Журнал. Если заявка
+// уже не в статусе "одобрена", возвращает ее вместе с ErrPayoutRequestNotApproved.
+func (sc *SheetsClient) ReopenPayoutRequest(id string) (*PayoutRequest, error) {
+	layout := sc.payoutRequestsLayout
+	unlock := sc.sheetLocks.lock(layout.name)
+	defer unlock()
+
+	sc.cacheMutex.RLock()
+	cached, ok := sc.payoutRequests[id]
+	var req PayoutRequest
+	if ok {
+		req = *cached
+	}
+	sc.cacheMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("заявка %s не найдена", id)
+	}
+
+	rowIndex, row, err := sc.locatePayoutRequest(id)
+	if err != nil {
+		return nil, err
+	}
+	if row != nil {
+		req.Status = PayoutStatus(strings.ToLower(strings.TrimSpace(getStringValue(layout.get(row, colStatus)))))
+	}
+	if req.Status != PayoutApproved {
+		sc.cacheMutex.Lock()
+		sc.payoutRequests[id].Status = req.Status
+		sc.cacheMutex.Unlock()
+		return &req, fmt.Errorf("заявка %s (%s): %w", id, req.Status, ErrPayoutRequestNotApproved)
+	}
+
+	req.Status = PayoutRequested
+	req.ReviewedBy = ""
+	req.ReviewedAt = time.Time{}
+
+	log.Printf("📝 Обновление Заявки на выплату (строка %d): %s -> %s, одобрение отменено", rowIndex, id, PayoutRequested)
+
+	if err := sc.writeRow(layout, rowIndex, sc.payoutRequestRow(&req)); err != nil {
+		log.Printf("❌ Ошибка обновления Заявки на выплату: %v", err)
+		return nil, fmt.Errorf("ошибка обновления заявки на выплату: %w", err)
+	}
+
+	sc.cacheMutex.Lock()
+	reqCopy := req
+	sc.payoutRequests[id] = &reqCopy
+	sc.payoutRequestRows[id] = rowIndex
+	sc.cacheMutex.Unlock()
+
+	return &req, nil
+}
+
+// locatePayoutRequest возвращает номер строки заявки и ее текущие значения в таблице.
+// Для строки, которая еще в очереди записи, значения не читаются (row == nil).
+func (sc *SheetsClient) locatePayoutRequest(id string) (int, []interface{}, error) {
+	layout := sc.payoutRequestsLayout
+
+	sc.cacheMutex.RLock()
+	rowIndex := sc.payoutRequestRows[id]
+	sc.cacheMutex.RUnlock()
+
+	if rowIndex > 0 {
+		if sc.writes.isPending(layout.name, rowIndex) {
+			return rowIndex, nil, nil
+		}
+
+		row, err := sc.readPayoutRequestRow(rowIndex)
+		if err != nil {
+			return 0, nil, err
+		}
+		if getStringValue(layout.get(row, colRequestID)) == id {
+			return rowIndex, row, nil
+		}
+		log.Printf("⚠️ Заявка %s больше не в строке %d листа %s, ищем ее заново", id, rowIndex, layout.name)
+	}
+
+	resp, err := execute(sc, "values.get", sc.service.Spreadsheets.Values.Get(sc.spreadsheetID, layout.columnRange(colRequestID)))
+	if err != nil {
+		return 0, nil, fmt.Errorf("ошибка чтения листа Заявки на выплату: %w", err)
+	}
+	for i, cells := range resp.Values {
+		if len(cells) > 0 && getStringValue(cells[0]) == id {
+			row, err := sc.readPayoutRequestRow(i + 2)
+			if err != nil {
+				return 0, nil, err
+			}
+			return i + 2, row, nil
+		}
+	}
+
+	return 0, nil, fmt.Errorf("заявка %s не найдена в листе %s", id, layout.name)
+}
+
+// readPayoutRequestRow читает строку листа Заявки на выплату
+func (sc *SheetsClient) readPayoutRequestRow(rowIndex int) ([]interface{}, error) {
+	resp, err := execute(sc, "values.get", sc.service.Spreadsheets.Values.Get(sc.spreadsheetID, sc.payoutRequestsLayout.rowRange(rowIndex)).
+		ValueRenderOption("UNFORMATTED_VALUE"))
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения строки %d листа Заявки на выплату: %w", rowIndex, err)
+	}
+	if len(resp.Values) == 0 {
+		return []interface{}{}, nil
+	}
+	return resp.Values[0], nil
+}
+
+// GetPayoutRequests возвращает все заявки на выплату в порядке создания
+func (sc *SheetsClient) GetPayoutRequests() ([]PayoutRequest, error) {
+	sc.cacheMutex.RLock()
+	requests := make([]PayoutRequest, 0, len(sc.payoutRequests))
+	for _, req := range sc.payoutRequests {
+		requests = append(requests, *req)
+	}
+	sc.cacheMutex.RUnlock()
+
+	sort.Slice(requests, func(i, j int) bool {
+		if !requests[i].Time.Equal(requests[j].Time) {
+			return requests[i].Time.Before(requests[j].Time)
+		}
+		return requests[i].ID < requests[j].ID
+	})
+	return requests, nil
+}
+
+// payoutRequestRow собирает строку листа для заявки
+func (sc *SheetsClient) payoutRequestRow(req *PayoutRequest) []interface{} {
+	reviewedAt := ""
+	if !req.ReviewedAt.IsZero() {
+		reviewedAt = req.ReviewedAt.Format(sheetTimeFormat)
+	}
+	return sc.payoutRequestsLayout.row(map[string]interface{}{
+		colRequestID:  req.ID,
+		colTime:       req.Time.Format(sheetTimeFormat),
+		colReferrer:   fmt.Sprintf("%d", req.ReferrerID),
+		colUsername:   req.Username,
+		colWallet:     req.Wallet,
+		colAmount:     req.Amount.Float64(),
+		colStatus:     string(req.Status),
+		colReviewer:   req.ReviewedBy,
+		colReviewedAt: reviewedAt,
+		colReason:     req.Reason,
+		colExportID:   req.ExportID,
+	})
+}
+
+// loadPayoutRequestsCache загружает заявки на выплату. Вызывается под cacheMutex.
+func (sc *SheetsClient) loadPayoutRequestsCache() error {
+	layout := sc.payoutRequestsLayout
+	resp, err := execute(sc, "values.get", sc.service.Spreadsheets.Values.Get(sc.spreadsheetID, layout.dataRange()).
+		ValueRenderOption("UNFORMATTED_VALUE").
+		DateTimeRenderOption("FORMATTED_STRING"))
+	if err != nil {
+		return fmt.Errorf("ошибка чтения листа Заявки на выплату: %w", err)
+	}
+
+	sc.payoutRequests = make(map[string]*PayoutRequest)
+	sc.payoutRequestRows = make(map[string]int)
+	sc.nextFreeRow[layout.name] = nextRowAfter(resp.Values, layout, colRequestID)
+
+	for i, row := range resp.Values {
+		id := getStringValue(layout.get(row, colRequestID))
+		if id == "" {
+			continue
+		}
+
+		referrerID, err := parseIDValue(layout.get(row, colReferrer))
+		if err != nil {
+			log.Printf("⚠️ Пропуск строки %d листа Заявки на выплату: %v", i+2, err)
+			continue
+		}
+
+		req := &PayoutRequest{
+			ID:         id,
+			ReferrerID: referrerID,
+			Username:   getStringValue(layout.get(row, colUsername)),
+			Wallet:     getStringValue(layout.get(row, colWallet)),
+			Amount:     getAmountValue(layout.get(row, colAmount)),
+			Status:     PayoutStatus(strings.ToLower(strings.TrimSpace(getStringValue(layout.get(row, colStatus))))),
+		}
+		if t, ok := parseSheetTime(getStringValue(layout.get(row, colTime))); ok {
+			req.Time = t
+		}
+		req.ReviewedBy = getStringValue(layout.get(row, colReviewer))
+		req.Reason = getStringValue(layout.get(row, colReason))
+		req.ExportID = getStringValue(layout.get(row, colExportID))
+		if t, ok := parseSheetTime(getStringValue(layout.get(row, colReviewedAt))); ok {
+			req.ReviewedAt = t
+		}
+
+		sc.payoutRequests[id] = req
+		sc.payoutRequestRows[id] = i + 2
+	}
+
+	return nil
+}
@@ -0,0 +1,179 @@
+package sheets
+
+import (
+	"errors"
+	"testing"
+
+	"ss_ref_bot/money"
+)
+
+func TestPayoutRequests(t *testing.T) {
+	f, sc := newFixture(t, Options{}, func(f *fakeSpreadsheet) {
+		// Лист создан вручную, одна старая заявка уже обработана
+		f.addRow(payoutRequestsSchema.Name, "P-OLD", "01.01.2025 09:00:00", "111", "@first", "EQold", 12.5, "Одобрена")
+	})
+	ref := &Referrer{ID: 111, Username: "@first", Code: "A1", Wallet: "EQnew"}
+
+	if open, _ := sc.OpenPayoutRequest(ref.ID); open != nil {
+		t.Fatalf("одобренная заявка %s считается открытой", open.ID)
+	}
+
+	req := NewPayoutRequest(ref, 25*money.USDT)
+	if err := sc.CreatePayoutRequest(&req); err != nil {
+		t.Fatalf("ошибка создания заявки: %v", err)
+	}
+	if err := sc.Flush(); err != nil {
+		t.Fatalf("ошибка отправки очереди: %v", err)
+	}
+
+	if got := f.cell(payoutRequestsSchema.Name, 3, 0); got != req.ID {
+		t.Errorf("ID заявки в строке 3 = %v, ожидалось %s", got, req.ID)
+	}
+	if got := f.cell(payoutRequestsSchema.Name, 3, 6); got != "ожидает" {
+		t.Errorf("статус заявки = %v, ожидалось ожидает", got)
+	}
+
+	// Пока заявка не обработана, вторую создать нельзя
+	second := NewPayoutRequest(ref, 5*money.USDT)
+	if err := sc.CreatePayoutRequest(&second); !errors.Is(err, ErrPayoutRequestOpen) {
+		t.Errorf("вторая заявка: ошибка %v, ожидалась ErrPayoutRequestOpen", err)
+	}
+	other := NewPayoutRequest(&Referrer{ID: 222, Wallet: "EQother"}, 5*money.USDT)
+	if err := sc.CreatePayoutRequest(&other); err != nil {
+		t.Errorf("заявка другого рефовода: %v", err)
+	}
+
+	check := func(stage string) {
+		t.Helper()
+		open, err := sc.OpenPayoutRequest(ref.ID)
+		if err != nil || open == nil {
+			t.Fatalf("%s: открытая заявка не найдена (%v)", stage, err)
+		}
+		if open.ID != req.ID || open.Amount != 25*money.USDT || open.Wallet != "EQnew" || !open.Time.Equal(req.Time) {
+			t.Errorf("%s: заявка = %+v, ожидалась %+v", stage, *open, req)
+		}
+	}
+	check("после записи")
+	if err := sc.Flush(); err != nil {
+		t.Fatalf("ошибка отправки очереди: %v", err)
+	}
+	if err := sc.LoadCache(); err != nil {
+		t.Fatalf("ошибка загрузки кэша: %v", err)
+	}
+	check("после перезагрузки")
+
+	if n := len(f.dataRows(payoutRequestsSchema.Name)); n != 3 {
+		t.Errorf("строк в листе %d, ожидалось 3", n)
+	}
+	if all, _ := sc.GetPayoutRequests(); len(all) != 3 || all[0].ID != "P-OLD" || all[0].Status != PayoutApproved {
+		t.Errorf("все заявки = %+v, ожидалось 3 начиная с P-OLD", all)
+	}
+
+	// Одобрение записывает решение и снимает блокировку
+	approved, err := sc.ResolvePayoutRequest(req.ID, PayoutApproved, "@admin", "")
+	if err != nil {
+		t.Fatalf("ошибка одобрения заявки: %v", err)
+	}
+	if approved.Status != PayoutApproved || approved.ReviewedBy != "@admin" || approved.ReviewedAt.IsZero() {
+		t.Errorf("одобренная заявка = %+v", *approved)
+	}
+	if err := sc.Flush(); err != nil {
+		t.Fatalf("ошибка отправки очереди: %v", err)
+	}
+	if got := f.cell(payoutRequestsSchema.Name, 3, 6); got != "одобрена" {
+		t.Errorf("статус заявки = %v, ожидалось одобрена", got)
+	}
+	if got := f.cell(payoutRequestsSchema.Name, 3, 7); got != "@admin" {
+		t.Errorf("рассмотревший = %v, ожидалось @admin", got)
+	}
+	if open, _ := sc.OpenPayoutRequest(ref.ID); open != nil {
+		t.Errorf("после одобрения осталась открытая заявка %s", open.ID)
+	}
+
+	if _, err := sc.ResolvePayoutRequest(req.ID, PayoutRejected, "@other", "дубль"); !errors.Is(err, ErrPayoutRequestResolved) {
+		t.Errorf("повторное рассмотрение: ошибка %v, ожидалась ErrPayoutRequestResolved", err)
+	}
+
+	// Заявку другого рефовода оператор закрыл вручную прямо в листе
+	f.write("'"+payoutRequestsSchema.Name+"'!G4", [][]interface{}{{"Одобрена"}})
+	resolved, err := sc.ResolvePayoutRequest(other.ID, PayoutRejected, "@admin", "нет средств")
+	if !errors.Is(err, ErrPayoutRequestResolved) || resolved.Status != PayoutApproved {
+		t.Errorf("заявка, закрытая в листе: %v, %+v", err, resolved)
+	}
+	if got := f.cell(payoutRequestsSchema.Name, 4, 9); got != nil && got != "" {
+		t.Errorf("причина отказа записана в закрытую заявку: %v", got)
+	}
+}
+
+func TestMarkPayoutExported(t *testing.T) {
+	f, sc := newFixture(t, Options{}, func(f *fakeSpreadsheet) {
+		f.addRow(payoutRequestsSchema.Name, "P-A", "01.01.2025 09:00:00", "111", "@first", "EQa", 12.5, "одобрена")
+		f.addRow(payoutRequestsSchema.Name, "P-B", "01.01.2025 10:00:00", "222", "@second", "EQb", 5, "ожидает")
+	})
+
+	req, err := sc.MarkPayoutExported("P-A", "E-1")
+	if err != nil {
+		t.Fatalf("MarkPayoutExported: %v", err)
+	}
+	if req.Status != PayoutExported || req.ExportID != "E-1" {
+		t.Errorf("выгруженная заявка = %+v", *req)
+	}
+	if err := sc.Flush(); err != nil {
+		t.Fatalf("ошибка отправки очереди: %v", err)
+	}
+	if got := f.cell(payoutRequestsSchema.Name, 2, 6); got != "выгружена" {
+		t.Errorf("статус заявки = %v, ожидалось выгружена", got)
+	}
+	if got := f.cell(payoutRequestsSchema.Name, 2, 10); got != "E-1" {
+		t.Errorf("выгрузка = %v, ожидалось E-1", got)
+	}
+
+	// Выгруженную и неодобренную заявки повторно не выгрузить
+	for _, id := range []string{"P-A", "P-B"} {
+		if _, err := sc.MarkPayoutExported(id, "E-2"); !errors.Is(err, ErrPayoutRequestNotApproved) {
+			t.Errorf("заявка %s: ошибка %v, ожидалась ErrPayoutRequestNotApproved", id, err)
+		}
+	}
+	if got := f.cell(payoutRequestsSchema.Name, 2, 10); got != "E-1" {
+		t.Errorf("выгрузка после повтора = %v, ожидалось E-1", got)
+	}
+
+	// После перезагрузки кеша статус и выгрузка читаются из листа
+	if err := sc.LoadCache(); err != nil {
+		t.Fatalf("LoadCache: %v", err)
+	}
+	requests, _ := sc.GetPayoutRequests()
+	if requests[0].Status != PayoutExported || requests[0].ExportID != "E-1" {
+		t.Errorf("заявка после загрузки = %+v", requests[0])
+	}
+}
+
+func TestReopenPayoutRequest(t *testing.T) {
+	f, sc := newFixture(t, Options{}, func(f *fakeSpreadsheet) {
+		f.addRow(payoutRequestsSchema.Name, "P-A", "01.01.2025 09:00:00", "111", "@first", "EQa", 12.5, "одобрена", "@admin", "01.01.2025 10:00:00")
+	})
+
+	req, err := sc.ReopenPayoutRequest("P-A")
+	if err != nil {
+		t.Fatalf("ReopenPayoutRequest: %v", err)
+	}
+	if req.Status != PayoutRequested || req.ReviewedBy != "" || !req.ReviewedAt.IsZero() {
+		t.Errorf("заявка после отмены одобрения = %+v", *req)
+	}
+	if err := sc.Flush(); err != nil {
+		t.Fatalf("ошибка отправки очереди: %v", err)
+	}
+	if got := f.cell(payoutRequestsSchema.Name, 2, 6); got != "ожидает" {
+		t.Errorf("статус заявки = %v, ожидалось ожидает", got)
+	}
+	if got := f.cell(payoutRequestsSchema.Name, 2, 7); got != "" {
+		t.Errorf("рассмотревший = %v, ожидалось пусто", got)
+	}
+	if open, _ := sc.OpenPayoutRequest(111); open == nil || open.ID != "P-A" {
+		t.Errorf("открытая заявка = %+v, ожидалась P-A", open)
+	}
+
+	if _, err := sc.ReopenPayoutRequest("P-A"); !errors.Is(err, ErrPayoutRequestNotApproved) {
+		t.Errorf("повторная отмена: ошибка %v, ожидалась ErrPayoutRequestNotApproved", err)
+	}
+}
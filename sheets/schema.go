@@ -0,0 +1,533 @@
+package sheets
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+// Логические имена колонок, по которым бот обращается к данным.
+// Положение колонки в листе определяется по заголовку (или переопределяется в конфиге).
+const (
+	colID       = "id"
+	colUsername = "username"
+	colCode     = "code"
+	colWallet   = "wallet"
+	colRefCount = "ref_count"
+	colPending  = "pending"
+	colPaid     = "paid"
+	colRate     = "rate"
+	colLevel    = "level"
+
+	colUserID  = "user_id"
+	colInvited = "invited_at"
+	colRefCode = "ref_code"
+	colRefID   = "ref_id"
+	colProfit  = "profit"
+	colDealID  = "deal_id"
+	colBonus   = "bonus"
+	colDate    = "date"
+
+	colEntryID  = "entry_id"
+	colTime     = "time"
+	colType     = "type"
+	colReferrer = "referrer_id"
+	colDebit    = "debit"
+	colCredit   = "credit"
+	colAmount   = "amount"
+	colReason   = "reason"
+
+	colRequestID  = "request_id"
+	colStatus     = "status"
+	colReviewer   = "reviewer"
+	colReviewedAt = "reviewed_at"
+	colExportID   = "export_id"
+)
+
+// column описывает колонку листа: логическое имя и ожидаемый заголовок
+type column struct {
+	Key    string
+	Header string
+}
+
+// sheetSchema описывает ожидаемые колонки листа. Порядок колонок соответствует README
+// и используется только для сообщений; фактическое положение берется из заголовков.
+// Name - название листа по умолчанию, его можно переопределить в конфиге.
+// Optional - колонки, появившиеся позже: если их нет, бот дописывает заголовок после последней колонки.
+type sheetSchema struct {
+	Name     string
+	Columns  []column
+	Optional []column
+}
+
+// withName возвращает копию схемы для листа с другим названием
+func (s sheetSchema) withName(name string) sheetSchema {
+	if name != "" {
+		s.Name = name
+	}
+	return s
+}
+
+var (
+	referrersSchema = sheetSchema{
+		Name: "Рефоводы",
+		Columns: []column{
+			{colID, "ID"},
+			{colUsername, "Username"},
+			{colCode, "Код"},
+			{colWallet, "Кошелёк TON"},
+			{colRefCount, "Количество рефералов"},
+			{colPending, "Ожидает выплаты"},
+			{colPaid, "Выплачено"},
+		},
+		Optional: []column{
+			{colRate, "Ставка"},
+		},
+	}
+	invitedSchema = sheetSchema{
+		Name: "Приглашенные",
+		Columns: []column{
+			{colUserID, "ID пользователя"},
+			{colRefCode, "Код пригласившего"},
+		},
+		Optional: []column{
+			{colInvited, "Дата приглашения"},
+		},
+	}
+	referralsSchema = sheetSchema{
+		Name: "Рефералы",
+		Columns: []column{
+			{colRefID, "ID реферала"},
+			{colRefCode, "Код пригласившего"},
+			{colProfit, "Чистая прибыль реферала"},
+			{colDealID, "ID сделки"},
+			{colBonus, "Бонус рефоводу"},
+			{colDate, "Дата начисления"},
+		},
+		Optional: []column{
+			{colRate, "Ставка"},
+			{colLevel, "Уровень"},
+		},
+	}
+	withdrawalsSchema = sheetSchema{
+		Name: "Выводы",
+		Columns: []column{
+			{colDealID, "ID сделки"},
+			{colUserID, "ID пользователя"},
+			{colProfit, "Прибыль"},
+		},
+		Optional: []column{
+			{colDate, "Дата"},
+		},
+	}
+)
+
+// ledgerSchema - лист Журнал. Если листа нет, бот создает его сам.
+var ledgerSchema = sheetSchema{
+	Name: "Журнал",
+	Columns: []column{
+		{colEntryID, "ID записи"},
+		{colTime, "Дата"},
+		{colType, "Тип"},
+		{colReferrer, "ID рефовода"},
+		{colDebit, "Дебет"},
+		{colCredit, "Кредит"},
+		{colAmount, "Сумма"},
+		{colDealID, "ID сделки"},
+		{colReason, "Основание"},
+	},
+}
+
+// payoutRequestsSchema - лист Заявки на выплату. Если листа нет, бот создает его сам.
+var payoutRequestsSchema = sheetSchema{
+	Name: "Заявки на выплату",
+	Columns: []column{
+		{colRequestID, "ID заявки"},
+		{colTime, "Дата"},
+		{colReferrer, "ID рефовода"},
+		{colUsername, "Username"},
+		{colWallet, "Кошелёк TON"},
+		{colAmount, "Сумма"},
+		{colStatus, "Статус"},
+	},
+	Optional: []column{
+		{colReviewer, "Кем рассмотрена"},
+		{colReviewedAt, "Дата решения"},
+		{colReason, "Причина"},
+		{colExportID, "Выгрузка"},
+	},
+}
+
+// header возвращает строку заголовков схемы
+func (s sheetSchema) header() []interface{} {
+	var header []interface{}
+	for _, col := range append(append([]column(nil), s.Columns...), s.Optional...) {
+		header = append(header, col.Header)
+	}
+	return header
+}
+
+// sheetLayout - фактическое расположение колонок листа, найденное по заголовкам
+type sheetLayout struct {
+	name    string
+	columns map[string]int // логическое имя -> индекс колонки (с нуля)
+	width   int            // индекс последней используемой колонки + 1
+}
+
+// index возвращает индекс колонки или -1, если колонка не сопоставлена
+func (l *sheetLayout) index(key string) int {
+	if i, ok := l.columns[key]; ok {
+		return i
+	}
+	return -1
+}
+
+// get возвращает значение колонки key из строки или nil, если значения нет
+func (l *sheetLayout) get(row []interface{}, key string) interface{} {
+	i := l.index(key)
+	if i < 0 || i >= len(row) {
+		return nil
+	}
+	return row[i]
+}
+
+// has сообщает, есть ли в строке значение колонки key
+func (l *sheetLayout) has(row []interface{}, key string) bool {
+	i := l.index(key)
+	return i >= 0 && i < len(row)
+}
+
+// row собирает строку для записи. Колонки, которых нет в values, остаются nil -
+// Sheets API пропускает такие ячейки, поэтому вспомогательные колонки операторов не затираются.
+func (l *sheetLayout) row(values map[string]interface{}) []interface{} {
+	row := make([]interface{}, l.width)
+	for key, value := range values {
+		if i := l.index(key); i >= 0 {
+			row[i] = value
+		}
+	}
+	return row
+}
+
+// dataRange - диапазон всех строк данных (без заголовка)
+func (l *sheetLayout) dataRange() string {
+	return fmt.Sprintf("%s!A2:%s", quoteSheetName(l.name), columnLetter(l.width-1))
+}
+
+// rowRange - диапазон одной строки листа
+func (l *sheetLayout) rowRange(rowIndex int) string {
+	return fmt.Sprintf("%s!A%d:%s%d", quoteSheetName(l.name), rowIndex, columnLetter(l.width-1), rowIndex)
+}
+
+// columnRange - диапазон данных одной колонки
+func (l *sheetLayout) columnRange(key string) string {
+	letter := columnLetter(l.index(key))
+	return fmt.Sprintf("%s!%s2:%s", quoteSheetName(l.name), letter, letter)
+}
+
+// cellRange - одна ячейка колонки key в строке rowIndex
+func (l *sheetLayout) cellRange(key string, rowIndex int) string {
+	return fmt.Sprintf("%s!%s%d", quoteSheetName(l.name), columnLetter(l.index(key)), rowIndex)
+}
+
+// SchemaError перечисляет все расхождения структуры таблицы с ожидаемой
+type SchemaError struct {
+	Problems []string
+}
+
+func (e *SchemaError) Error() string {
+	return "структура таблицы не соответствует ожидаемой:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// ValidateSchema проверяет, что все листы существуют, находит колонки по заголовкам
+// (с учетом переопределений из конфига) и сохраняет найденное расположение
+func (sc *SheetsClient) ValidateSchema() error {
+	targets := []struct {
+		schema        sheetSchema
+		spreadsheetID string
+		layout        **sheetLayout
+		create        bool // создать лист, если его нет
+		readOnly      bool // лист только читается: недостающие необязательные колонки не добавляются
+	}{
+		{referrersSchema.withName(sc.sheetNames.Referrers), sc.spreadsheetID, &sc.referrersLayout, false, false},
+		{invitedSchema.withName(sc.sheetNames.Invited), sc.spreadsheetID, &sc.invitedLayout, false, false},
+		{referralsSchema.withName(sc.sheetNames.Referrals), sc.spreadsheetID, &sc.referralsLayout, false, false},
+		{withdrawalsSchema.withName(sc.sheetNames.Withdrawals), sc.withdrawalsSpreadsheetID, &sc.withdrawalsLayout, false, true},
+		{ledgerSchema.withName(sc.sheetNames.Ledger), sc.spreadsheetID, &sc.ledgerLayout, true, false},
+		{payoutRequestsSchema.withName(sc.sheetNames.PayoutRequests), sc.spreadsheetID, &sc.payoutRequestsLayout, true, false},
+	}
+
+	// Листы могут находиться в разных таблицах: проверяем каждую таблицу отдельно
+	var problems []string
+	layouts := make([]*sheetLayout, len(targets))
+	added := make([][]column, len(targets)) // недостающие необязательные колонки
+	checked := make(map[string]bool)
+	for _, target := range targets {
+		spreadsheetID := target.spreadsheetID
+		if checked[spreadsheetID] {
+			continue
+		}
+		checked[spreadsheetID] = true
+
+		existing, err := sc.sheetTitles(spreadsheetID)
+		if err != nil {
+			return err
+		}
+
+		var ranges []string
+		var indexes []int
+		for i, t := range targets {
+			if t.spreadsheetID != spreadsheetID {
+				continue
+			}
+			if !existing[t.schema.Name] && t.create {
+				if err := sc.createSheet(spreadsheetID, t.schema); err != nil {
+					return err
+				}
+				layout, _, layoutProblems := resolveLayout(t.schema, t.schema.header(), sc.columnOverrides)
+				problems = append(problems, layoutProblems...)
+				layouts[i] = layout
+				continue
+			}
+			if !existing[t.schema.Name] {
+				problems = append(problems, fmt.Sprintf("лист %q не найден в таблице %s", t.schema.Name, spreadsheetID))
+				continue
+			}
+			ranges = append(ranges, fmt.Sprintf("%s!1:1", quoteSheetName(t.schema.Name)))
+			indexes = append(indexes, i)
+		}
+
+		if len(ranges) == 0 {
+			continue
+		}
+
+		resp, err := execute(sc, "values.batchGet", sc.service.Spreadsheets.Values.BatchGet(spreadsheetID).Ranges(ranges...))
+		if err != nil {
+			return fmt.Errorf("ошибка чтения заголовков таблицы %s: %w", spreadsheetID, err)
+		}
+
+		for j, i := range indexes {
+			var header []interface{}
+			if j < len(resp.ValueRanges) && len(resp.ValueRanges[j].Values) > 0 {
+				header = resp.ValueRanges[j].Values[0]
+			}
+
+			layout, missing, layoutProblems := resolveLayout(targets[i].schema, header, sc.columnOverrides)
+			problems = append(problems, layoutProblems...)
+			layouts[i] = layout
+			if targets[i].readOnly {
+				// Колонки нет в листе - значение считается пустым
+				for _, col := range missing {
+					delete(layout.columns, col.Key)
+				}
+				continue
+			}
+			added[i] = missing
+		}
+	}
+
+	if len(problems) > 0 {
+		return &SchemaError{Problems: problems}
+	}
+
+	for i, target := range targets {
+		if len(added[i]) > 0 {
+			if err := sc.addColumns(target.spreadsheetID, layouts[i], added[i]); err != nil {
+				return err
+			}
+		}
+		*target.layout = layouts[i]
+	}
+
+	return nil
+}
+
+// sheetTitles возвращает названия всех листов таблицы
+func (sc *SheetsClient) sheetTitles(spreadsheetID string) (map[string]bool, error) {
+	spreadsheet, err := execute(sc, "spreadsheets.get", sc.service.Spreadsheets.Get(spreadsheetID).
+		Fields("sheets.properties.title"))
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения списка листов таблицы %s: %w", spreadsheetID, err)
+	}
+
+	titles := make(map[string]bool)
+	for _, sheet := range spreadsheet.Sheets {
+		if sheet.Properties != nil {
+			titles[sheet.Properties.Title] = true
+		}
+	}
+	return titles, nil
+}
+
+// createSheet добавляет в таблицу лист со строкой заголовков схемы
+func (sc *SheetsClient) createSheet(spreadsheetID string, schema sheetSchema) error {
+	request := &sheets.BatchUpdateSpreadsheetRequest{
+		Requests: []*sheets.Request{{
+			AddSheet: &sheets.AddSheetRequest{Properties: &sheets.SheetProperties{Title: schema.Name}},
+		}},
+	}
+	if _, err := executeWrite(sc, "spreadsheets.batchUpdate", sc.service.Spreadsheets.BatchUpdate(spreadsheetID, request)); err != nil {
+		return fmt.Errorf("ошибка создания листа %s: %w", schema.Name, err)
+	}
+
+	header := &sheets.ValueRange{Values: [][]interface{}{schema.header()}}
+	headerRange := fmt.Sprintf("%s!1:1", quoteSheetName(schema.Name))
+	if _, err := executeWrite(sc, "values.update", sc.service.Spreadsheets.Values.Update(spreadsheetID, headerRange, header).
+		ValueInputOption("RAW")); err != nil {
+		return fmt.Errorf("ошибка записи заголовков листа %s: %w", schema.Name, err)
+	}
+
+	log.Printf("✅ Создан лист %s", schema.Name)
+	return nil
+}
+
+// addColumns дописывает заголовки необязательных колонок, для которых resolveLayout
+// уже выделил места после последней колонки листа
+func (sc *SheetsClient) addColumns(spreadsheetID string, layout *sheetLayout, columns []column) error {
+	for _, col := range columns {
+		header := &sheets.ValueRange{Values: [][]interface{}{{col.Header}}}
+		headerRange := fmt.Sprintf("%s!%s1", quoteSheetName(layout.name), columnLetter(layout.index(col.Key)))
+		if _, err := executeWrite(sc, "values.update", sc.service.Spreadsheets.Values.Update(spreadsheetID, headerRange, header).
+			ValueInputOption("RAW")); err != nil {
+			return fmt.Errorf("ошибка добавления колонки %q в лист %s: %w", col.Header, layout.name, err)
+		}
+		log.Printf("✅ В лист %s добавлена колонка %q (%s)", layout.name, col.Header, columnLetter(layout.index(col.Key)))
+	}
+	return nil
+}
+
+// resolveLayout сопоставляет колонки схемы со строкой заголовков.
+// overrides задает колонку явно в виде "Лист.поле" -> буква колонки.
+// Ненайденным необязательным колонкам отводятся места после последней колонки листа,
+// они возвращаются в missing - их заголовки нужно дописать.
+func resolveLayout(schema sheetSchema, header []interface{}, overrides map[string]string) (layout *sheetLayout, missing []column, problems []string) {
+	actual := make([]string, len(header))
+	for i, v := range header {
+		actual[i] = getStringValue(v)
+	}
+
+	layout = &sheetLayout{name: schema.Name, columns: make(map[string]int)}
+
+	for _, col := range append(append([]column(nil), schema.Columns...), schema.Optional...) {
+		if letter, ok := overrides[schema.Name+"."+col.Key]; ok {
+			index, err := columnIndex(letter)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("лист %q: некорректное переопределение колонки %q: %v", schema.Name, col.Header, err))
+				continue
+			}
+			layout.columns[col.Key] = index
+			continue
+		}
+
+		index := findHeader(actual, col.Header)
+
+		if index < 0 {
+			if isOptional(schema, col.Key) {
+				missing = append(missing, col)
+				continue
+			}
+			problems = append(problems, fmt.Sprintf("лист %q: не найдена колонка с заголовком %q", schema.Name, col.Header))
+			continue
+		}
+		layout.columns[col.Key] = index
+	}
+
+	// Новые колонки - после последней колонки с заголовком и после всех сопоставленных
+	next := len(actual)
+	for next > 0 && strings.TrimSpace(actual[next-1]) == "" {
+		next--
+	}
+	for _, index := range layout.columns {
+		if index+1 > next {
+			next = index + 1
+		}
+	}
+	for _, col := range missing {
+		layout.columns[col.Key] = next
+		next++
+	}
+
+	for _, index := range layout.columns {
+		if index+1 > layout.width {
+			layout.width = index + 1
+		}
+	}
+
+	return layout, missing, problems
+}
+
+func isOptional(schema sheetSchema, key string) bool {
+	for _, col := range schema.Optional {
+		if col.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// findHeader ищет колонку с заголовком: сначала точное совпадение,
+// затем заголовок с пояснением (чтобы "ID" не совпал с "ID пользователя" раньше времени)
+func findHeader(actual []string, expected string) int {
+	for i, a := range actual {
+		if normalizeHeader(a) == normalizeHeader(expected) {
+			return i
+		}
+	}
+	for i, a := range actual {
+		if headerMatches(a, expected) {
+			return i
+		}
+	}
+	return -1
+}
+
+// headerMatches сравнивает заголовки без учета регистра, ё/е и пояснений после основного названия
+// (например, "Ожидает выплаты (USDT)" соответствует "Ожидает выплаты")
+func headerMatches(actual, expected string) bool {
+	a := normalizeHeader(actual)
+	e := normalizeHeader(expected)
+	if a == e {
+		return true
+	}
+	return strings.HasPrefix(a, e+" ") || strings.HasPrefix(a, e+"(") || strings.HasPrefix(a, e+",")
+}
+
+func normalizeHeader(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	s = strings.ReplaceAll(s, "ё", "е")
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// quoteSheetName экранирует название листа для A1-нотации (нужно для названий с пробелами)
+func quoteSheetName(name string) string {
+	return "'" + strings.ReplaceAll(name, "'", "''") + "'"
+}
+
+// columnLetter переводит индекс колонки (с нуля) в буквенное обозначение: 0 -> A, 26 -> AA
+func columnLetter(index int) string {
+	letters := ""
+	for index >= 0 {
+		letters = string(rune('A'+index%26)) + letters
+		index = index/26 - 1
+	}
+	return letters
+}
+
+// columnIndex переводит буквенное обозначение колонки в индекс (с нуля): A -> 0, AA -> 26
+func columnIndex(letter string) (int, error) {
+	letter = strings.ToUpper(strings.TrimSpace(letter))
+	if letter == "" {
+		return 0, fmt.Errorf("пустое обозначение колонки")
+	}
+
+	index := 0
+	for _, r := range letter {
+		if r < 'A' || r > 'Z' {
+			return 0, fmt.Errorf("некорректное обозначение колонки %q", letter)
+		}
+		index = index*26 + int(r-'A'+1)
+	}
+	return index - 1, nil
+}
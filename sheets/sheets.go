@@ -6,11 +6,14 @@ import (
 	"fmt"
 	"log"
 	"math/big"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"ss_ref_bot/money"
+
 	"google.golang.org/api/option"
 	"google.golang.org/api/sheets/v4"
 )
@@ -19,13 +22,54 @@ type SheetsClient struct {
 	service       *sheets.Service
 	spreadsheetID string
 
+	// Ограничение частоты запросов, повторы и счетчики вызовов Sheets API
+	limiter    *tokenBucket
+	maxRetries int
+	statsMutex sync.Mutex
+	stats      map[string]CallStats
+
+	// Очередь отложенной записи изменений
+	writes *writeQueue
+
+	// Таблица с листом Выводы (по умолчанию та же, что и spreadsheetID)
+	withdrawalsSpreadsheetID string
+	sheetNames               SheetNames
+
+	// Расположение колонок, найденное по заголовкам листов
+	columnOverrides      map[string]string // "Лист.поле" -> буква колонки
+	referrersLayout      *sheetLayout
+	invitedLayout        *sheetLayout
+	referralsLayout      *sheetLayout
+	withdrawalsLayout    *sheetLayout
+	ledgerLayout         *sheetLayout
+	payoutRequestsLayout *sheetLayout
+
 	// Кэш для быстрого поиска
 	cacheMutex      sync.RWMutex
 	referrersByID   map[int64]*Referrer
 	referrersByCode map[string]*Referrer // нормализованный код -> Referrer
 	invitedByUserID map[int64]*Invited
 	existingDealIDs map[string]bool
+	referralKeys    map[string]bool         // сделка и уровень (referralKey) -> запись в Рефералы есть
+	referredProfit  map[string]money.Amount // нормализованный код -> прибыль рефералов первого уровня
 	lastCacheUpdate time.Time
+
+	// Номера строк записей в листах, чтобы обновлять их без чтения всего листа
+	referrerRows map[int64]int
+	invitedRows  map[int64]int
+	nextFreeRow  map[string]int // название листа -> первая строка после данных
+
+	// Журнал: ID записей (для защиты от повторов) и остатки рефоводов по записям
+	ledgerIDs      map[string]bool
+	ledgerEntries  map[int64][]LedgerEntry // ID рефовода -> записи журнала
+	ledgerBalances map[int64]*LedgerBalance
+
+	payoutRequests    map[string]*PayoutRequest // ID заявки -> заявка
+	payoutRequestRows map[string]int            // ID заявки -> номер строки
+
+	// Сериализация изменений: по ID рефовода и по названию листа (выделение строк)
+	referrerLocks *keyedLocks
+	sheetLocks    *keyedLocks
 }
 
 type Referrer struct {
@@ -34,47 +78,150 @@ type Referrer struct {
 	Code          string
 	Wallet        string
 	RefCount      int
-	PendingPayout float64
-	PaidOut       float64 // Выплачено (колонка G)
+	PendingPayout money.Amount
+	PaidOut       money.Amount  // Выплачено
+	Rate          money.Percent // индивидуальная ставка; 0 - общая ставка из конфигурации
 }
 
 type Invited struct {
-	UserID  int64
-	RefCode string
+	UserID    int64
+	RefCode   string
+	InvitedAt time.Time // нулевое значение - дата неизвестна (приглашен до появления колонки)
 }
 
 type Referral struct {
 	RefID   int64
 	RefCode string
-	Profit  float64
+	Profit  money.Amount
 	DealID  string
-	Bonus   float64
+	Bonus   money.Amount
 	Date    string
+	Rate    money.Percent // ставка, по которой начислен бонус
+	Level   int           // уровень партнерской цепочки: 1 - прямой пригласивший, 2 - пригласивший его
 }
 
 type Withdrawal struct {
 	DealID string
 	UserID int64
-	Profit float64
+	Profit money.Amount
+	Date   time.Time // дата сделки из колонки "Дата"; нулевое значение - дата неизвестна
+
+	// Invalid - почему строку нельзя обработать (некорректный ID пользователя или прибыль);
+	// пусто - строка корректна
+	Invalid string
+}
+
+// Processable сообщает, можно ли начислить бонус по сделке. Прибыль <= 0 - сторно:
+// такая сделка бонуса не дает, а начисленный по ней бонус списывается.
+func (w Withdrawal) Processable() bool {
+	return w.Invalid == "" && w.Profit > 0
 }
 
-func NewSheetsClient(spreadsheetID, credentialsPath string) (*SheetsClient, error) {
+// SheetNames - названия листов для каждой логической таблицы.
+// Пустое значение означает название по умолчанию.
+type SheetNames struct {
+	Referrers      string // Рефоводы
+	Invited        string // Приглашенные
+	Referrals      string // Рефералы
+	Withdrawals    string // Выводы
+	Ledger         string // Журнал
+	PayoutRequests string // Заявки на выплату
+}
+
+// Options - параметры подключения к Google Таблицам
+type Options struct {
+	SpreadsheetID   string
+	CredentialsPath string
+
+	// WithdrawalsSpreadsheetID - отдельная таблица с листом Выводы (вместо IMPORTRANGE).
+	// Если пусто, лист Выводы читается из SpreadsheetID.
+	WithdrawalsSpreadsheetID string
+	SheetNames               SheetNames
+
+	// RequestsPerMinute - средняя частота запросов к Sheets API (квота), по умолчанию 60
+	RequestsPerMinute int
+	// MaxRetries - число повторов при 429 и 5xx (запись - только при 429), по умолчанию 5
+	MaxRetries int
+
+	// FlushInterval - как часто отправлять накопленные изменения одним BatchUpdate.
+	// 0 - писать каждое изменение сразу.
+	FlushInterval time.Duration
+	// FlushSize - число изменений, при котором очередь отправляется досрочно, по умолчанию 50
+	FlushSize int
+	// SpoolPath - файл, в котором очередь сохраняется до отправки (пусто - без сохранения)
+	SpoolPath string
+
+	// ColumnOverrides позволяет явно задать колонку для поля в виде
+	// "Лист.поле" -> буква (например, "Рефоводы.wallet" -> "H");
+	// остальные колонки находятся по заголовкам.
+	ColumnOverrides map[string]string
+}
+
+func NewSheetsClient(opts Options) (*SheetsClient, error) {
 	ctx := context.Background()
 
-	service, err := sheets.NewService(ctx, option.WithCredentialsFile(credentialsPath))
+	service, err := sheets.NewService(ctx, option.WithCredentialsFile(opts.CredentialsPath))
 	if err != nil {
 		return nil, fmt.Errorf("ошибка создания клиента Google Sheets: %w", err)
 	}
 
+	return newSheetsClient(service, opts)
+}
+
+// newSheetsClient создает клиент поверх готового сервиса (в тестах - с фейковым сервером)
+func newSheetsClient(service *sheets.Service, opts Options) (*SheetsClient, error) {
+	var err error
+
+	withdrawalsSpreadsheetID := opts.WithdrawalsSpreadsheetID
+	if withdrawalsSpreadsheetID == "" {
+		withdrawalsSpreadsheetID = opts.SpreadsheetID
+	}
+
+	maxRetries := opts.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = defaultMaxRetries
+	}
+
 	client := &SheetsClient{
-		service:         service,
-		spreadsheetID:   spreadsheetID,
-		referrersByID:   make(map[int64]*Referrer),
-		referrersByCode: make(map[string]*Referrer),
-		invitedByUserID: make(map[int64]*Invited),
-		existingDealIDs: make(map[string]bool),
+		service:                  service,
+		limiter:                  newTokenBucket(opts.RequestsPerMinute),
+		maxRetries:               maxRetries,
+		stats:                    make(map[string]CallStats),
+		spreadsheetID:            opts.SpreadsheetID,
+		withdrawalsSpreadsheetID: withdrawalsSpreadsheetID,
+		sheetNames:               opts.SheetNames,
+		columnOverrides:          opts.ColumnOverrides,
+		referrersByID:            make(map[int64]*Referrer),
+		referrersByCode:          make(map[string]*Referrer),
+		invitedByUserID:          make(map[int64]*Invited),
+		existingDealIDs:          make(map[string]bool),
+		referralKeys:             make(map[string]bool),
+		referredProfit:           make(map[string]money.Amount),
+		referrerRows:             make(map[int64]int),
+		invitedRows:              make(map[int64]int),
+		nextFreeRow:              make(map[string]int),
+		ledgerIDs:                make(map[string]bool),
+		ledgerEntries:            make(map[int64][]LedgerEntry),
+		ledgerBalances:           make(map[int64]*LedgerBalance),
+		payoutRequests:           make(map[string]*PayoutRequest),
+		payoutRequestRows:        make(map[string]int),
+		referrerLocks:            newKeyedLocks(),
+		sheetLocks:               newKeyedLocks(),
+	}
+
+	// Проверяем структуру таблицы: при сдвинутых или переименованных колонках
+	// бот читал бы нулевые балансы, поэтому отказываемся запускаться
+	if err := client.ValidateSchema(); err != nil {
+		return nil, err
 	}
 
+	// Восстанавливаем очередь записи после перезапуска; она будет отправлена перед загрузкой кэша
+	client.writes, err = newWriteQueue(client, opts.SpoolPath, opts.FlushInterval, opts.FlushSize)
+	if err != nil {
+		return nil, err
+	}
+	client.writes.start()
+
 	// Загружаем кэш при инициализации
 	if err := client.LoadCache(); err != nil {
 		log.Printf("Предупреждение: не удалось загрузить кэш при инициализации: %v", err)
@@ -85,6 +232,11 @@ func NewSheetsClient(spreadsheetID, credentialsPath string) (*SheetsClient, erro
 
 // LoadCache загружает все данные в кэш для быстрого поиска
 func (sc *SheetsClient) LoadCache() error {
+	// Сначала отправляем отложенные изменения, иначе кэш перезапишется устаревшими данными
+	if err := sc.Flush(); err != nil {
+		return fmt.Errorf("ошибка отправки очереди записи перед загрузкой кэша: %w", err)
+	}
+
 	sc.cacheMutex.Lock()
 	defer sc.cacheMutex.Unlock()
 
@@ -105,30 +257,45 @@ func (sc *SheetsClient) LoadCache() error {
 		return fmt.Errorf("ошибка загрузки кэша DealIDs: %w", err)
 	}
 
+	// Загружаем Журнал и пересчитываем по нему остатки рефоводов
+	if err := sc.loadLedgerCache(); err != nil {
+		return fmt.Errorf("ошибка загрузки кэша журнала: %w", err)
+	}
+
+	// Загружаем заявки на выплату
+	if err := sc.loadPayoutRequestsCache(); err != nil {
+		return fmt.Errorf("ошибка загрузки кэша заявок на выплату: %w", err)
+	}
+
 	sc.lastCacheUpdate = time.Now()
-	log.Printf("Кэш загружен: рефоводов=%d, приглашенных=%d, сделок=%d",
-		len(sc.referrersByID), len(sc.invitedByUserID), len(sc.existingDealIDs))
+	log.Printf("Кэш загружен: рефоводов=%d, приглашенных=%d, сделок=%d, записей журнала=%d, заявок=%d",
+		len(sc.referrersByID), len(sc.invitedByUserID), len(sc.existingDealIDs), len(sc.ledgerIDs), len(sc.payoutRequests))
 
 	return nil
 }
 
 // loadReferrersCache загружает рефоводов в кэш
 func (sc *SheetsClient) loadReferrersCache() error {
-	readRange := "Рефоводы!A2:G"
-	resp, err := sc.service.Spreadsheets.Values.Get(sc.spreadsheetID, readRange).
-		ValueRenderOption("UNFORMATTED_VALUE").Do()
+	readRange := sc.referrersLayout.dataRange()
+	resp, err := execute(sc, "values.get", sc.service.Spreadsheets.Values.Get(sc.spreadsheetID, readRange).
+		ValueRenderOption("UNFORMATTED_VALUE"))
 	if err != nil {
 		return fmt.Errorf("ошибка чтения листа Рефоводы: %w", err)
 	}
+	if err := sc.readFormattedColumn(sc.referrersLayout, colRate, resp.Values); err != nil {
+		return err
+	}
 
 	sc.referrersByID = make(map[int64]*Referrer)
 	sc.referrersByCode = make(map[string]*Referrer)
+	sc.referrerRows = make(map[int64]int)
+	sc.nextFreeRow[sc.referrersLayout.name] = nextRowAfter(resp.Values, sc.referrersLayout, colID)
 
 	if resp.Values == nil {
 		return nil
 	}
 
-	for _, row := range resp.Values {
+	for i, row := range resp.Values {
 		if len(row) < 1 {
 			continue
 		}
@@ -140,6 +307,7 @@ func (sc *SheetsClient) loadReferrersCache() error {
 
 		// Добавляем в кэш по ID
 		sc.referrersByID[ref.ID] = ref
+		sc.referrerRows[ref.ID] = i + 2 // +2 потому что начинаем с строки 2 и индексация с 0
 
 		// Добавляем в кэш по коду (нормализованному)
 		if ref.Code != "" {
@@ -151,15 +319,45 @@ func (sc *SheetsClient) loadReferrersCache() error {
 	return nil
 }
 
+// sheetReferrer - рефовод, прочитанный из таблицы, с номером строки
+type sheetReferrer struct {
+	Referrer
+	Row int
+}
+
+// readReferrersSheet читает лист Рефоводы мимо кэша. Строки без кода пропускаются.
+func (sc *SheetsClient) readReferrersSheet() ([]sheetReferrer, error) {
+	// Используем UNFORMATTED_VALUE для получения вычисленных значений из функций (например, СУММ)
+	resp, err := execute(sc, "values.get", sc.service.Spreadsheets.Values.Get(sc.spreadsheetID, sc.referrersLayout.dataRange()).
+		ValueRenderOption("UNFORMATTED_VALUE"))
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения листа Рефоводы: %w", err)
+	}
+	if err := sc.readFormattedColumn(sc.referrersLayout, colRate, resp.Values); err != nil {
+		return nil, err
+	}
+
+	var referrers []sheetReferrer
+	for i, row := range resp.Values {
+		ref := sc.parseReferrerRow(row)
+		if ref == nil || ref.Code == "" {
+			continue
+		}
+		referrers = append(referrers, sheetReferrer{Referrer: *ref, Row: i + 2})
+	}
+	return referrers, nil
+}
+
 // parseReferrerRow парсит строку рефовода из таблицы
 func (sc *SheetsClient) parseReferrerRow(row []interface{}) *Referrer {
-	if len(row) < 1 {
+	layout := sc.referrersLayout
+	if !layout.has(row, colID) {
 		return nil
 	}
 
 	// Пробуем получить ID разными способами
 	var id int64
-	switch v := row[0].(type) {
+	switch v := layout.get(row, colID).(type) {
 	case string:
 		parsed, err := strconv.ParseInt(v, 10, 64)
 		if err != nil {
@@ -173,7 +371,7 @@ func (sc *SheetsClient) parseReferrerRow(row []interface{}) *Referrer {
 	case float64:
 		id = int64(v)
 	default:
-		idStr := getStringValue(row[0])
+		idStr := getStringValue(v)
 		if idStr == "" {
 			return nil
 		}
@@ -184,51 +382,42 @@ func (sc *SheetsClient) parseReferrerRow(row []interface{}) *Referrer {
 		id = parsed
 	}
 
-	ref := &Referrer{ID: id}
-
-	if len(row) > 1 {
-		ref.Username = getStringValue(row[1])
-	}
-	if len(row) > 2 {
-		ref.Code = getStringValue(row[2])
-	}
-	if len(row) > 3 {
-		ref.Wallet = getStringValue(row[3])
-	}
-	if len(row) > 4 {
-		ref.RefCount = getIntValue(row[4])
+	return &Referrer{
+		ID:            id,
+		Username:      getStringValue(layout.get(row, colUsername)),
+		Code:          getStringValue(layout.get(row, colCode)),
+		Wallet:        getStringValue(layout.get(row, colWallet)),
+		RefCount:      getIntValue(layout.get(row, colRefCount)),
+		PendingPayout: getAmountValue(layout.get(row, colPending)),
+		PaidOut:       getAmountValue(layout.get(row, colPaid)),
+		Rate:          getPercentValue(layout.get(row, colRate)),
 	}
-	if len(row) > 5 {
-		ref.PendingPayout = getFloatValue(row[5])
-	}
-	if len(row) > 6 {
-		ref.PaidOut = getFloatValue(row[6])
-	}
-
-	return ref
 }
 
 // loadInvitedCache загружает приглашенных в кэш
 func (sc *SheetsClient) loadInvitedCache() error {
-	readRange := "Приглашенные!A2:B"
-	resp, err := sc.service.Spreadsheets.Values.Get(sc.spreadsheetID, readRange).Do()
+	layout := sc.invitedLayout
+	readRange := layout.dataRange()
+	resp, err := execute(sc, "values.get", sc.service.Spreadsheets.Values.Get(sc.spreadsheetID, readRange))
 	if err != nil {
 		return fmt.Errorf("ошибка чтения листа Приглашенные: %w", err)
 	}
 
 	sc.invitedByUserID = make(map[int64]*Invited)
+	sc.invitedRows = make(map[int64]int)
+	sc.nextFreeRow[layout.name] = nextRowAfter(resp.Values, layout, colUserID)
 
 	if resp.Values == nil {
 		return nil
 	}
 
-	for _, row := range resp.Values {
-		if len(row) < 2 {
+	for i, row := range resp.Values {
+		if !layout.has(row, colUserID) || !layout.has(row, colRefCode) {
 			continue
 		}
 
 		var userID int64
-		switch v := row[0].(type) {
+		switch v := layout.get(row, colUserID).(type) {
 		case string:
 			parsed, err := strconv.ParseInt(v, 10, 64)
 			if err != nil {
@@ -247,41 +436,69 @@ func (sc *SheetsClient) loadInvitedCache() error {
 
 		invited := &Invited{
 			UserID:  userID,
-			RefCode: getStringValue(row[1]),
+			RefCode: getStringValue(layout.get(row, colRefCode)),
+		}
+		if t, ok := parseSheetTime(getStringValue(layout.get(row, colInvited))); ok {
+			invited.InvitedAt = t
 		}
 
 		sc.invitedByUserID[userID] = invited
+		sc.invitedRows[userID] = i + 2
 	}
 
 	return nil
 }
 
-// loadDealIDsCache загружает существующие DealIDs в кэш
+// loadDealIDsCache загружает существующие DealIDs и суммарную прибыль рефералов по кодам в кэш
 func (sc *SheetsClient) loadDealIDsCache() error {
-	readRange := "Рефералы!D2:D"
-	resp, err := sc.service.Spreadsheets.Values.Get(sc.spreadsheetID, readRange).Do()
+	layout := sc.referralsLayout
+	resp, err := execute(sc, "values.get", sc.service.Spreadsheets.Values.Get(sc.spreadsheetID, layout.dataRange()).
+		ValueRenderOption("UNFORMATTED_VALUE"))
 	if err != nil {
 		return fmt.Errorf("ошибка чтения листа Рефералы: %w", err)
 	}
 
 	sc.existingDealIDs = make(map[string]bool)
-
-	if resp.Values == nil {
-		return nil
-	}
+	sc.referralKeys = make(map[string]bool)
+	sc.referredProfit = make(map[string]money.Amount)
+	sc.nextFreeRow[layout.name] = nextRowAfter(resp.Values, layout, colDealID)
 
 	for _, row := range resp.Values {
-		if len(row) > 0 {
-			dealID := getStringValue(row[0])
-			if dealID != "" {
-				sc.existingDealIDs[dealID] = true
-			}
+		dealID := getStringValue(layout.get(row, colDealID))
+		if dealID == "" {
+			continue
+		}
+		level := getLevelValue(layout.get(row, colLevel))
+		sc.referralKeys[referralKey(dealID, level)] = true
+
+		// Сделка обработана, когда есть начисление первого уровня.
+		// Ступени ставки считаются по прибыли прямых рефералов.
+		if level == 1 {
+			sc.existingDealIDs[dealID] = true
+			code := normalizeCode(getStringValue(layout.get(row, colRefCode)))
+			sc.referredProfit[code] += getAmountValue(layout.get(row, colProfit))
 		}
 	}
 
 	return nil
 }
 
+// nextRowAfter возвращает номер строки после последней строки с заполненной колонкой key
+func nextRowAfter(rows [][]interface{}, layout *sheetLayout, key string) int {
+	lastRow := 1 // заголовок
+	for i, row := range rows {
+		if getStringValue(layout.get(row, key)) != "" {
+			lastRow = i + 2
+		}
+	}
+	return lastRow + 1
+}
+
+// Flush отправляет все отложенные изменения в таблицу
+func (sc *SheetsClient) Flush() error {
+	return sc.writes.flush()
+}
+
 // GetReferrerByID получает рефовода по ID из кэша
 func (sc *SheetsClient) GetReferrerByID(userID int64) (*Referrer, error) {
 	sc.cacheMutex.RLock()
@@ -297,31 +514,108 @@ func (sc *SheetsClient) GetReferrerByID(userID int64) (*Referrer, error) {
 	return &refCopy, nil
 }
 
-// findFirstEmptyRow находит первую пустую строку в листе (начиная со строки 2)
-func (sc *SheetsClient) findFirstEmptyRow(sheetName string) (int, error) {
-	readRange := fmt.Sprintf("%s!A2:A", sheetName)
-	resp, err := sc.service.Spreadsheets.Values.Get(sc.spreadsheetID, readRange).Do()
+// GetReferrers возвращает копии всех рефоводов из кэша по возрастанию ID
+func (sc *SheetsClient) GetReferrers() ([]Referrer, error) {
+	sc.cacheMutex.RLock()
+	referrers := make([]Referrer, 0, len(sc.referrersByID))
+	for _, ref := range sc.referrersByID {
+		referrers = append(referrers, *ref)
+	}
+	sc.cacheMutex.RUnlock()
+
+	sort.Slice(referrers, func(i, j int) bool { return referrers[i].ID < referrers[j].ID })
+	return referrers, nil
+}
+
+// reserveRow выделяет строку для новой записи по счетчику свободных строк листа.
+// Счетчик проверяется чтением одной ячейки; если строка уже занята (например,
+// оператор добавил строки вручную), свободная строка ищется заново по колонке keyColumn.
+// Вызывается под блокировкой листа, пока запись не поставлена в очередь.
+func (sc *SheetsClient) reserveRow(layout *sheetLayout, keyColumn string) (int, error) {
+	sc.cacheMutex.Lock()
+	rowIndex := sc.nextFreeRow[layout.name]
+	if rowIndex > 0 {
+		sc.nextFreeRow[layout.name] = rowIndex + 1
+	}
+	sc.cacheMutex.Unlock()
+
+	if rowIndex > 0 {
+		value, err := sc.readCell(layout, keyColumn, rowIndex)
+		if err != nil {
+			return 0, err
+		}
+		if getStringValue(value) == "" {
+			return rowIndex, nil
+		}
+		log.Printf("⚠️ Строка %d листа %s уже занята, ищем свободную строку заново", rowIndex, layout.name)
+	}
+
+	rowIndex, err := sc.findNextFreeRow(layout, keyColumn)
 	if err != nil {
-		return 2, fmt.Errorf("ошибка чтения листа %s: %w", sheetName, err)
+		return 0, err
 	}
 
-	if len(resp.Values) == 0 {
-		return 2, nil // Первая строка после заголовка
+	sc.cacheMutex.Lock()
+	sc.nextFreeRow[layout.name] = rowIndex + 1
+	sc.cacheMutex.Unlock()
+
+	return rowIndex, nil
+}
+
+// findNextFreeRow находит строку после последней заполненной записи листа
+// по колонке keyColumn, которая заполнена в каждой записи
+func (sc *SheetsClient) findNextFreeRow(layout *sheetLayout, keyColumn string) (int, error) {
+	readRange := layout.columnRange(keyColumn)
+	resp, err := execute(sc, "values.get", sc.service.Spreadsheets.Values.Get(sc.spreadsheetID, readRange))
+	if err != nil {
+		return 0, fmt.Errorf("ошибка чтения листа %s: %w", layout.name, err)
 	}
 
-	// Ищем первую пустую строку
+	lastRow := 1 // заголовок
 	for i, row := range resp.Values {
-		if len(row) == 0 || getStringValue(row[0]) == "" {
-			return i + 2, nil // +2 потому что начинаем с строки 2 и индексация с 0
+		if len(row) > 0 && getStringValue(row[0]) != "" {
+			lastRow = i + 2 // +2 потому что начинаем с строки 2 и индексация с 0
 		}
 	}
 
-	// Если все строки заполнены, возвращаем следующую после последней
-	return len(resp.Values) + 2, nil
+	// Строки, запись которых еще в очереди, уже заняты
+	pending := sc.writes.pendingRows(layout.name)
+	rowIndex := lastRow + 1
+	for pending[rowIndex] {
+		rowIndex++
+	}
+	return rowIndex, nil
+}
+
+// readCell читает одну ячейку колонки key в строке rowIndex
+func (sc *SheetsClient) readCell(layout *sheetLayout, key string, rowIndex int) (interface{}, error) {
+	resp, err := execute(sc, "values.get", sc.service.Spreadsheets.Values.Get(sc.spreadsheetID, layout.cellRange(key, rowIndex)).
+		ValueRenderOption("UNFORMATTED_VALUE"))
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения листа %s: %w", layout.name, err)
+	}
+
+	if len(resp.Values) == 0 || len(resp.Values[0]) == 0 {
+		return nil, nil
+	}
+	return resp.Values[0][0], nil
+}
+
+// writeRow ставит запись строки листа в очередь отложенной записи
+func (sc *SheetsClient) writeRow(layout *sheetLayout, rowIndex int, row []interface{}) error {
+	return sc.writes.enqueue(pendingWrite{
+		Sheet:  layout.name,
+		Row:    rowIndex,
+		Range:  layout.rowRange(rowIndex),
+		Values: [][]interface{}{row},
+	})
 }
 
 // CreateReferrer создает нового рефовода
 func (sc *SheetsClient) CreateReferrer(userID int64, username string) (*Referrer, error) {
+	unlock := sc.referrerLocks.lock(strconv.FormatInt(userID, 10))
+	defer unlock()
+
 	// Проверяем, не существует ли уже рефовод с таким ID
 	sc.cacheMutex.RLock()
 	existingRef, exists := sc.referrersByID[userID]
@@ -345,158 +639,134 @@ func (sc *SheetsClient) CreateReferrer(userID int64, username string) (*Referrer
 		Username:      username,
 		Code:          code,
 		RefCount:      0,
-		PendingPayout: 0.0,
-		PaidOut:       0.0,
+		PendingPayout: 0,
+		PaidOut:       0,
 	}
 
-	// Находим первую пустую строку
-	rowIndex, err := sc.findFirstEmptyRow("Рефоводы")
-	if err != nil {
-		return nil, fmt.Errorf("ошибка поиска пустой строки: %w", err)
+	if err := sc.appendReferrer(ref); err != nil {
+		return nil, err
 	}
 
-	// Важно: пустые значения должны быть пустыми строками, а не nil
-	walletValue := ""
-	if ref.Wallet != "" {
-		walletValue = ref.Wallet
-	}
+	refCopy := *ref
+	return &refCopy, nil
+}
 
-	values := [][]interface{}{
-		{
-			fmt.Sprintf("%d", ref.ID), // Колонка A: ID
-			ref.Username,              // Колонка B: Username
-			ref.Code,                  // Колонка C: Код
-			walletValue,               // Колонка D: Кошелёк (может быть пустым)
-			ref.RefCount,              // Колонка E: Количество рефералов
-			ref.PendingPayout,         // Колонка F: Ожидает выплаты
-			ref.PaidOut,               // Колонка G: Выплачено
-		},
-	}
+// MirrorReferrer записывает рефовода из внешнего хранилища: обновляет строку,
+// если рефовод уже есть в листе, иначе добавляет новую с тем же кодом
+func (sc *SheetsClient) MirrorReferrer(ref *Referrer) error {
+	unlock := sc.referrerLocks.lock(strconv.FormatInt(ref.ID, 10))
+	defer unlock()
 
-	log.Printf("📝 Запись в Рефоводы (строка %d): ID=%d, Username=%s, Code=%s, Wallet=%s, RefCount=%d, PendingPayout=%.2f, PaidOut=%.2f",
-		rowIndex, ref.ID, ref.Username, ref.Code, walletValue, ref.RefCount, ref.PendingPayout, ref.PaidOut)
+	sc.cacheMutex.RLock()
+	_, exists := sc.referrersByID[ref.ID]
+	sc.cacheMutex.RUnlock()
 
-	valueRange := &sheets.ValueRange{
-		Values: values,
+	refCopy := *ref
+	if exists {
+		return sc.updateReferrer(&refCopy)
 	}
+	return sc.appendReferrer(&refCopy)
+}
 
-	// Используем Update с конкретной строкой вместо Append
-	updateRange := fmt.Sprintf("Рефоводы!A%d:G%d", rowIndex, rowIndex)
-	updateResp, err := sc.service.Spreadsheets.Values.Update(
-		sc.spreadsheetID,
-		updateRange,
-		valueRange,
-	).ValueInputOption("USER_ENTERED").Do()
+// appendReferrer записывает рефовода в первую пустую строку листа Рефоводы и добавляет его в кэш
+func (sc *SheetsClient) appendReferrer(ref *Referrer) error {
+	unlock := sc.sheetLocks.lock(sc.referrersLayout.name)
+	defer unlock()
 
+	// Находим первую свободную строку
+	rowIndex, err := sc.reserveRow(sc.referrersLayout, colID)
 	if err != nil {
+		return fmt.Errorf("ошибка поиска пустой строки: %w", err)
+	}
+
+	log.Printf("📝 Запись в Рефоводы (строка %d): ID=%d, Username=%s, Code=%s, Wallet=%s, RefCount=%d, PendingPayout=%s, PaidOut=%s",
+		rowIndex, ref.ID, ref.Username, ref.Code, ref.Wallet, ref.RefCount, ref.PendingPayout, ref.PaidOut)
+
+	// Используем запись конкретной строки вместо Append
+	if err := sc.writeRow(sc.referrersLayout, rowIndex, sc.referrerRow(ref)); err != nil {
 		log.Printf("❌ Ошибка записи в Рефоводы: %v", err)
-		return nil, fmt.Errorf("ошибка добавления рефовода: %w", err)
+		return fmt.Errorf("ошибка добавления рефовода: %w", err)
 	}
 
 	log.Printf("✅ Рефовод успешно создан: ID=%d, код=%s, username=%s (строка %d)", ref.ID, ref.Code, ref.Username, rowIndex)
-	if updateResp.UpdatedCells > 0 {
-		log.Printf("   Обновлено ячеек: %d, диапазон: %s", updateResp.UpdatedCells, updateResp.UpdatedRange)
-	}
 
 	// Обновляем кэш
 	sc.cacheMutex.Lock()
 	sc.referrersByID[ref.ID] = ref
+	sc.referrerRows[ref.ID] = rowIndex
 	if ref.Code != "" {
 		normalizedCode := strings.ToUpper(strings.TrimSpace(ref.Code))
 		sc.referrersByCode[normalizedCode] = ref
 	}
 	sc.cacheMutex.Unlock()
 
-	return ref, nil
+	return nil
 }
 
-// UpdateReferrer обновляет данные рефовода
+// UpdateReferrer обновляет данные рефовода целиком. Для изменения отдельных полей
+// используйте ModifyReferrer - он не затирает параллельные изменения других полей.
 func (sc *SheetsClient) UpdateReferrer(ref *Referrer) error {
-	readRange := "Рефоводы!A2:G"
-	resp, err := sc.service.Spreadsheets.Values.Get(sc.spreadsheetID, readRange).Do()
-	if err != nil {
-		return fmt.Errorf("ошибка чтения листа Рефоводы: %w", err)
-	}
-
-	if resp.Values == nil {
-		return fmt.Errorf("рефовод не найден")
-	}
+	unlock := sc.referrerLocks.lock(strconv.FormatInt(ref.ID, 10))
+	defer unlock()
 
-	rowIndex := -1
-	for i, row := range resp.Values {
-		if len(row) < 1 {
-			continue
-		}
-
-		idStr, ok := row[0].(string)
-		if !ok {
-			continue
-		}
+	refCopy := *ref
+	return sc.updateReferrer(&refCopy)
+}
 
-		id, err := strconv.ParseInt(idStr, 10, 64)
-		if err != nil {
-			continue
-		}
+// ModifyReferrer атомарно изменяет рефовода: под блокировкой рефовода берет
+// актуальные данные из кэша, применяет fn и записывает результат.
+// Возвращает копию обновленного рефовода.
+func (sc *SheetsClient) ModifyReferrer(userID int64, fn func(ref *Referrer) error) (*Referrer, error) {
+	unlock := sc.referrerLocks.lock(strconv.FormatInt(userID, 10))
+	defer unlock()
 
-		if id == ref.ID {
-			rowIndex = i + 2 // +2 потому что первая строка - заголовок, и индексация с 1
-			break
-		}
+	sc.cacheMutex.RLock()
+	cached, exists := sc.referrersByID[userID]
+	var ref Referrer
+	if exists {
+		ref = *cached
 	}
+	sc.cacheMutex.RUnlock()
 
-	if rowIndex == -1 {
-		return fmt.Errorf("рефовод не найден")
+	if !exists {
+		return nil, fmt.Errorf("рефовод %d не найден", userID)
 	}
 
-	// Обновляем строку
-	updateRange := fmt.Sprintf("Рефоводы!A%d:G%d", rowIndex, rowIndex)
-
-	// Важно: пустые значения должны быть пустыми строками
-	walletValue := ""
-	if ref.Wallet != "" {
-		walletValue = ref.Wallet
+	if err := fn(&ref); err != nil {
+		return nil, err
 	}
 
-	values := [][]interface{}{
-		{
-			fmt.Sprintf("%d", ref.ID), // Колонка A: ID
-			ref.Username,              // Колонка B: Username
-			ref.Code,                  // Колонка C: Код
-			walletValue,               // Колонка D: Кошелёк
-			ref.RefCount,              // Колонка E: Количество рефералов
-			ref.PendingPayout,         // Колонка F: Ожидает выплаты
-			ref.PaidOut,               // Колонка G: Выплачено
-		},
+	if err := sc.updateReferrer(&ref); err != nil {
+		return nil, err
 	}
 
-	log.Printf("📝 Обновление Рефоводы (строка %d): ID=%d, Username=%s, Code=%s, Wallet=%s, RefCount=%d, PendingPayout=%.2f",
-		rowIndex, ref.ID, ref.Username, ref.Code, walletValue, ref.RefCount, ref.PendingPayout)
+	refCopy := ref
+	return &refCopy, nil
+}
 
-	valueRange := &sheets.ValueRange{
-		Values: values,
+// updateReferrer записывает рефовода; вызывается под блокировкой рефовода.
+// ref сохраняется в кэше, поэтому вызывающий передает свою копию.
+func (sc *SheetsClient) updateReferrer(ref *Referrer) error {
+	rowIndex, err := sc.locateReferrer(ref.ID)
+	if err != nil {
+		return err
 	}
 
-	updateResp, err := sc.service.Spreadsheets.Values.Update(
-		sc.spreadsheetID,
-		updateRange,
-		valueRange,
-	).ValueInputOption("USER_ENTERED").Do()
+	log.Printf("📝 Обновление Рефоводы (строка %d): ID=%d, Username=%s, Code=%s, Wallet=%s, RefCount=%d, PendingPayout=%s",
+		rowIndex, ref.ID, ref.Username, ref.Code, ref.Wallet, ref.RefCount, ref.PendingPayout)
 
-	if err != nil {
+	// Обновляем строку
+	if err := sc.writeRow(sc.referrersLayout, rowIndex, sc.referrerRow(ref)); err != nil {
 		log.Printf("❌ Ошибка обновления Рефоводы: %v", err)
 		return fmt.Errorf("ошибка обновления рефовода: %w", err)
 	}
 
-	log.Printf("✅ Рефовод обновлен: ID=%d, кошелек=%s, рефералов=%d, ожидает=%.2f", ref.ID, ref.Wallet, ref.RefCount, ref.PendingPayout)
-	if updateResp.UpdatedCells > 0 {
-		log.Printf("   Обновлено ячеек: %d, диапазон: %s", updateResp.UpdatedCells, updateResp.UpdatedRange)
-	} else {
-		log.Printf("   ⚠️ Обновлено ячеек: 0")
-	}
+	log.Printf("✅ Рефовод обновлен: ID=%d, кошелек=%s, рефералов=%d, ожидает=%s", ref.ID, ref.Wallet, ref.RefCount, ref.PendingPayout)
 
 	// Обновляем кэш
 	sc.cacheMutex.Lock()
 	sc.referrersByID[ref.ID] = ref
+	sc.referrerRows[ref.ID] = rowIndex
 	if ref.Code != "" {
 		normalizedCode := strings.ToUpper(strings.TrimSpace(ref.Code))
 		sc.referrersByCode[normalizedCode] = ref
@@ -506,27 +776,120 @@ func (sc *SheetsClient) UpdateReferrer(ref *Referrer) error {
 	return nil
 }
 
-// generateUniqueCode генерирует уникальный 6-символьный код
-func (sc *SheetsClient) generateUniqueCode() (string, error) {
+// locateReferrer возвращает номер строки рефовода. Номер берется из кэша и проверяется
+// чтением одной ячейки ID; если строка сдвинулась, колонка ID перечитывается целиком.
+func (sc *SheetsClient) locateReferrer(id int64) (int, error) {
+	layout := sc.referrersLayout
+
+	sc.cacheMutex.RLock()
+	rowIndex := sc.referrerRows[id]
+	sc.cacheMutex.RUnlock()
+
+	if rowIndex > 0 {
+		// Строка еще в очереди записи - в таблице ее пока нет, проверять нечего
+		if sc.writes.isPending(layout.name, rowIndex) {
+			return rowIndex, nil
+		}
+
+		value, err := sc.readCell(layout, colID, rowIndex)
+		if err != nil {
+			return 0, err
+		}
+		if cellID, err := parseIDValue(value); err == nil && cellID == id {
+			return rowIndex, nil
+		}
+		log.Printf("⚠️ Рефовод %d больше не в строке %d листа %s, ищем его заново", id, rowIndex, layout.name)
+	}
+
+	rowIndex, err := sc.findReferrerRow(id)
+	if err != nil {
+		return 0, err
+	}
+
+	sc.cacheMutex.Lock()
+	sc.referrerRows[id] = rowIndex
+	sc.cacheMutex.Unlock()
+
+	return rowIndex, nil
+}
+
+// findReferrerRow ищет строку рефовода по колонке ID, а затем в очереди записи
+func (sc *SheetsClient) findReferrerRow(id int64) (int, error) {
+	layout := sc.referrersLayout
+	resp, err := execute(sc, "values.get", sc.service.Spreadsheets.Values.Get(sc.spreadsheetID, layout.columnRange(colID)))
+	if err != nil {
+		return 0, fmt.Errorf("ошибка чтения листа Рефоводы: %w", err)
+	}
+
+	for i, row := range resp.Values {
+		if len(row) < 1 {
+			continue
+		}
+
+		cellID, err := parseIDValue(row[0])
+		if err != nil {
+			continue
+		}
+
+		if cellID == id {
+			return i + 2, nil // +2 потому что первая строка - заголовок, и индексация с 1
+		}
+	}
+
+	// Рефовод мог быть создан недавно, и его строка еще в очереди записи
+	idIndex := layout.index(colID)
+	rowIndex := sc.writes.findPendingRow(layout.name, func(row []interface{}) bool {
+		return idIndex < len(row) && getStringValue(row[idIndex]) == fmt.Sprintf("%d", id)
+	})
+	if rowIndex <= 0 {
+		return 0, fmt.Errorf("рефовод не найден")
+	}
+	return rowIndex, nil
+}
+
+// referrerRow собирает строку листа Рефоводы по расположению колонок
+func (sc *SheetsClient) referrerRow(ref *Referrer) []interface{} {
+	return sc.referrersLayout.row(map[string]interface{}{
+		colID:       fmt.Sprintf("%d", ref.ID),
+		colUsername: ref.Username,
+		colCode:     ref.Code,
+		colWallet:   ref.Wallet, // пустой кошелек пишем пустой строкой, а не nil
+		colRefCount: ref.RefCount,
+		colPending:  ref.PendingPayout.Float64(),
+		colPaid:     ref.PaidOut.Float64(), // как и "Ожидает выплаты" - проекция Журнала
+		// "Ставку" задают операторы - бот ее только читает.
+	})
+}
+
+// NewReferralCode генерирует случайный 6-символьный код (A-Z0-9) без проверки уникальности
+func NewReferralCode() (string, error) {
 	const charset = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	const codeLength = 6
 
-	maxAttempts := 100
 	charsetLen := big.NewInt(int64(len(charset)))
+	code := make([]byte, codeLength)
+	for j := range code {
+		// Используем crypto/rand для криптографически стойкой генерации
+		n, err := rand.Int(rand.Reader, charsetLen)
+		if err != nil {
+			return "", fmt.Errorf("ошибка генерации случайного числа: %w", err)
+		}
+		code[j] = charset[n.Int64()]
+	}
+
+	return string(code), nil
+}
+
+// generateUniqueCode генерирует уникальный 6-символьный код
+func (sc *SheetsClient) generateUniqueCode() (string, error) {
+	maxAttempts := 100
 
 	for i := 0; i < maxAttempts; i++ {
-		code := make([]byte, codeLength)
-		for j := range code {
-			// Используем crypto/rand для криптографически стойкой генерации
-			n, err := rand.Int(rand.Reader, charsetLen)
-			if err != nil {
-				return "", fmt.Errorf("ошибка генерации случайного числа: %w", err)
-			}
-			code[j] = charset[n.Int64()]
+		codeStr, err := NewReferralCode()
+		if err != nil {
+			return "", err
 		}
 
-		codeStr := string(code)
-
 		// Проверяем уникальность
 		exists, err := sc.codeExists(codeStr)
 		if err != nil {
@@ -546,8 +909,16 @@ func (sc *SheetsClient) generateUniqueCode() (string, error) {
 
 // codeExists проверяет существование кода
 func (sc *SheetsClient) codeExists(code string) (bool, error) {
-	readRange := "Рефоводы!C2:C"
-	resp, err := sc.service.Spreadsheets.Values.Get(sc.spreadsheetID, readRange).Do()
+	// Код недавно созданного рефовода может быть еще только в кэше и очереди записи
+	sc.cacheMutex.RLock()
+	_, cached := sc.referrersByCode[code]
+	sc.cacheMutex.RUnlock()
+	if cached {
+		return true, nil
+	}
+
+	readRange := sc.referrersLayout.columnRange(colCode)
+	resp, err := execute(sc, "values.get", sc.service.Spreadsheets.Values.Get(sc.spreadsheetID, readRange))
 	if err != nil {
 		return false, err
 	}
@@ -584,46 +955,46 @@ func (sc *SheetsClient) GetInvitedByUserID(userID int64) (*Invited, error) {
 
 // CreateInvited создает запись в Приглашенные
 func (sc *SheetsClient) CreateInvited(userID int64, refCode string) error {
-	// Находим первую пустую строку
-	rowIndex, err := sc.findFirstEmptyRow("Приглашенные")
-	if err != nil {
-		return fmt.Errorf("ошибка поиска пустой строки: %w", err)
-	}
+	unlock := sc.sheetLocks.lock(sc.invitedLayout.name)
+	defer unlock()
 
-	values := [][]interface{}{
-		{
-			fmt.Sprintf("%d", userID), // Колонка A: ID пользователя
-			refCode,                   // Колонка B: Код пригласившего
-		},
+	// Повторная проверка под блокировкой: два одновременных перехода по ссылке
+	// не должны создать две записи и дважды увеличить счетчик
+	sc.cacheMutex.RLock()
+	_, exists := sc.invitedByUserID[userID]
+	sc.cacheMutex.RUnlock()
+	if exists {
+		return fmt.Errorf("пользователь %d: %w", userID, ErrAlreadyInvited)
 	}
 
-	log.Printf("📝 Запись в Приглашенные (строка %d): UserID=%d, код=%s", rowIndex, userID, refCode)
-
-	valueRange := &sheets.ValueRange{
-		Values: values,
+	// Находим первую свободную строку
+	rowIndex, err := sc.reserveRow(sc.invitedLayout, colUserID)
+	if err != nil {
+		return fmt.Errorf("ошибка поиска пустой строки: %w", err)
 	}
 
-	// Используем Update с конкретной строкой вместо Append
-	updateRange := fmt.Sprintf("Приглашенные!A%d:B%d", rowIndex, rowIndex)
-	updateResp, err := sc.service.Spreadsheets.Values.Update(
-		sc.spreadsheetID,
-		updateRange,
-		valueRange,
-	).ValueInputOption("USER_ENTERED").Do()
+	invitedAt := time.Now().Truncate(time.Second)
+	row := sc.invitedLayout.row(map[string]interface{}{
+		colUserID:  fmt.Sprintf("%d", userID),
+		colRefCode: refCode,
+		colInvited: invitedAt.Format(sheetTimeFormat),
+	})
 
-	if err != nil {
+	log.Printf("📝 Запись в Приглашенные (строка %d): UserID=%d, код=%s, дата %s",
+		rowIndex, userID, refCode, invitedAt.Format(sheetTimeFormat))
+
+	// Используем запись конкретной строки вместо Append
+	if err := sc.writeRow(sc.invitedLayout, rowIndex, row); err != nil {
 		log.Printf("❌ Ошибка записи в Приглашенные: %v", err)
 		return fmt.Errorf("ошибка добавления в Приглашенные: %w", err)
 	}
 
 	log.Printf("✅ Добавлен в Приглашенные: UserID=%d, код=%s (строка %d)", userID, refCode, rowIndex)
-	if updateResp.UpdatedCells > 0 {
-		log.Printf("   Обновлено ячеек: %d, диапазон: %s", updateResp.UpdatedCells, updateResp.UpdatedRange)
-	}
 
 	// Обновляем кэш
 	sc.cacheMutex.Lock()
-	sc.invitedByUserID[userID] = &Invited{UserID: userID, RefCode: refCode}
+	sc.invitedByUserID[userID] = &Invited{UserID: userID, RefCode: refCode, InvitedAt: invitedAt}
+	sc.invitedRows[userID] = rowIndex
 	sc.cacheMutex.Unlock()
 
 	return nil
@@ -647,7 +1018,8 @@ func (sc *SheetsClient) GetReferrerByCode(code string) (*Referrer, error) {
 	return &refCopy, nil
 }
 
-// IncrementRefCount увеличивает счетчик рефералов
+// IncrementRefCount увеличивает счетчик рефералов. Чтение и запись счетчика
+// выполняются под блокировкой рефовода, поэтому параллельные приглашения не теряются.
 func (sc *SheetsClient) IncrementRefCount(refCode string) error {
 	ref, err := sc.GetReferrerByCode(refCode)
 	if err != nil {
@@ -658,12 +1030,19 @@ func (sc *SheetsClient) IncrementRefCount(refCode string) error {
 		return fmt.Errorf("рефовод с кодом %s не найден", refCode)
 	}
 
-	ref.RefCount++
-	log.Printf("Увеличение счетчика рефералов для кода %s: теперь %d", refCode, ref.RefCount)
-	return sc.UpdateReferrer(ref)
+	updated, err := sc.ModifyReferrer(ref.ID, func(r *Referrer) error {
+		r.RefCount++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Увеличение счетчика рефералов для кода %s: теперь %d", refCode, updated.RefCount)
+	return nil
 }
 
-// GetExistingDealIDs получает список всех ID сделок из кэша
+// GetExistingDealIDs получает из кэша ID сделок с начислением первого уровня
 func (sc *SheetsClient) GetExistingDealIDs() (map[string]bool, error) {
 	sc.cacheMutex.RLock()
 	defer sc.cacheMutex.RUnlock()
@@ -677,6 +1056,21 @@ func (sc *SheetsClient) GetExistingDealIDs() (map[string]bool, error) {
 	return dealIDs, nil
 }
 
+// HasReferral проверяет по кэшу, есть ли в листе Рефералы запись о сделке на указанном уровне
+func (sc *SheetsClient) HasReferral(dealID string, level int) (bool, error) {
+	sc.cacheMutex.RLock()
+	defer sc.cacheMutex.RUnlock()
+	return sc.referralKeys[referralKey(dealID, level)], nil
+}
+
+// referralKey - ключ записи в Рефералы: по одной сделке бывает по записи на каждый уровень
+func referralKey(dealID string, level int) string {
+	if level <= 1 {
+		return dealID
+	}
+	return fmt.Sprintf("%s:%d", dealID, level)
+}
+
 // GetNewWithdrawals получает новые выводы (которых еще нет в Рефералы)
 func (sc *SheetsClient) GetNewWithdrawals() ([]Withdrawal, error) {
 	existingDealIDs, err := sc.GetExistingDealIDs()
@@ -684,10 +1078,33 @@ func (sc *SheetsClient) GetNewWithdrawals() ([]Withdrawal, error) {
 		return nil, err
 	}
 
-	readRange := "Выводы!A2:D"
-	// Используем UNFORMATTED_VALUE для получения вычисленных значений из IMPORTRANGE
-	resp, err := sc.service.Spreadsheets.Values.Get(sc.spreadsheetID, readRange).
-		ValueRenderOption("UNFORMATTED_VALUE").Do()
+	withdrawals, err := sc.GetWithdrawals()
+	if err != nil {
+		return nil, err
+	}
+
+	newWithdrawals := []Withdrawal{}
+	for _, w := range withdrawals {
+		// Пропускаем уже обработанные сделки, сторно и некорректные строки
+		if existingDealIDs[w.DealID] || !w.Processable() {
+			continue
+		}
+		newWithdrawals = append(newWithdrawals, w)
+	}
+
+	return newWithdrawals, nil
+}
+
+// GetWithdrawals читает все строки листа Выводы с ID сделки, не фильтруя уже обработанные
+// сделки. Строки с некорректными ID пользователя или прибылью возвращаются с причиной в Invalid.
+func (sc *SheetsClient) GetWithdrawals() ([]Withdrawal, error) {
+	layout := sc.withdrawalsLayout
+	readRange := layout.dataRange()
+	// Используем UNFORMATTED_VALUE для получения вычисленных значений из IMPORTRANGE,
+	// а даты сделок читаем строками
+	resp, err := execute(sc, "values.get", sc.service.Spreadsheets.Values.Get(sc.withdrawalsSpreadsheetID, readRange).
+		ValueRenderOption("UNFORMATTED_VALUE").
+		DateTimeRenderOption("FORMATTED_STRING"))
 	if err != nil {
 		return nil, fmt.Errorf("ошибка чтения листа Выводы: %w", err)
 	}
@@ -698,247 +1115,225 @@ func (sc *SheetsClient) GetNewWithdrawals() ([]Withdrawal, error) {
 
 	var withdrawals []Withdrawal
 	for _, row := range resp.Values {
-		// Проверяем минимальное количество колонок: A (DealID), B (UserID), D (Profit)
-		// Колонка C может отсутствовать из-за IMPORTRANGE, поэтому проверяем len >= 4
-		// но Profit может быть в индексе 3 (если C есть) или 2 (если C отсутствует)
-		if len(row) < 2 {
-			continue
-		}
-
-		dealID := getStringValue(row[0])
+		dealID := getStringValue(layout.get(row, colDealID))
 		if dealID == "" {
 			continue
 		}
 
-		// Пропускаем уже обработанные сделки
-		if existingDealIDs[dealID] {
-			continue
-		}
-
-		// Пробуем получить UserID разными способами
-		var userID int64
-		if len(row) < 2 {
-			log.Printf("Пропуск сделки %s: недостаточно колонок для UserID", dealID)
-			continue
+		// Некорректная строка остается в результате с причиной: сделка в листе есть,
+		// и сверка начислений не должна считать ее удаленной
+		withdrawal := Withdrawal{DealID: dealID}
+		if userID, err := parseIDValue(layout.get(row, colUserID)); err != nil {
+			withdrawal.Invalid = fmt.Sprintf("ID пользователя: %v", err)
+		} else {
+			withdrawal.UserID = userID
 		}
 
-		switch v := row[1].(type) {
-		case string:
-			// Убираем неразрывные пробелы и другие пробельные символы
-			cleaned := strings.ReplaceAll(v, "\u00a0", "") // неразрывный пробел
-			cleaned = strings.ReplaceAll(cleaned, " ", "")
-			cleaned = strings.TrimSpace(cleaned)
-
-			// Пропускаем если это текст (не число)
-			if cleaned == "" || strings.HasPrefix(strings.ToLower(cleaned), "без") {
-				log.Printf("Пропуск сделки %s: UserID содержит текст или пустой", dealID)
-				continue
-			}
-
-			parsed, err := strconv.ParseInt(cleaned, 10, 64)
-			if err != nil {
-				log.Printf("Ошибка парсинга UserID для сделки %s (значение: %q): %v", dealID, v, err)
-				continue
-			}
-			userID = parsed
-		case int64:
-			userID = v
-		case int:
-			userID = int64(v)
-		case float64:
-			userID = int64(v)
-		default:
-			userIDStr := getStringValue(row[1])
-			// Убираем неразрывные пробелы
-			userIDStr = strings.ReplaceAll(userIDStr, "\u00a0", "")
-			userIDStr = strings.ReplaceAll(userIDStr, " ", "")
-			userIDStr = strings.TrimSpace(userIDStr)
-
-			if userIDStr == "" || strings.HasPrefix(strings.ToLower(userIDStr), "без") {
-				log.Printf("Пропуск сделки %s: UserID содержит текст или пустой", dealID)
-				continue
-			}
-
-			parsed, err := strconv.ParseInt(userIDStr, 10, 64)
-			if err != nil {
-				log.Printf("Ошибка парсинга UserID для сделки %s (значение: %q): %v", dealID, userIDStr, err)
-				continue
-			}
-			userID = parsed
+		rawProfit := layout.get(row, colProfit)
+		if profit, ok := parseAmountValue(rawProfit); ok {
+			withdrawal.Profit = profit
+		} else if withdrawal.Invalid == "" {
+			withdrawal.Invalid = fmt.Sprintf("некорректная прибыль: %q", getStringValue(rawProfit))
 		}
 
-		// Profit находится в колонке D (индекс 3), но если колонка C отсутствует из-за IMPORTRANGE,
-		// то Profit может быть в индексе 2. Проверяем оба варианта.
-		var profit float64
-		var profitIndex int
-		if len(row) >= 4 {
-			// Стандартный случай: A, B, C, D
-			profitIndex = 3
-			profit = getFloatValue(row[3])
-			log.Printf("Сделка %s: Profit из колонки D (индекс %d), raw значение: %v, parsed: %.2f",
-				dealID, profitIndex, row[3], profit)
-		} else if len(row) >= 3 {
-			// Если колонка C отсутствует: A, B, D
-			profitIndex = 2
-			profit = getFloatValue(row[2])
-			log.Printf("Сделка %s: Profit из колонки D (индекс %d, колонка C отсутствует), raw значение: %v, parsed: %.2f",
-				dealID, profitIndex, row[2], profit)
-		} else {
-			log.Printf("Пропуск сделки %s: недостаточно колонок для Profit (len=%d, row=%v)", dealID, len(row), row)
-			continue
+		if withdrawal.Invalid != "" {
+			log.Printf("⚠️ Строка сделки %s в листе Выводы некорректна (%s), сделка не обрабатывается", dealID, withdrawal.Invalid)
+		} else if withdrawal.Profit <= 0 {
+			log.Printf("📝 Прибыль по сделке %s: %s USDT (сторно), начисление не выполняется", dealID, withdrawal.Profit)
 		}
-
-		if profit <= 0 {
-			log.Printf("Пропуск сделки %s: Profit <= 0 (значение: %f, raw: %v)", dealID, profit, row[profitIndex])
-			continue
+		if rawDate := getStringValue(layout.get(row, colDate)); rawDate != "" {
+			if t, ok := parseSheetTime(rawDate); ok {
+				withdrawal.Date = t
+			} else {
+				log.Printf("⚠️ Некорректная дата сделки %s: %q, дата не учитывается", dealID, rawDate)
+			}
 		}
 
-		withdrawals = append(withdrawals, Withdrawal{
-			DealID: dealID,
-			UserID: userID,
-			Profit: profit,
-		})
+		withdrawals = append(withdrawals, withdrawal)
 	}
 
 	return withdrawals, nil
 }
 
-// CreateReferral создает запись в листе Рефералы
-func (sc *SheetsClient) CreateReferral(ref *Referral) error {
-	// Находим первую пустую строку
-	rowIndex, err := sc.findFirstEmptyRow("Рефералы")
+// GetReferrals читает все записи листа Рефералы; некорректные строки пропускаются
+func (sc *SheetsClient) GetReferrals() ([]Referral, error) {
+	referrals, rejected, err := sc.ReadReferrals()
 	if err != nil {
-		return fmt.Errorf("ошибка поиска пустой строки: %w", err)
+		return nil, err
 	}
-
-	values := [][]interface{}{
-		{
-			fmt.Sprintf("%d", ref.RefID), // Колонка A: ID реферала
-			ref.RefCode,                  // Колонка B: Код пригласившего
-			ref.Profit,                   // Колонка C: Чистая прибыль реферала
-			ref.DealID,                   // Колонка D: ID сделки
-			ref.Bonus,                    // Колонка E: Бонус рефоводу
-			ref.Date,                     // Колонка F: Дата начисления
-		},
+	for _, r := range rejected {
+		log.Printf("⚠️ Пропуск строки %d листа %s: %s", r.Row, r.Sheet, r.Reason)
 	}
+	return referrals, nil
+}
 
-	log.Printf("📝 Запись в Рефералы (строка %d): RefID=%d, RefCode=%s, Profit=%.2f, DealID=%s, Bonus=%.2f, Date=%s",
-		rowIndex, ref.RefID, ref.RefCode, ref.Profit, ref.DealID, ref.Bonus, ref.Date)
+// CreateReferral создает запись в листе Рефералы
+func (sc *SheetsClient) CreateReferral(ref *Referral) error {
+	unlock := sc.sheetLocks.lock(sc.referralsLayout.name)
+	defer unlock()
 
-	valueRange := &sheets.ValueRange{
-		Values: values,
+	// Находим первую свободную строку (счетчик ведется по колонке ID сделки)
+	rowIndex, err := sc.reserveRow(sc.referralsLayout, colDealID)
+	if err != nil {
+		return fmt.Errorf("ошибка поиска пустой строки: %w", err)
 	}
 
-	// Используем Update с конкретной строкой вместо Append
-	updateRange := fmt.Sprintf("Рефералы!A%d:F%d", rowIndex, rowIndex)
-	updateResp, err := sc.service.Spreadsheets.Values.Update(
-		sc.spreadsheetID,
-		updateRange,
-		valueRange,
-	).ValueInputOption("USER_ENTERED").Do()
+	row := sc.referralsLayout.row(map[string]interface{}{
+		colRefID:   fmt.Sprintf("%d", ref.RefID),
+		colRefCode: ref.RefCode,
+		colProfit:  ref.Profit.Float64(),
+		colDealID:  ref.DealID,
+		colBonus:   ref.Bonus.Float64(),
+		colRate:    percentCell(ref.Rate),
+		colLevel:   levelOf(ref.Level),
+		colDate:    ref.Date,
+	})
 
-	if err != nil {
+	log.Printf("📝 Запись в Рефералы (строка %d): RefID=%d, RefCode=%s, Profit=%s, DealID=%s, Bonus=%s, Date=%s, уровень %d",
+		rowIndex, ref.RefID, ref.RefCode, ref.Profit, ref.DealID, ref.Bonus, ref.Date, levelOf(ref.Level))
+
+	// Используем запись конкретной строки вместо Append
+	if err := sc.writeRow(sc.referralsLayout, rowIndex, row); err != nil {
 		log.Printf("❌ Ошибка записи в Рефералы: %v", err)
 		return fmt.Errorf("ошибка добавления в Рефералы: %w", err)
 	}
 
-	log.Printf("✅ Добавлена запись в Рефералы: DealID=%s, RefID=%d, код=%s, бонус=%.2f (строка %d)",
+	log.Printf("✅ Добавлена запись в Рефералы: DealID=%s, RefID=%d, код=%s, бонус=%s (строка %d)",
 		ref.DealID, ref.RefID, ref.RefCode, ref.Bonus, rowIndex)
-	if updateResp.UpdatedCells > 0 {
-		log.Printf("   Обновлено ячеек: %d, диапазон: %s", updateResp.UpdatedCells, updateResp.UpdatedRange)
-	}
 
 	// Обновляем кэш DealIDs
 	sc.cacheMutex.Lock()
-	sc.existingDealIDs[ref.DealID] = true
+	sc.referralKeys[referralKey(ref.DealID, ref.Level)] = true
+	if levelOf(ref.Level) == 1 {
+		sc.existingDealIDs[ref.DealID] = true
+		sc.referredProfit[normalizeCode(ref.RefCode)] += ref.Profit
+	}
 	sc.cacheMutex.Unlock()
 
 	return nil
 }
 
-// UpdatePendingPayouts обновляет столбец "Ожидает выплаты" (F) для всех рефоводов
-// Формула: Ожидает выплаты = текущее значение - Выплачено (где Выплачено - это функция СУММ)
-// Выполняется каждый час для синхронизации с выплатами
+// ReferredProfit возвращает суммарную прибыль прямых рефералов рефовода по листу Рефералы
+func (sc *SheetsClient) ReferredProfit(refCode string) (money.Amount, error) {
+	sc.cacheMutex.RLock()
+	defer sc.cacheMutex.RUnlock()
+	return sc.referredProfit[normalizeCode(refCode)], nil
+}
+
+// UpdatePendingPayouts пересчитывает столбцы "Ожидает выплаты" и "Выплачено" по Журналу.
+// Сначала в Журнал переносятся начисления из Рефералы и выплаты из колонки Выплачено, которых
+// в нем еще нет, затем Ожидает выплаты = начислено - выплачено, а Выплачено = выплаты по
+// записям Журнала, поэтому повторные запуски ничего не меняют. Выполняется каждый час для учета новых выплат.
 func (sc *SheetsClient) UpdatePendingPayouts() error {
 	log.Printf("Начало обновления столбца 'Ожидает выплаты'...")
 
-	readRange := "Рефоводы!A2:G"
-	// Используем UNFORMATTED_VALUE для получения вычисленных значений из функций (например, СУММ)
-	resp, err := sc.service.Spreadsheets.Values.Get(sc.spreadsheetID, readRange).
-		ValueRenderOption("UNFORMATTED_VALUE").Do()
-	if err != nil {
-		return fmt.Errorf("ошибка чтения листа Рефоводы: %w", err)
+	// Отложенные изменения должны попасть в таблицу до чтения текущих значений
+	if err := sc.Flush(); err != nil {
+		return fmt.Errorf("ошибка отправки очереди записи: %w", err)
 	}
 
-	if len(resp.Values) == 0 {
+	referrers, err := sc.readReferrersSheet()
+	if err != nil {
+		return err
+	}
+	if len(referrers) == 0 {
 		log.Printf("Нет данных для обновления")
 		return nil
 	}
 
-	var updates []*sheets.ValueRange
-	for i, row := range resp.Values {
-		if len(row) < 1 {
-			continue
-		}
+	referrals, _, err := sc.ReadReferrals()
+	if err != nil {
+		return err
+	}
 
-		// Пропускаем строки без ID
-		idStr := getStringValue(row[0])
-		if idStr == "" {
-			continue
+	backfill := sc.ledgerBackfill(referrers, referrals)
+	for _, entry := range backfill {
+		if err := sc.AppendLedgerEntry(entry); err != nil {
+			return fmt.Errorf("ошибка переноса в Журнал: %w", err)
 		}
+	}
+	if len(backfill) > 0 {
+		log.Printf("В Журнал перенесено записей: %d", len(backfill))
+	}
 
-		// Читаем текущее значение "Ожидает выплаты" (колонка F, индекс 5)
-		var currentPending float64
-		if len(row) > 5 {
-			currentPending = getFloatValue(row[5])
+	layout := sc.referrersLayout
+	balances := sc.projectBalances(nil)
+
+	var updates []*sheets.ValueRange
+	for _, ref := range referrers {
+		balance := balances[ref.ID]
+		newPending := balance.Pending()
+
+		if balance.Paid != ref.PaidOut {
+			updates = append(updates, &sheets.ValueRange{
+				Range:  layout.cellRange(colPaid, ref.Row),
+				Values: [][]interface{}{{balance.Paid.Float64()}},
+			})
+			log.Printf("Обновление строки %d (ID: %d): Выплачено %s -> %s по Журналу", ref.Row, ref.ID, ref.PaidOut, balance.Paid)
 		}
 
-		// Читаем "Выплачено" (колонка G, индекс 6) - это вычисляемое значение из функции СУММ
-		var paidOut float64
-		if len(row) > 6 {
-			paidOut = getFloatValue(row[6])
+		if newPending == ref.PendingPayout {
+			continue
 		}
 
-		// Вычисляем новое значение: Ожидает выплаты - Выплачено
-		newPending := currentPending - paidOut
+		updates = append(updates, &sheets.ValueRange{
+			Range:  layout.cellRange(colPending, ref.Row),
+			Values: [][]interface{}{{newPending.Float64()}},
+		})
 
-		// Если значение изменилось, обновляем
-		if newPending != currentPending {
-			rowIndex := i + 2 // +2 потому что начинаем с строки 2 и индексация с 0
-			updateRange := fmt.Sprintf("Рефоводы!F%d", rowIndex)
+		log.Printf("Обновление строки %d (ID: %d): Ожидает выплаты %s -> %s (начислено: %s, выплачено: %s)",
+			ref.Row, ref.ID, ref.PendingPayout, newPending, balance.Accrued, balance.Paid)
+		if newPending < 0 {
+			log.Printf("⚠️ Выплачено больше начисленного у рефовода %d: %s", ref.ID, newPending)
+		}
+	}
 
-			updates = append(updates, &sheets.ValueRange{
-				Range:  updateRange,
-				Values: [][]interface{}{{newPending}},
-			})
+	if len(updates) > 0 {
+		// Выполняем batch update
+		body := &sheets.BatchUpdateValuesRequest{
+			ValueInputOption: "USER_ENTERED",
+			Data:             updates,
+		}
 
-			log.Printf("Обновление строки %d (ID: %s): Ожидает выплаты %.2f -> %.2f (Выплачено: %.2f)",
-				rowIndex, idStr, currentPending, newPending, paidOut)
+		updateResp, err := executeWrite(sc, "values.batchUpdate", sc.service.Spreadsheets.Values.BatchUpdate(sc.spreadsheetID, body))
+		if err != nil {
+			return fmt.Errorf("ошибка обновления столбцов 'Ожидает выплаты' и 'Выплачено': %w", err)
 		}
-	}
 
-	if len(updates) == 0 {
+		log.Printf("Обновлено строк: %d", len(updates))
+		if updateResp.TotalUpdatedCells > 0 {
+			log.Printf("Обновлено ячеек: %d", updateResp.TotalUpdatedCells)
+		}
+	} else {
 		log.Printf("Нет изменений для обновления")
-		return nil
 	}
 
-	// Выполняем batch update
-	body := &sheets.BatchUpdateValuesRequest{
-		ValueInputOption: "USER_ENTERED",
-		Data:             updates,
+	// Обновляем кэш, чтобы следующие записи строк не вернули старые значения
+	sc.cacheMutex.Lock()
+	for _, r := range referrers {
+		if ref, ok := sc.referrersByID[r.ID]; ok {
+			ref.PendingPayout = balances[r.ID].Pending()
+			ref.PaidOut = balances[r.ID].Paid
+		}
 	}
+	sc.cacheMutex.Unlock()
 
-	updateResp, err := sc.service.Spreadsheets.Values.BatchUpdate(sc.spreadsheetID, body).Do()
-	if err != nil {
-		return fmt.Errorf("ошибка обновления столбца 'Ожидает выплаты': %w", err)
-	}
+	return nil
+}
 
-	log.Printf("Обновлено строк: %d", len(updates))
-	if updateResp.TotalUpdatedCells > 0 {
-		log.Printf("Обновлено ячеек: %d", updateResp.TotalUpdatedCells)
-	}
+// Формат дат, которые бот пишет в Журнал и Приглашенные
+const sheetTimeFormat = "02.01.2006 15:04:05"
 
-	return nil
+// parseSheetTime разбирает дату из ячейки: с секундами (Журнал, Приглашенные)
+// или без них (Рефералы)
+func parseSheetTime(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{sheetTimeFormat, "02.01.2006 15:04", "02.01.2006"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
 }
 
 // Helper functions
@@ -985,40 +1380,114 @@ func getIntValue(val interface{}) int {
 	}
 }
 
-func getFloatValue(val interface{}) float64 {
+// getPercentValue читает ставку в процентах буквально: 15, "15", "15%", 0.5 и "0.5" - это 0.5%.
+// Ячейку в процентном формате нужно читать с FORMATTED_VALUE (readFormattedColumn):
+// без форматирования она приходит долей (0.15 вместо 15%), и доля здесь не угадывается.
+func getPercentValue(val interface{}) money.Percent {
+	switch v := val.(type) {
+	case nil:
+		return 0
+	case float64:
+		return money.Percent(money.FromFloat(v))
+	}
+
+	str := strings.TrimSpace(getStringValue(val))
+	if str == "" {
+		return 0
+	}
+	rate, err := money.ParsePercent(str)
+	if err != nil {
+		return 0
+	}
+	return rate
+}
+
+// readFormattedColumn заменяет в строках, прочитанных с UNFORMATTED_VALUE, значения колонки
+// на отображаемые в таблице (FORMATTED_VALUE). Нужна для колонки "Ставка": ячейка в
+// процентном формате тогда приходит строкой "0,5%", а не долей 0.005. Стоит одного запроса.
+func (sc *SheetsClient) readFormattedColumn(layout *sheetLayout, key string, rows [][]interface{}) error {
+	col := layout.index(key)
+	if col < 0 || len(rows) == 0 {
+		return nil
+	}
+
+	resp, err := execute(sc, "values.get", sc.service.Spreadsheets.Values.Get(sc.spreadsheetID, layout.columnRange(key)).
+		ValueRenderOption("FORMATTED_VALUE"))
+	if err != nil {
+		return fmt.Errorf("ошибка чтения колонки листа %s: %w", layout.name, err)
+	}
+
+	for i, row := range rows {
+		var value interface{}
+		if i < len(resp.Values) && len(resp.Values[i]) > 0 {
+			value = resp.Values[i][0]
+		}
+		if col >= len(row) {
+			if value == nil || value == "" {
+				continue
+			}
+			row = append(row, make([]interface{}, col+1-len(row))...)
+		}
+		row[col] = value
+		rows[i] = row
+	}
+	return nil
+}
+
+// percentCell - значение ставки для записи: "15%" с USER_ENTERED становится числом в процентном формате
+func percentCell(rate money.Percent) interface{} {
+	if rate == 0 {
+		return nil
+	}
+	return rate.String() + "%"
+}
+
+// levelOf возвращает уровень начисления; в записях без уровня это первый уровень
+func levelOf(level int) int {
+	if level < 1 {
+		return 1
+	}
+	return level
+}
+
+// getLevelValue читает уровень из ячейки; пустая ячейка - первый уровень
+func getLevelValue(val interface{}) int {
+	return levelOf(getIntValue(val))
+}
+
+// getAmountValue читает сумму из ячейки. Числа из Sheets API приходят как float64
+// и округляются до микро-USDT, строки разбираются без потери точности.
+func getAmountValue(val interface{}) money.Amount {
+	amount, _ := parseAmountValue(val)
+	return amount
+}
+
+// parseAmountValue читает сумму из ячейки; ok = false для пустой или нечисловой ячейки
+func parseAmountValue(val interface{}) (amount money.Amount, ok bool) {
 	if val == nil {
-		return 0.0
+		return 0, false
 	}
 
 	// Пробуем разные типы
 	switch v := val.(type) {
 	case float64:
-		return v
+		return money.FromFloat(v), true
 	case float32:
-		return float64(v)
+		return money.FromFloat(float64(v)), true
 	case int:
-		return float64(v)
+		return money.Amount(v) * money.USDT, true
 	case int64:
-		return float64(v)
-	case string:
-		if v == "" {
-			return 0.0
-		}
-		result, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
-		if err != nil {
-			return 0.0
-		}
-		return result
+		return money.Amount(v) * money.USDT, true
 	default:
 		// Пробуем через строку
 		str := getStringValue(val)
 		if str == "" {
-			return 0.0
+			return 0, false
 		}
-		result, err := strconv.ParseFloat(str, 64)
+		result, err := money.Parse(str)
 		if err != nil {
-			return 0.0
+			return 0, false
 		}
-		return result
+		return result, true
 	}
 }
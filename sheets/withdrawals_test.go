@@ -0,0 +1,46 @@
+package sheets
+
+import (
+	"testing"
+
+	"ss_ref_bot/money"
+)
+
+func TestInvalidWithdrawalRowsAreKept(t *testing.T) {
+	_, sc := newFixture(t, Options{}, func(f *fakeSpreadsheet) {
+		f.addRow(withdrawalsSchema.Name, "D-1", "1001", 10)
+		f.addRow(withdrawalsSchema.Name, "D-2", "100l", 10)
+		f.addRow(withdrawalsSchema.Name, "D-3", "1003", "")
+		f.addRow(withdrawalsSchema.Name, "D-4", "1004", 0)
+		f.addRow(withdrawalsSchema.Name, "", "1005", 10)
+	})
+
+	// Строки с ID сделки остаются в листе для сверки, даже если их нельзя обработать
+	withdrawals, err := sc.GetWithdrawals()
+	if err != nil {
+		t.Fatalf("GetWithdrawals: %v", err)
+	}
+	want := []struct {
+		dealID  string
+		invalid bool
+		profit  money.Amount
+	}{{"D-1", false, 10 * money.USDT}, {"D-2", true, 10 * money.USDT}, {"D-3", true, 0}, {"D-4", false, 0}}
+	if len(withdrawals) != len(want) {
+		t.Fatalf("выводов %d, ожидалось %d: %+v", len(withdrawals), len(want), withdrawals)
+	}
+	for i, w := range want {
+		got := withdrawals[i]
+		if got.DealID != w.dealID || (got.Invalid != "") != w.invalid || got.Profit != w.profit {
+			t.Errorf("строка %d: %+v, ожидалось %+v", i+2, got, w)
+		}
+	}
+
+	// Обрабатываются только корректные сделки с прибылью
+	fresh, err := sc.GetNewWithdrawals()
+	if err != nil {
+		t.Fatalf("GetNewWithdrawals: %v", err)
+	}
+	if len(fresh) != 1 || fresh[0].DealID != "D-1" || fresh[0].UserID != 1001 {
+		t.Errorf("новые выводы: %+v, ожидалась только D-1", fresh)
+	}
+}
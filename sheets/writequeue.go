@@ -0,0 +1,371 @@
+package sheets
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+const (
+	defaultFlushSize = 50
+	// Ограничение размера одного BatchUpdate при разборе накопившейся очереди
+	maxBatchSize = 500
+)
+
+// pendingWrite - отложенная запись диапазона в таблицу
+type pendingWrite struct {
+	Sheet  string          `json:"sheet"`
+	Row    int             `json:"row"` // номер строки, если запись целой строки (иначе 0)
+	Range  string          `json:"range"`
+	Values [][]interface{} `json:"values"`
+}
+
+// writeQueue накапливает изменения и отправляет их одним BatchUpdate по таймеру
+// или при достижении порога. Каждая запись сначала дописывается в файл spool,
+// поэтому после падения процесса очередь восстанавливается и досылается.
+type writeQueue struct {
+	sc *SheetsClient
+
+	mu      sync.Mutex
+	pending []pendingWrite
+	spool   *os.File
+
+	spoolPath string
+	flushSize int
+	interval  time.Duration // 0 - запись сразу, без накопления
+
+	flushMu sync.Mutex // не даем двум сбросам очереди идти одновременно
+	flushCh chan struct{}
+}
+
+func newWriteQueue(sc *SheetsClient, spoolPath string, interval time.Duration, flushSize int) (*writeQueue, error) {
+	if flushSize <= 0 {
+		flushSize = defaultFlushSize
+	}
+
+	q := &writeQueue{
+		sc:        sc,
+		spoolPath: spoolPath,
+		flushSize: flushSize,
+		interval:  interval,
+		flushCh:   make(chan struct{}, 1),
+	}
+
+	if spoolPath != "" {
+		if err := q.restoreSpool(); err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
+}
+
+// restoreSpool загружает записи, не отправленные до перезапуска
+func (q *writeQueue) restoreSpool() error {
+	file, err := os.Open(q.spoolPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("ошибка открытия файла очереди записи: %w", err)
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var w pendingWrite
+			if err := json.Unmarshal(scanner.Bytes(), &w); err != nil {
+				// Последняя строка могла оборваться при падении - пропускаем ее
+				log.Printf("⚠️ Пропуск поврежденной записи в очереди: %v", err)
+				continue
+			}
+			q.pending = append(q.pending, w)
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("ошибка чтения файла очереди записи: %w", err)
+		}
+
+		if len(q.pending) > 0 {
+			log.Printf("Восстановлено записей из очереди: %d", len(q.pending))
+		}
+	}
+
+	return q.rewriteSpool()
+}
+
+// start запускает фоновую отправку очереди
+func (q *writeQueue) start() {
+	if q.interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(q.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-q.flushCh:
+			}
+
+			if err := q.flush(); err != nil {
+				log.Printf("Ошибка отправки очереди записи: %v", err)
+			}
+		}
+	}()
+}
+
+// enqueue ставит запись в очередь. Запись считается принятой после сохранения в spool.
+func (q *writeQueue) enqueue(w pendingWrite) error {
+	q.mu.Lock()
+	if err := q.appendSpool(w); err != nil {
+		q.mu.Unlock()
+		return err
+	}
+	q.pending = append(q.pending, w)
+	size := len(q.pending)
+	q.mu.Unlock()
+
+	// Без накопления пишем сразу и возвращаем ошибку вызывающему
+	if q.interval <= 0 {
+		return q.flush()
+	}
+
+	if size >= q.flushSize {
+		select {
+		case q.flushCh <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// flush отправляет все накопленные записи. Записи, которые не удалось отправить
+// из-за временных ошибок, остаются в очереди до следующей попытки. Записи с постоянной
+// ошибкой убираются из очереди в файл отброшенных записей, а flush возвращает ошибку.
+func (q *writeQueue) flush() error {
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+
+	dropped := 0
+	for {
+		q.mu.Lock()
+		batch := make([]pendingWrite, len(q.pending))
+		copy(batch, q.pending)
+		q.mu.Unlock()
+
+		if len(batch) == 0 {
+			if dropped > 0 {
+				return fmt.Errorf("отброшено записей с постоянной ошибкой: %d", dropped)
+			}
+			return nil
+		}
+		if len(batch) > maxBatchSize {
+			batch = batch[:maxBatchSize]
+		}
+
+		err := q.send(batch)
+		if err != nil && isRetryable(err) {
+			return err
+		}
+		if err != nil {
+			// Постоянная ошибка (например, некорректный диапазон): отправляем по одной,
+			// чтобы одна плохая запись не блокировала остальные
+			log.Printf("⚠️ Ошибка пакетной записи, отправляем записи по одной: %v", err)
+			for _, w := range batch {
+				if err := q.send([]pendingWrite{w}); err != nil {
+					if isRetryable(err) {
+						return err
+					}
+					log.Printf("❌ Запись %s отброшена: %v (значения: %v)", w.Range, err, w.Values)
+					dropped++
+					if dlErr := q.appendDeadLetter(w, err); dlErr != nil {
+						log.Printf("❌ Не удалось сохранить отброшенную запись %s: %v", w.Range, dlErr)
+					}
+				}
+			}
+		}
+
+		q.mu.Lock()
+		q.pending = q.pending[len(batch):]
+		spoolErr := q.rewriteSpool()
+		q.mu.Unlock()
+		if spoolErr != nil {
+			return spoolErr
+		}
+	}
+}
+
+// send отправляет записи одним BatchUpdate
+func (q *writeQueue) send(batch []pendingWrite) error {
+	data := make([]*sheets.ValueRange, 0, len(batch))
+	for _, w := range batch {
+		data = append(data, &sheets.ValueRange{Range: w.Range, Values: w.Values})
+	}
+
+	body := &sheets.BatchUpdateValuesRequest{
+		ValueInputOption: "USER_ENTERED",
+		Data:             data,
+	}
+
+	resp, err := executeWrite(q.sc, "values.batchUpdate", q.sc.service.Spreadsheets.Values.BatchUpdate(q.sc.spreadsheetID, body))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("✅ Очередь записи отправлена: диапазонов=%d, обновлено ячеек=%d", len(batch), resp.TotalUpdatedCells)
+	return nil
+}
+
+// pendingRows возвращает номера строк листа, запись которых еще в очереди
+func (q *writeQueue) pendingRows(sheet string) map[int]bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	rows := make(map[int]bool)
+	for _, w := range q.pending {
+		if w.Sheet == sheet && w.Row > 0 {
+			rows[w.Row] = true
+		}
+	}
+	return rows
+}
+
+// isPending сообщает, ожидает ли строка листа записи
+func (q *writeQueue) isPending(sheet string, row int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, w := range q.pending {
+		if w.Sheet == sheet && w.Row == row {
+			return true
+		}
+	}
+	return false
+}
+
+// findPendingRow ищет строку листа в очереди по условию (последняя запись выигрывает)
+func (q *writeQueue) findPendingRow(sheet string, match func(row []interface{}) bool) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i := len(q.pending) - 1; i >= 0; i-- {
+		w := q.pending[i]
+		if w.Sheet == sheet && w.Row > 0 && len(w.Values) > 0 && match(w.Values[0]) {
+			return w.Row
+		}
+	}
+	return 0
+}
+
+// appendSpool дописывает запись в файл очереди и сбрасывает его на диск
+func (q *writeQueue) appendSpool(w pendingWrite) error {
+	if q.spool == nil {
+		return nil
+	}
+
+	line, err := json.Marshal(w)
+	if err != nil {
+		return fmt.Errorf("ошибка сериализации записи: %w", err)
+	}
+	if _, err := q.spool.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("ошибка записи в файл очереди: %w", err)
+	}
+	if err := q.spool.Sync(); err != nil {
+		return fmt.Errorf("ошибка сохранения файла очереди: %w", err)
+	}
+	return nil
+}
+
+// deadLetter - запись, отброшенная из-за постоянной ошибки, с причиной
+type deadLetter struct {
+	pendingWrite
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// deadLetterPath - файл для записей, которые таблица отклонила (рядом с файлом очереди)
+func (q *writeQueue) deadLetterPath() string {
+	if q.spoolPath == "" {
+		return ""
+	}
+	return q.spoolPath + ".dead"
+}
+
+// appendDeadLetter сохраняет отброшенную запись, чтобы суммы не терялись и их можно было
+// внести вручную. Без файла очереди запись только логируется.
+func (q *writeQueue) appendDeadLetter(w pendingWrite, sendErr error) error {
+	path := q.deadLetterPath()
+	if path == "" {
+		return nil
+	}
+
+	line, err := json.Marshal(deadLetter{pendingWrite: w, Error: sendErr.Error(), Time: time.Now()})
+	if err != nil {
+		return fmt.Errorf("ошибка сериализации записи: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("ошибка открытия файла отброшенных записей: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("ошибка записи в файл отброшенных записей: %w", err)
+	}
+	return file.Sync()
+}
+
+// rewriteSpool атомарно перезаписывает файл очереди текущим содержимым.
+// Вызывается под q.mu.
+func (q *writeQueue) rewriteSpool() error {
+	if q.spoolPath == "" {
+		return nil
+	}
+
+	if q.spool != nil {
+		q.spool.Close()
+		q.spool = nil
+	}
+
+	tmpPath := q.spoolPath + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("ошибка создания файла очереди: %w", err)
+	}
+
+	for _, w := range q.pending {
+		line, err := json.Marshal(w)
+		if err != nil {
+			tmp.Close()
+			return fmt.Errorf("ошибка сериализации записи: %w", err)
+		}
+		if _, err := tmp.Write(append(line, '\n')); err != nil {
+			tmp.Close()
+			return fmt.Errorf("ошибка записи файла очереди: %w", err)
+		}
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("ошибка сохранения файла очереди: %w", err)
+	}
+	tmp.Close()
+
+	if err := os.Rename(tmpPath, q.spoolPath); err != nil {
+		return fmt.Errorf("ошибка замены файла очереди: %w", err)
+	}
+
+	spool, err := os.OpenFile(q.spoolPath, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("ошибка открытия файла очереди: %w", err)
+	}
+	q.spool = spool
+	return nil
+}
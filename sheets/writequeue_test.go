@@ -0,0 +1,50 @@
+package sheets
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRejectedWriteGoesToDeadLetterFile(t *testing.T) {
+	spoolPath := filepath.Join(t.TempDir(), "spool.jsonl")
+	f, sc := newFixture(t, Options{SpoolPath: spoolPath}, nil)
+
+	// Пакет и повторная отправка по одной отклонены окончательно
+	f.fail("values.batchUpdate", 400, 400)
+	if _, err := sc.CreateReferrer(111, "@ref"); err == nil {
+		t.Fatal("CreateReferrer должен вернуть ошибку отброшенной записи")
+	}
+
+	file, err := os.Open(spoolPath + ".dead")
+	if err != nil {
+		t.Fatalf("файл отброшенных записей не создан: %v", err)
+	}
+	defer file.Close()
+
+	var dead []deadLetter
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var d deadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			t.Fatalf("некорректная строка файла отброшенных записей: %v", err)
+		}
+		dead = append(dead, d)
+	}
+	if len(dead) != 1 || dead[0].Sheet != referrersSchema.Name || dead[0].Error == "" {
+		t.Fatalf("отброшенные записи: %+v, ожидалась одна строка листа Рефоводы с причиной", dead)
+	}
+
+	// В очереди запись не остается и повторно не отправляется
+	if data, err := os.ReadFile(spoolPath); err != nil || len(data) != 0 {
+		t.Errorf("файл очереди: %q, %v; ожидался пустой", data, err)
+	}
+	if err := sc.Flush(); err != nil {
+		t.Errorf("Flush после отброшенной записи: %v", err)
+	}
+	if got := f.callCount("values.batchUpdate"); got != 2 {
+		t.Errorf("вызовов values.batchUpdate %d, ожидалось 2", got)
+	}
+}
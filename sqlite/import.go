@@ -0,0 +1,173 @@
+package sqlite
+
+import (
+	"fmt"
+	"strings"
+
+	"ss_ref_bot/money"
+	"ss_ref_bot/sheets"
+)
+
+// ImportRejection описывает запись, которую не удалось загрузить в базу
+type ImportRejection struct {
+	Index  int    // номер записи во входном списке
+	Key    string // идентификатор записи (ID пользователя или ID сделки)
+	Reason string
+}
+
+// ImportTotals - количество записей и контрольные суммы, по которым сверяется перенос
+type ImportTotals struct {
+	Referrers int
+	Invited   int
+	Referrals int
+	Pending   money.Amount // сумма "Ожидает выплаты" рефоводов
+	Profit    money.Amount // сумма прибыли по начислениям
+	Bonus     money.Amount // сумма бонусов по начислениям
+}
+
+// Totals считает записи и контрольные суммы в базе
+func (s *SQLiteStore) Totals() (ImportTotals, error) {
+	var t ImportTotals
+	err := s.db.QueryRow(`SELECT
+		(SELECT COUNT(*) FROM referrers),
+		(SELECT COUNT(*) FROM invited),
+		(SELECT COUNT(*) FROM referrals),
+		(SELECT COALESCE(SUM(pending_payout), 0) FROM referrers),
+		(SELECT COALESCE(SUM(profit), 0) FROM referrals),
+		(SELECT COALESCE(SUM(bonus), 0) FROM referrals)`).
+		Scan(&t.Referrers, &t.Invited, &t.Referrals, &t.Pending, &t.Profit, &t.Bonus)
+	if err != nil {
+		return ImportTotals{}, fmt.Errorf("ошибка подсчета итогов базы: %w", err)
+	}
+	return t, nil
+}
+
+// ExpectedTotals считает итоги по прочитанным из таблицы записям без отклоненных при импорте
+func ExpectedTotals(referrers []sheets.Referrer, rejectedReferrers []ImportRejection,
+	invited []sheets.Invited, rejectedInvited []ImportRejection,
+	referrals []sheets.Referral, rejectedReferrals []ImportRejection) ImportTotals {
+	var t ImportTotals
+
+	skip := rejectedIndexes(rejectedReferrers)
+	for i, ref := range referrers {
+		if !skip[i] {
+			t.Referrers++
+			t.Pending += ref.PendingPayout
+		}
+	}
+
+	t.Invited = len(invited) - len(rejectedIndexes(rejectedInvited))
+
+	skip = rejectedIndexes(rejectedReferrals)
+	for i, ref := range referrals {
+		if !skip[i] {
+			t.Referrals++
+			t.Profit += ref.Profit
+			t.Bonus += ref.Bonus
+		}
+	}
+	return t
+}
+
+func rejectedIndexes(rejected []ImportRejection) map[int]bool {
+	skip := make(map[int]bool, len(rejected))
+	for _, r := range rejected {
+		skip[r.Index] = true
+	}
+	return skip
+}
+
+// Sub возвращает разность итогов: прирост базы за импорт
+func (t ImportTotals) Sub(o ImportTotals) ImportTotals {
+	return ImportTotals{
+		Referrers: t.Referrers - o.Referrers,
+		Invited:   t.Invited - o.Invited,
+		Referrals: t.Referrals - o.Referrals,
+		Pending:   t.Pending - o.Pending,
+		Profit:    t.Profit - o.Profit,
+		Bonus:     t.Bonus - o.Bonus,
+	}
+}
+
+// Mismatches перечисляет расхождения фактических итогов с ожидаемыми
+func (t ImportTotals) Mismatches(actual ImportTotals) []string {
+	var diffs []string
+	count := func(name string, want, got int) {
+		if want != got {
+			diffs = append(diffs, fmt.Sprintf("%s: в таблице %d, в базе %d", name, want, got))
+		}
+	}
+	sum := func(name string, want, got money.Amount) {
+		if want != got {
+			diffs = append(diffs, fmt.Sprintf("%s: в таблице %s, в базе %s", name, want, got))
+		}
+	}
+	count("Рефоводы", t.Referrers, actual.Referrers)
+	count("Приглашенные", t.Invited, actual.Invited)
+	count("Рефералы", t.Referrals, actual.Referrals)
+	sum("Ожидает выплаты", t.Pending, actual.Pending)
+	sum("Прибыль", t.Profit, actual.Profit)
+	sum("Бонусы", t.Bonus, actual.Bonus)
+	return diffs
+}
+
+// ImportReferrers загружает рефоводов как есть (с их кодами и балансами) в одной транзакции
+func (s *SQLiteStore) ImportReferrers(referrers []sheets.Referrer) (int, []ImportRejection, error) {
+	return s.importRows(len(referrers), func(i int) (string, string, []interface{}) {
+		ref := referrers[i]
+		return fmt.Sprintf("ID %d", ref.ID),
+			`INSERT INTO referrers (id, username, code, wallet, ref_count, pending_payout, paid_out, rate)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			[]interface{}{ref.ID, ref.Username, strings.TrimSpace(ref.Code), ref.Wallet, ref.RefCount, ref.PendingPayout, ref.PaidOut, ref.Rate}
+	})
+}
+
+// ImportInvited загружает приглашенных в одной транзакции
+func (s *SQLiteStore) ImportInvited(invited []sheets.Invited) (int, []ImportRejection, error) {
+	return s.importRows(len(invited), func(i int) (string, string, []interface{}) {
+		inv := invited[i]
+		return fmt.Sprintf("ID %d", inv.UserID),
+			"INSERT INTO invited (user_id, ref_code, invited_at) VALUES (?, ?, ?)",
+			[]interface{}{inv.UserID, strings.TrimSpace(inv.RefCode), formatTime(inv.InvitedAt)}
+	})
+}
+
+// ImportReferrals загружает начисления в одной транзакции
+func (s *SQLiteStore) ImportReferrals(referrals []sheets.Referral) (int, []ImportRejection, error) {
+	return s.importRows(len(referrals), func(i int) (string, string, []interface{}) {
+		ref := referrals[i]
+		return "сделка " + ref.DealID,
+			`INSERT INTO referrals (ref_id, ref_code, profit, deal_id, bonus, date, rate, level)
+				VALUES (?, ?, ?, ?, ?, ?, ?, MAX(?, 1))`,
+			[]interface{}{ref.RefID, strings.TrimSpace(ref.RefCode), ref.Profit, ref.DealID, ref.Bonus, ref.Date, ref.Rate, ref.Level}
+	})
+}
+
+// importRows выполняет вставку n записей; нарушения уникальности не прерывают импорт,
+// а попадают в список отклоненных
+func (s *SQLiteStore) importRows(n int, row func(i int) (key, query string, args []interface{})) (int, []ImportRejection, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, nil, fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback()
+
+	imported := 0
+	var rejected []ImportRejection
+	for i := 0; i < n; i++ {
+		key, query, args := row(i)
+		if _, err := tx.Exec(query, args...); err != nil {
+			if isUniqueViolation(err) {
+				rejected = append(rejected, ImportRejection{Index: i, Key: key, Reason: "дубликат: " + err.Error()})
+				continue
+			}
+			return 0, nil, fmt.Errorf("ошибка импорта (%s): %w", key, err)
+		}
+		imported++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, nil, fmt.Errorf("ошибка сохранения импорта: %w", err)
+	}
+	return imported, rejected, nil
+}
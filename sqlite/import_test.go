@@ -0,0 +1,74 @@
+package sqlite
+
+import (
+	"testing"
+	"time"
+
+	"ss_ref_bot/money"
+	"ss_ref_bot/sheets"
+)
+
+func TestImportReconcilesWithSheetRows(t *testing.T) {
+	s := newTestStore(t)
+
+	// В базе уже есть данные: сверяется только прирост за импорт
+	if _, err := s.CreateReferrer(999, "@old"); err != nil {
+		t.Fatalf("CreateReferrer: %v", err)
+	}
+	before, err := s.Totals()
+	if err != nil {
+		t.Fatalf("Totals: %v", err)
+	}
+
+	referrers := []sheets.Referrer{
+		{ID: 111, Username: "@ref", Code: "ABC123", PendingPayout: money.FromFloat(0.1)},
+		{ID: 222, Username: "@other", Code: "XYZ789", PendingPayout: money.FromFloat(0.2)},
+		{ID: 111, Username: "@dup", Code: "DUP111", PendingPayout: money.FromFloat(100)}, // дубликат ID
+	}
+	invited := []sheets.Invited{
+		{UserID: 1001, RefCode: "ABC123", InvitedAt: time.Now()},
+		{UserID: 1001, RefCode: "XYZ789", InvitedAt: time.Now()}, // дубликат
+	}
+	referrals := []sheets.Referral{
+		{RefID: 1001, RefCode: "ABC123", Profit: money.FromFloat(33.33), DealID: "D-1", Bonus: money.FromFloat(3.333)},
+		{RefID: 1001, RefCode: "ABC123", Profit: money.FromFloat(66.67), DealID: "D-2", Bonus: money.FromFloat(6.667)},
+		{RefID: 1001, RefCode: "ABC123", Profit: money.FromFloat(500), DealID: "D-1", Bonus: money.FromFloat(50)}, // дубликат сделки
+	}
+
+	_, rejectedReferrers, err := s.ImportReferrers(referrers)
+	if err != nil {
+		t.Fatalf("ImportReferrers: %v", err)
+	}
+	_, rejectedInvited, err := s.ImportInvited(invited)
+	if err != nil {
+		t.Fatalf("ImportInvited: %v", err)
+	}
+	_, rejectedReferrals, err := s.ImportReferrals(referrals)
+	if err != nil {
+		t.Fatalf("ImportReferrals: %v", err)
+	}
+	if len(rejectedReferrers) != 1 || rejectedReferrers[0].Index != 2 {
+		t.Errorf("отклоненные рефоводы: %+v, ожидался дубликат в записи 2", rejectedReferrers)
+	}
+
+	after, err := s.Totals()
+	if err != nil {
+		t.Fatalf("Totals: %v", err)
+	}
+	expected := ExpectedTotals(referrers, rejectedReferrers, invited, rejectedInvited, referrals, rejectedReferrals)
+	want := ImportTotals{Referrers: 2, Invited: 1, Referrals: 2,
+		Pending: money.FromFloat(0.3), Profit: money.FromFloat(100), Bonus: money.FromFloat(10)}
+	if expected != want {
+		t.Errorf("ожидаемые итоги %+v, ожидалось %+v", expected, want)
+	}
+	if diffs := expected.Mismatches(after.Sub(before)); len(diffs) > 0 {
+		t.Errorf("сверка не сошлась: %v", diffs)
+	}
+
+	// Расхождение суммы обнаруживается
+	changed := after.Sub(before)
+	changed.Bonus += money.Cent
+	if diffs := expected.Mismatches(changed); len(diffs) != 1 {
+		t.Errorf("расхождения %v, ожидалось одно по бонусам", diffs)
+	}
+}
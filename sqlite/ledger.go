@@ -0,0 +1,180 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"ss_ref_bot/money"
+	"ss_ref_bot/sheets"
+)
+
+// AppendLedgerEntry добавляет запись в журнал; запись с существующим ID пропускается
+func (s *SQLiteStore) AppendLedgerEntry(entry sheets.LedgerEntry) error {
+	inserted, err := insertLedgerEntry(s.db, entry)
+	if err != nil {
+		return err
+	}
+	if inserted {
+		s.mirrorLedgerEntry(entry)
+	}
+	return nil
+}
+
+// execer - общее у *sql.DB и *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertLedgerEntry(db execer, e sheets.LedgerEntry) (bool, error) {
+	res, err := db.Exec(`INSERT OR IGNORE INTO ledger (id, time, type, referrer_id, debit, credit, amount, deal_id, reason)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.ID, formatTime(e.Time), string(e.Type), e.ReferrerID, e.Debit, e.Credit, e.Amount, e.DealID, e.Reason)
+	if err != nil {
+		return false, fmt.Errorf("ошибка добавления записи журнала %s: %w", e.ID, err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("ошибка добавления записи журнала %s: %w", e.ID, err)
+	}
+	return n > 0, nil
+}
+
+// LedgerEntries возвращает записи журнала по рефоводу в порядке добавления
+func (s *SQLiteStore) LedgerEntries(referrerID int64) ([]sheets.LedgerEntry, error) {
+	rows, err := s.db.Query(`SELECT id, time, type, referrer_id, debit, credit, amount, deal_id, reason
+		FROM ledger WHERE referrer_id = ? ORDER BY rowid`, referrerID)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения журнала рефовода %d: %w", referrerID, err)
+	}
+	defer rows.Close()
+
+	var entries []sheets.LedgerEntry
+	for rows.Next() {
+		var e sheets.LedgerEntry
+		var entryTime, entryType string
+		if err := rows.Scan(&e.ID, &entryTime, &entryType, &e.ReferrerID, &e.Debit, &e.Credit, &e.Amount, &e.DealID, &e.Reason); err != nil {
+			return nil, fmt.Errorf("ошибка чтения журнала рефовода %d: %w", referrerID, err)
+		}
+		e.Time = parseTime(entryTime)
+		e.Type = sheets.LedgerEntryType(entryType)
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка чтения журнала рефовода %d: %w", referrerID, err)
+	}
+	return entries, nil
+}
+
+// ledgerBalances считает остатки рефоводов по журналу
+func ledgerBalances(tx *sql.Tx) (map[int64]sheets.LedgerBalance, error) {
+	rows, err := tx.Query("SELECT type, referrer_id, debit, credit, amount FROM ledger")
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения журнала: %w", err)
+	}
+	defer rows.Close()
+
+	balances := make(map[int64]sheets.LedgerBalance)
+	for rows.Next() {
+		var e sheets.LedgerEntry
+		var entryType string
+		if err := rows.Scan(&entryType, &e.ReferrerID, &e.Debit, &e.Credit, &e.Amount); err != nil {
+			return nil, fmt.Errorf("ошибка чтения журнала: %w", err)
+		}
+		e.Type = sheets.LedgerEntryType(entryType)
+
+		balance := balances[e.ReferrerID]
+		balance.Apply(e)
+		balances[e.ReferrerID] = balance
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка чтения журнала: %w", err)
+	}
+	return balances, nil
+}
+
+// backfillLedger переносит в журнал начисления из referrals и выплаты из paid_out,
+// которых в нем еще нет, и возвращает добавленные записи
+func backfillLedger(tx *sql.Tx) ([]sheets.LedgerEntry, error) {
+	var entries []sheets.LedgerEntry
+
+	rows, err := tx.Query(`SELECT r.id, f.deal_id, f.bonus, f.level FROM referrals f
+		JOIN referrers r ON r.code = f.ref_code
+		WHERE NOT EXISTS (SELECT 1 FROM ledger l
+			WHERE l.type = ? AND l.deal_id = f.deal_id AND l.referrer_id = r.id)`,
+		string(sheets.EntryAccrual))
+	if err != nil {
+		return nil, fmt.Errorf("ошибка поиска начислений вне журнала: %w", err)
+	}
+	for rows.Next() {
+		var referrerID int64
+		var dealID string
+		var bonus money.Amount
+		var level int
+		if err := rows.Scan(&referrerID, &dealID, &bonus, &level); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("ошибка поиска начислений вне журнала: %w", err)
+		}
+		entries = append(entries, sheets.NewAccrualEntry(referrerID, bonus, dealID, level, "перенос из referrals"))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка поиска начислений вне журнала: %w", err)
+	}
+
+	for _, entry := range entries {
+		if _, err := insertLedgerEntry(tx, entry); err != nil {
+			return nil, err
+		}
+	}
+
+	balances, err := ledgerBalances(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	paidRows, err := tx.Query("SELECT id, paid_out FROM referrers")
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения выплат: %w", err)
+	}
+	var payouts []sheets.LedgerEntry
+	for paidRows.Next() {
+		var id int64
+		var paidOut money.Amount
+		if err := paidRows.Scan(&id, &paidOut); err != nil {
+			paidRows.Close()
+			return nil, fmt.Errorf("ошибка чтения выплат: %w", err)
+		}
+
+		ledgerPaid := balances[id].Paid
+		diff := paidOut - ledgerPaid
+		if diff > 0 {
+			payouts = append(payouts, sheets.NewLedgerEntry(sheets.EntryPayout, id, diff, "", "выплата по paid_out"))
+		} else if diff < 0 {
+			log.Printf("⚠️ У рефовода %d paid_out %s, а в журнале выплат на %s", id, paidOut, ledgerPaid)
+		}
+	}
+	paidRows.Close()
+	if err := paidRows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка чтения выплат: %w", err)
+	}
+
+	for _, entry := range payouts {
+		if _, err := insertLedgerEntry(tx, entry); err != nil {
+			return nil, err
+		}
+	}
+
+	return append(entries, payouts...), nil
+}
+
+// mirrorLedgerEntry дублирует запись журнала в Google Таблицу; ошибки зеркала не критичны
+func (s *SQLiteStore) mirrorLedgerEntry(entry sheets.LedgerEntry) {
+	if !s.mirror {
+		return
+	}
+	if err := s.sheets.AppendLedgerEntry(entry); err != nil {
+		log.Printf("Предупреждение: не удалось записать %s в зеркало журнала: %v", entry.ID, err)
+	}
+}
@@ -0,0 +1,180 @@
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"ss_ref_bot/sheets"
+)
+
+// CreatePayoutRequest сохраняет заявку на выплату; вторая необработанная заявка
+// рефовода отклоняется с ошибкой sheets.ErrPayoutRequestOpen
+func (s *SQLiteStore) CreatePayoutRequest(req *sheets.PayoutRequest) error {
+	_, err := s.db.Exec(`INSERT INTO payout_requests (id, time, referrer_id, username, wallet, amount, status)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		req.ID, formatTime(req.Time), req.ReferrerID, req.Username, req.Wallet, req.Amount, string(req.Status))
+	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("рефовод %d: %w", req.ReferrerID, sheets.ErrPayoutRequestOpen)
+		}
+		return fmt.Errorf("ошибка добавления заявки на выплату: %w", err)
+	}
+
+	if s.mirror {
+		if err := s.sheets.CreatePayoutRequest(req); err != nil {
+			log.Printf("Предупреждение: не удалось записать заявку %s в зеркало: %v", req.ID, err)
+		}
+	}
+	return nil
+}
+
+// OpenPayoutRequest возвращает заявку рефовода в статусе "ожидает" или nil, если ее нет
+func (s *SQLiteStore) OpenPayoutRequest(referrerID int64) (*sheets.PayoutRequest, error) {
+	req, err := scanPayoutRequest(s.db.QueryRow(`SELECT `+payoutRequestColumns+`
+		FROM payout_requests WHERE referrer_id = ? AND status = ?`, referrerID, string(sheets.PayoutRequested)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения заявки рефовода %d: %w", referrerID, err)
+	}
+	return req, nil
+}
+
+// ResolvePayoutRequest переводит заявку из статуса "ожидает" в status. Если заявку уже
+// рассмотрели, возвращает ее вместе с sheets.ErrPayoutRequestResolved.
+func (s *SQLiteStore) ResolvePayoutRequest(id string, status sheets.PayoutStatus, reviewer, reason string) (*sheets.PayoutRequest, error) {
+	reviewedAt := time.Now().Truncate(time.Second)
+	res, err := s.db.Exec(`UPDATE payout_requests SET status = ?, reviewed_by = ?, reviewed_at = ?, reason = ?
+		WHERE id = ? AND status = ?`,
+		string(status), reviewer, formatTime(reviewedAt), reason, id, string(sheets.PayoutRequested))
+	if err != nil {
+		return nil, fmt.Errorf("ошибка обновления заявки %s: %w", id, err)
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка обновления заявки %s: %w", id, err)
+	}
+
+	req, err := scanPayoutRequest(s.db.QueryRow(`SELECT `+payoutRequestColumns+` FROM payout_requests WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("заявка %s не найдена", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения заявки %s: %w", id, err)
+	}
+	if updated == 0 {
+		return req, fmt.Errorf("заявка %s (%s): %w", id, req.Status, sheets.ErrPayoutRequestResolved)
+	}
+
+	if s.mirror {
+		if _, err := s.sheets.ResolvePayoutRequest(id, status, reviewer, reason); err != nil {
+			log.Printf("Предупреждение: не удалось обновить заявку %s в зеркале: %v", id, err)
+		}
+	}
+	return req, nil
+}
+
+// ReopenPayoutRequest возвращает одобренную заявку в статус "ожидает", стирая, кто и когда ее
+// рассмотрел. Если заявка не в статусе "одобрена", возвращает ее вместе с sheets.ErrPayoutRequestNotApproved.
+func (s *SQLiteStore) ReopenPayoutRequest(id string) (*sheets.PayoutRequest, error) {
+	res, err := s.db.Exec(`UPDATE payout_requests SET status = ?, reviewed_by = '', reviewed_at = '' WHERE id = ? AND status = ?`,
+		string(sheets.PayoutRequested), id, string(sheets.PayoutApproved))
+	if err != nil {
+		return nil, fmt.Errorf("ошибка обновления заявки %s: %w", id, err)
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка обновления заявки %s: %w", id, err)
+	}
+
+	req, err := scanPayoutRequest(s.db.QueryRow(`SELECT `+payoutRequestColumns+` FROM payout_requests WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("заявка %s не найдена", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения заявки %s: %w", id, err)
+	}
+	if updated == 0 {
+		return req, fmt.Errorf("заявка %s (%s): %w", id, req.Status, sheets.ErrPayoutRequestNotApproved)
+	}
+
+	if s.mirror {
+		if _, err := s.sheets.ReopenPayoutRequest(id); err != nil {
+			log.Printf("Предупреждение: не удалось обновить заявку %s в зеркале: %v", id, err)
+		}
+	}
+	return req, nil
+}
+
+// MarkPayoutExported переводит заявку из статуса "одобрена" в "выгружена" с ID выгрузки.
+// Если заявка уже выгружена или не одобрена, возвращает ее вместе с sheets.ErrPayoutRequestNotApproved.
+func (s *SQLiteStore) MarkPayoutExported(id, exportID string) (*sheets.PayoutRequest, error) {
+	res, err := s.db.Exec(`UPDATE payout_requests SET status = ?, export_id = ? WHERE id = ? AND status = ?`,
+		string(sheets.PayoutExported), exportID, id, string(sheets.PayoutApproved))
+	if err != nil {
+		return nil, fmt.Errorf("ошибка обновления заявки %s: %w", id, err)
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка обновления заявки %s: %w", id, err)
+	}
+
+	req, err := scanPayoutRequest(s.db.QueryRow(`SELECT `+payoutRequestColumns+` FROM payout_requests WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("заявка %s не найдена", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения заявки %s: %w", id, err)
+	}
+	if updated == 0 {
+		return req, fmt.Errorf("заявка %s (%s): %w", id, req.Status, sheets.ErrPayoutRequestNotApproved)
+	}
+
+	if s.mirror {
+		if _, err := s.sheets.MarkPayoutExported(id, exportID); err != nil {
+			log.Printf("Предупреждение: не удалось обновить заявку %s в зеркале: %v", id, err)
+		}
+	}
+	return req, nil
+}
+
+// GetPayoutRequests возвращает все заявки на выплату в порядке создания
+func (s *SQLiteStore) GetPayoutRequests() ([]sheets.PayoutRequest, error) {
+	rows, err := s.db.Query(`SELECT ` + payoutRequestColumns + ` FROM payout_requests ORDER BY time, id`)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения заявок на выплату: %w", err)
+	}
+	defer rows.Close()
+
+	var requests []sheets.PayoutRequest
+	for rows.Next() {
+		req, err := scanPayoutRequest(rows)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения заявок на выплату: %w", err)
+		}
+		requests = append(requests, *req)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка чтения заявок на выплату: %w", err)
+	}
+	return requests, nil
+}
+
+const payoutRequestColumns = `id, time, referrer_id, username, wallet, amount, status, reviewed_by, reviewed_at, reason, export_id`
+
+func scanPayoutRequest(row interface{ Scan(...interface{}) error }) (*sheets.PayoutRequest, error) {
+	req := &sheets.PayoutRequest{}
+	var reqTime, status, reviewedAt string
+	if err := row.Scan(&req.ID, &reqTime, &req.ReferrerID, &req.Username, &req.Wallet, &req.Amount, &status,
+		&req.ReviewedBy, &reviewedAt, &req.Reason, &req.ExportID); err != nil {
+		return nil, err
+	}
+	req.Time = parseTime(reqTime)
+	req.Status = sheets.PayoutStatus(status)
+	req.ReviewedAt = parseTime(reviewedAt)
+	return req, nil
+}
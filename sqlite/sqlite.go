@@ -0,0 +1,810 @@
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"ss_ref_bot/money"
+	"ss_ref_bot/sheets"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// SQLiteStore хранит рефоводов, приглашенных, начисления и выводы в локальной базе SQLite.
+// База - источник истины; Google Таблица (если подключена) используется как источник листа
+// Выводы и (опционально) как зеркало для просмотра данных. Без нее сделки берутся из таблицы
+// withdrawals, которую заполняет внешний процесс.
+type SQLiteStore struct {
+	db *sql.DB
+
+	// sheets - клиент Google Sheets для чтения листа Выводы и записи зеркала (может быть nil)
+	sheets *sheets.SheetsClient
+	mirror bool
+}
+
+// Суммы и ставки хранятся целыми числами в микро-USDT (миллионных долях процента),
+// как money.Amount и money.Percent, поэтому сложение и SUM в базе точные.
+
+// referralsTable - определение таблицы referrals. По сделке хранится по записи
+// на каждый уровень партнерской цепочки.
+const referralsTable = `(
+	id       INTEGER PRIMARY KEY AUTOINCREMENT,
+	ref_id   INTEGER NOT NULL,
+	ref_code TEXT    NOT NULL COLLATE NOCASE,
+	profit   INTEGER NOT NULL,
+	deal_id  TEXT    NOT NULL,
+	bonus    INTEGER NOT NULL,
+	date     TEXT    NOT NULL DEFAULT '',
+	rate     INTEGER NOT NULL DEFAULT 0,
+	level    INTEGER NOT NULL DEFAULT 1,
+	UNIQUE (deal_id, level)
+)`
+
+const referrersTable = `(
+	id             INTEGER PRIMARY KEY,
+	username       TEXT    NOT NULL DEFAULT '',
+	code           TEXT    NOT NULL COLLATE NOCASE,
+	wallet         TEXT    NOT NULL DEFAULT '',
+	ref_count      INTEGER NOT NULL DEFAULT 0,
+	pending_payout INTEGER NOT NULL DEFAULT 0,
+	paid_out       INTEGER NOT NULL DEFAULT 0,
+	rate           INTEGER NOT NULL DEFAULT 0,
+	UNIQUE (code)
+)`
+
+const ledgerTable = `(
+	id          TEXT    PRIMARY KEY,
+	time        TEXT    NOT NULL,
+	type        TEXT    NOT NULL,
+	referrer_id INTEGER NOT NULL,
+	debit       TEXT    NOT NULL,
+	credit      TEXT    NOT NULL,
+	amount      INTEGER NOT NULL,
+	deal_id     TEXT    NOT NULL DEFAULT '',
+	reason      TEXT    NOT NULL DEFAULT ''
+)`
+
+const payoutRequestsTable = `(
+	id          TEXT    PRIMARY KEY,
+	time        TEXT    NOT NULL,
+	referrer_id INTEGER NOT NULL,
+	username    TEXT    NOT NULL DEFAULT '',
+	wallet      TEXT    NOT NULL,
+	amount      INTEGER NOT NULL,
+	status      TEXT    NOT NULL,
+	reviewed_by TEXT    NOT NULL DEFAULT '',
+	reviewed_at TEXT    NOT NULL DEFAULT '',
+	reason      TEXT    NOT NULL DEFAULT '',
+	export_id   TEXT    NOT NULL DEFAULT ''
+)`
+
+const withdrawalsTable = `(
+	deal_id   TEXT    PRIMARY KEY,
+	user_id   INTEGER NOT NULL,
+	profit    INTEGER NOT NULL,
+	deal_time TEXT    NOT NULL DEFAULT ''
+)`
+
+// indexes создаются после таблиц и заново после их перестроения
+const indexes = `
+CREATE INDEX IF NOT EXISTS referrals_ref_code ON referrals (ref_code);
+
+CREATE INDEX IF NOT EXISTS ledger_referrer ON ledger (referrer_id);
+
+-- У рефовода не больше одной необработанной заявки: ее сумма заблокирована
+CREATE UNIQUE INDEX IF NOT EXISTS payout_requests_open ON payout_requests (referrer_id) WHERE status = 'ожидает';
+`
+
+const schema = `
+CREATE TABLE IF NOT EXISTS referrers ` + referrersTable + `;
+
+CREATE TABLE IF NOT EXISTS invited (
+	user_id    INTEGER PRIMARY KEY,
+	ref_code   TEXT    NOT NULL COLLATE NOCASE,
+	invited_at TEXT    NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS referrals ` + referralsTable + `;
+
+CREATE TABLE IF NOT EXISTS ledger ` + ledgerTable + `;
+
+CREATE TABLE IF NOT EXISTS payout_requests ` + payoutRequestsTable + `;
+
+CREATE TABLE IF NOT EXISTS withdrawals ` + withdrawalsTable + `;
+` + indexes
+
+// columnMigrations - колонки, добавленные после первой версии схемы. CREATE TABLE IF NOT EXISTS
+// не меняет существующие таблицы, поэтому в старые базы они добавляются через ALTER TABLE.
+var columnMigrations = []struct {
+	table, column, definition string
+}{
+	{"referrers", "rate", "INTEGER NOT NULL DEFAULT 0"},
+	{"referrals", "rate", "INTEGER NOT NULL DEFAULT 0"},
+	{"referrals", "level", "INTEGER NOT NULL DEFAULT 1"},
+	{"invited", "invited_at", "TEXT NOT NULL DEFAULT ''"},
+	{"payout_requests", "reviewed_by", "TEXT NOT NULL DEFAULT ''"},
+	{"payout_requests", "reviewed_at", "TEXT NOT NULL DEFAULT ''"},
+	{"payout_requests", "reason", "TEXT NOT NULL DEFAULT ''"},
+	{"payout_requests", "export_id", "TEXT NOT NULL DEFAULT ''"},
+	{"withdrawals", "deal_time", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// migrateColumns добавляет недостающие колонки из columnMigrations
+func migrateColumns(db *sql.DB) error {
+	for _, m := range columnMigrations {
+		var exists bool
+		err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pragma_table_info(?) WHERE name = ?)", m.table, m.column).Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("ошибка чтения схемы таблицы %s: %w", m.table, err)
+		}
+		if exists {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.table, m.column, m.definition)); err != nil {
+			return fmt.Errorf("ошибка добавления колонки %s.%s: %w", m.table, m.column, err)
+		}
+		log.Printf("В таблицу %s добавлена колонка %s", m.table, m.column)
+	}
+	return nil
+}
+
+// moneyTables - таблицы с суммами и ставками. В базах до перехода на микро-USDT эти колонки
+// были REAL с суммой в USDT; migrateMoneyColumns перестраивает такие таблицы.
+var moneyTables = []struct {
+	name, definition string
+	columns          []string
+}{
+	{"referrers", referrersTable, []string{"pending_payout", "paid_out", "rate"}},
+	{"referrals", referralsTable, []string{"profit", "bonus", "rate"}},
+	{"ledger", ledgerTable, []string{"amount"}},
+	{"payout_requests", payoutRequestsTable, []string{"amount"}},
+	{"withdrawals", withdrawalsTable, []string{"profit"}},
+}
+
+// migrateMoneyColumns переводит колонки сумм из REAL (USDT) в INTEGER (микро-USDT).
+// Тип колонки в SQLite не меняется через ALTER TABLE, поэтому таблица пересоздается
+// с переносом данных; значения округляются до микро-USDT.
+func migrateMoneyColumns(db *sql.DB) error {
+	for _, t := range moneyTables {
+		var columnType string
+		err := db.QueryRow("SELECT type FROM pragma_table_info(?) WHERE name = ?", t.name, t.columns[0]).Scan(&columnType)
+		if err != nil {
+			return fmt.Errorf("ошибка чтения схемы таблицы %s: %w", t.name, err)
+		}
+		if !strings.EqualFold(columnType, "REAL") {
+			continue
+		}
+
+		if err := rebuildMoneyTable(db, t.name, t.definition, t.columns); err != nil {
+			return err
+		}
+		log.Printf("Таблица %s перестроена: суммы хранятся в микро-USDT", t.name)
+	}
+	return nil
+}
+
+func rebuildMoneyTable(db *sql.DB, table, definition string, moneyColumns []string) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return fmt.Errorf("ошибка чтения схемы таблицы %s: %w", table, err)
+	}
+	var columns, values []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return fmt.Errorf("ошибка чтения схемы таблицы %s: %w", table, err)
+		}
+		columns = append(columns, name)
+		values = append(values, name)
+		for _, moneyColumn := range moneyColumns {
+			if name == moneyColumn {
+				values[len(values)-1] = fmt.Sprintf("CAST(ROUND(%s * 1000000) AS INTEGER)", name)
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("ошибка чтения схемы таблицы %s: %w", table, err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		fmt.Sprintf("CREATE TABLE %s_new %s", table, definition),
+		fmt.Sprintf("INSERT INTO %s_new (%s) SELECT %s FROM %s",
+			table, strings.Join(columns, ", "), strings.Join(values, ", "), table),
+		"DROP TABLE " + table,
+		fmt.Sprintf("ALTER TABLE %s_new RENAME TO %s", table, table),
+		indexes,
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("ошибка перестроения таблицы %s: %w", table, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("ошибка перестроения таблицы %s: %w", table, err)
+	}
+	return nil
+}
+
+// migrateReferralsKey пересоздает таблицу referrals из старой схемы, где сделка была
+// уникальной. ALTER TABLE не меняет ограничения, поэтому данные переносятся в новую таблицу.
+func migrateReferralsKey(db *sql.DB) error {
+	var definition string
+	err := db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'referrals'").Scan(&definition)
+	if err != nil {
+		return fmt.Errorf("ошибка чтения схемы таблицы referrals: %w", err)
+	}
+	if !strings.Contains(definition, "UNIQUE (deal_id)") {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		"CREATE TABLE referrals_new " + referralsTable,
+		`INSERT INTO referrals_new (id, ref_id, ref_code, profit, deal_id, bonus, date, rate, level)
+			SELECT id, ref_id, ref_code, profit, deal_id, bonus, date, rate, level FROM referrals`,
+		"DROP TABLE referrals",
+		"ALTER TABLE referrals_new RENAME TO referrals",
+		indexes,
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("ошибка перестроения таблицы referrals: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("ошибка перестроения таблицы referrals: %w", err)
+	}
+	log.Printf("Таблица referrals перестроена: уникальны сделка и уровень")
+	return nil
+}
+
+// NewSQLiteStore открывает (или создает) базу по пути path и применяет схему.
+// sheetsClient нужен для чтения листа Выводы и может быть nil; если mirror = true,
+// все изменения дублируются в Google Таблицу.
+func NewSQLiteStore(path string, sheetsClient *sheets.SheetsClient, mirror bool) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate", path))
+	if err != nil {
+		return nil, fmt.Errorf("ошибка открытия базы SQLite: %w", err)
+	}
+
+	// SQLite допускает только одного писателя, поэтому держим одно соединение
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ошибка создания схемы SQLite: %w", err)
+	}
+
+	if err := migrateColumns(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Перестроение referrals с суммами в микро-USDT заодно меняет и ключ сделки
+	if err := migrateMoneyColumns(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := migrateReferralsKey(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if mirror && sheetsClient == nil {
+		db.Close()
+		return nil, fmt.Errorf("для зеркалирования в Google Таблицу нужен клиент Sheets")
+	}
+
+	return &SQLiteStore{
+		db:     db,
+		sheets: sheetsClient,
+		mirror: mirror,
+	}, nil
+}
+
+// Close закрывает базу
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// LoadCache обновляет кэш зеркала; сама база кэша не требует
+func (s *SQLiteStore) LoadCache() error {
+	if !s.mirror {
+		return nil
+	}
+	return s.sheets.LoadCache()
+}
+
+const referrerColumns = "id, username, code, wallet, ref_count, pending_payout, paid_out, rate"
+
+func scanReferrer(row *sql.Row) (*sheets.Referrer, error) {
+	ref := &sheets.Referrer{}
+	err := row.Scan(&ref.ID, &ref.Username, &ref.Code, &ref.Wallet, &ref.RefCount, &ref.PendingPayout, &ref.PaidOut, &ref.Rate)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ref, nil
+}
+
+// GetReferrerByID получает рефовода по ID
+func (s *SQLiteStore) GetReferrerByID(userID int64) (*sheets.Referrer, error) {
+	ref, err := scanReferrer(s.db.QueryRow("SELECT "+referrerColumns+" FROM referrers WHERE id = ?", userID))
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения рефовода %d: %w", userID, err)
+	}
+	return ref, nil
+}
+
+// GetReferrers возвращает всех рефоводов по возрастанию ID
+func (s *SQLiteStore) GetReferrers() ([]sheets.Referrer, error) {
+	rows, err := s.db.Query("SELECT " + referrerColumns + " FROM referrers ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения рефоводов: %w", err)
+	}
+	defer rows.Close()
+
+	var referrers []sheets.Referrer
+	for rows.Next() {
+		var ref sheets.Referrer
+		if err := rows.Scan(&ref.ID, &ref.Username, &ref.Code, &ref.Wallet, &ref.RefCount, &ref.PendingPayout, &ref.PaidOut, &ref.Rate); err != nil {
+			return nil, fmt.Errorf("ошибка чтения рефоводов: %w", err)
+		}
+		referrers = append(referrers, ref)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка чтения рефоводов: %w", err)
+	}
+	return referrers, nil
+}
+
+// GetReferrerByCode получает рефовода по коду (без учета регистра и пробелов)
+func (s *SQLiteStore) GetReferrerByCode(code string) (*sheets.Referrer, error) {
+	ref, err := scanReferrer(s.db.QueryRow("SELECT "+referrerColumns+" FROM referrers WHERE code = ?", strings.TrimSpace(code)))
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения рефовода с кодом %s: %w", code, err)
+	}
+	return ref, nil
+}
+
+// CreateReferrer создает нового рефовода с уникальным кодом.
+// Если рефовод с таким ID уже есть, возвращает существующего.
+func (s *SQLiteStore) CreateReferrer(userID int64, username string) (*sheets.Referrer, error) {
+	const maxAttempts = 100
+
+	for i := 0; i < maxAttempts; i++ {
+		code, err := sheets.NewReferralCode()
+		if err != nil {
+			return nil, fmt.Errorf("ошибка генерации кода: %w", err)
+		}
+
+		ref, created, err := s.insertReferrer(userID, username, code)
+		if err != nil {
+			if isUniqueViolation(err) {
+				// Код уже занят, пробуем другой
+				continue
+			}
+			return nil, err
+		}
+
+		if created {
+			log.Printf("✅ Рефовод создан в SQLite: ID=%d, код=%s, username=%s", ref.ID, ref.Code, ref.Username)
+			s.mirrorReferrer(ref)
+		} else {
+			log.Printf("⚠️ Рефовод с ID %d уже существует (код: %s), возвращаем существующего", userID, ref.Code)
+		}
+		return ref, nil
+	}
+
+	return nil, fmt.Errorf("не удалось сгенерировать уникальный код после %d попыток", maxAttempts)
+}
+
+// insertReferrer в одной транзакции проверяет наличие рефовода и добавляет его
+func (s *SQLiteStore) insertReferrer(userID int64, username, code string) (*sheets.Referrer, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, false, fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback()
+
+	existing, err := scanReferrer(tx.QueryRow("SELECT "+referrerColumns+" FROM referrers WHERE id = ?", userID))
+	if err != nil {
+		return nil, false, fmt.Errorf("ошибка чтения рефовода %d: %w", userID, err)
+	}
+	if existing != nil {
+		return existing, false, nil
+	}
+
+	ref := &sheets.Referrer{ID: userID, Username: username, Code: code}
+	_, err = tx.Exec("INSERT INTO referrers (id, username, code) VALUES (?, ?, ?)", ref.ID, ref.Username, ref.Code)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, fmt.Errorf("ошибка сохранения рефовода: %w", err)
+	}
+	return ref, true, nil
+}
+
+// updateReferrerSQL сохраняет все поля рефовода, включая индивидуальную ставку
+const updateReferrerSQL = `UPDATE referrers
+	SET username = ?, code = ?, wallet = ?, ref_count = ?, pending_payout = ?, paid_out = ?, rate = ?
+	WHERE id = ?`
+
+// UpdateReferrer обновляет данные рефовода
+func (s *SQLiteStore) UpdateReferrer(ref *sheets.Referrer) error {
+	res, err := s.db.Exec(updateReferrerSQL,
+		ref.Username, ref.Code, ref.Wallet, ref.RefCount, ref.PendingPayout, ref.PaidOut, ref.Rate, ref.ID)
+	if err != nil {
+		return fmt.Errorf("ошибка обновления рефовода: %w", err)
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("рефовод не найден")
+	}
+
+	s.mirrorReferrer(ref)
+	return nil
+}
+
+// ModifyReferrer в одной транзакции читает рефовода, применяет fn и сохраняет результат
+func (s *SQLiteStore) ModifyReferrer(userID int64, fn func(ref *sheets.Referrer) error) (*sheets.Referrer, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback()
+
+	ref, err := scanReferrer(tx.QueryRow("SELECT "+referrerColumns+" FROM referrers WHERE id = ?", userID))
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения рефовода %d: %w", userID, err)
+	}
+	if ref == nil {
+		return nil, fmt.Errorf("рефовод %d не найден", userID)
+	}
+
+	if err := fn(ref); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(updateReferrerSQL,
+		ref.Username, ref.Code, ref.Wallet, ref.RefCount, ref.PendingPayout, ref.PaidOut, ref.Rate, ref.ID)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка обновления рефовода: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("ошибка сохранения рефовода: %w", err)
+	}
+
+	s.mirrorReferrer(ref)
+	return ref, nil
+}
+
+// IncrementRefCount атомарно увеличивает счетчик рефералов
+func (s *SQLiteStore) IncrementRefCount(refCode string) error {
+	code := strings.TrimSpace(refCode)
+	res, err := s.db.Exec("UPDATE referrers SET ref_count = ref_count + 1 WHERE code = ?", code)
+	if err != nil {
+		return fmt.Errorf("ошибка увеличения счетчика рефералов: %w", err)
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("рефовод с кодом %s не найден", refCode)
+	}
+
+	if s.mirror {
+		ref, err := s.GetReferrerByCode(code)
+		if err != nil {
+			log.Printf("Предупреждение: не удалось прочитать рефовода %s для зеркала: %v", code, err)
+		} else if ref != nil {
+			s.mirrorReferrer(ref)
+		}
+	}
+	return nil
+}
+
+// GetInvitedByUserID получает запись о приглашенном по ID пользователя
+func (s *SQLiteStore) GetInvitedByUserID(userID int64) (*sheets.Invited, error) {
+	invited := &sheets.Invited{}
+	var invitedAt string
+	err := s.db.QueryRow("SELECT user_id, ref_code, invited_at FROM invited WHERE user_id = ?", userID).
+		Scan(&invited.UserID, &invited.RefCode, &invitedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения приглашенного %d: %w", userID, err)
+	}
+	invited.InvitedAt = parseTime(invitedAt)
+	return invited, nil
+}
+
+// CreateInvited создает запись о приглашенном с датой приглашения
+func (s *SQLiteStore) CreateInvited(userID int64, refCode string) error {
+	_, err := s.db.Exec("INSERT INTO invited (user_id, ref_code, invited_at) VALUES (?, ?, ?)",
+		userID, refCode, formatTime(time.Now()))
+	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("пользователь %d: %w", userID, sheets.ErrAlreadyInvited)
+		}
+		return fmt.Errorf("ошибка добавления приглашенного: %w", err)
+	}
+
+	if s.mirror {
+		if err := s.sheets.CreateInvited(userID, refCode); err != nil {
+			log.Printf("Предупреждение: не удалось записать приглашенного %d в зеркало: %v", userID, err)
+		}
+	}
+	return nil
+}
+
+// GetNewWithdrawals читает лист Выводы, сохраняет сделки в базу
+// и возвращает те, по которым еще нет начисления. Без Google Таблицы
+// источником служит сама таблица withdrawals.
+func (s *SQLiteStore) GetNewWithdrawals() ([]sheets.Withdrawal, error) {
+	withdrawals, err := s.GetWithdrawals()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback()
+
+	newWithdrawals := []sheets.Withdrawal{}
+	for _, w := range withdrawals {
+		// Сторно и некорректные строки не сохраняются и не обрабатываются
+		if !w.Processable() {
+			continue
+		}
+
+		_, err := tx.Exec(`INSERT INTO withdrawals (deal_id, user_id, profit, deal_time) VALUES (?, ?, ?, ?)
+			ON CONFLICT (deal_id) DO UPDATE SET user_id = excluded.user_id, profit = excluded.profit,
+				deal_time = excluded.deal_time`,
+			w.DealID, w.UserID, w.Profit, formatTime(w.Date))
+		if err != nil {
+			return nil, fmt.Errorf("ошибка сохранения вывода %s: %w", w.DealID, err)
+		}
+
+		var exists bool
+		err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM referrals WHERE deal_id = ? AND level = 1)", w.DealID).Scan(&exists)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка проверки сделки %s: %w", w.DealID, err)
+		}
+		if !exists {
+			newWithdrawals = append(newWithdrawals, w)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("ошибка сохранения выводов: %w", err)
+	}
+
+	return newWithdrawals, nil
+}
+
+// GetWithdrawals возвращает все сделки листа Выводы. Если Google Таблица подключена,
+// источник - она, а не база: в базе остаются и сделки, которые из листа уже удалены.
+func (s *SQLiteStore) GetWithdrawals() ([]sheets.Withdrawal, error) {
+	if s.sheets != nil {
+		return s.sheets.GetWithdrawals()
+	}
+
+	rows, err := s.db.Query("SELECT deal_id, user_id, profit, deal_time FROM withdrawals ORDER BY rowid")
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения выводов: %w", err)
+	}
+	defer rows.Close()
+
+	var withdrawals []sheets.Withdrawal
+	for rows.Next() {
+		var w sheets.Withdrawal
+		var dealTime string
+		if err := rows.Scan(&w.DealID, &w.UserID, &w.Profit, &dealTime); err != nil {
+			return nil, fmt.Errorf("ошибка чтения выводов: %w", err)
+		}
+		w.Date = parseTime(dealTime)
+		withdrawals = append(withdrawals, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка чтения выводов: %w", err)
+	}
+	return withdrawals, nil
+}
+
+// GetReferrals возвращает все начисления по сделкам
+func (s *SQLiteStore) GetReferrals() ([]sheets.Referral, error) {
+	rows, err := s.db.Query(`SELECT ref_id, ref_code, profit, deal_id, bonus, date, rate, level
+		FROM referrals ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения начислений: %w", err)
+	}
+	defer rows.Close()
+
+	var referrals []sheets.Referral
+	for rows.Next() {
+		var r sheets.Referral
+		if err := rows.Scan(&r.RefID, &r.RefCode, &r.Profit, &r.DealID, &r.Bonus, &r.Date, &r.Rate, &r.Level); err != nil {
+			return nil, fmt.Errorf("ошибка чтения начислений: %w", err)
+		}
+		referrals = append(referrals, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка чтения начислений: %w", err)
+	}
+	return referrals, nil
+}
+
+// CreateReferral создает запись о начислении; повторная запись той же сделки отклоняется
+func (s *SQLiteStore) CreateReferral(ref *sheets.Referral) error {
+	_, err := s.db.Exec(`INSERT INTO referrals (ref_id, ref_code, profit, deal_id, bonus, date, rate, level)
+		VALUES (?, ?, ?, ?, ?, ?, ?, MAX(?, 1))`,
+		ref.RefID, ref.RefCode, ref.Profit, ref.DealID, ref.Bonus, ref.Date, ref.Rate, ref.Level)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("сделка %s уже обработана на уровне %d", ref.DealID, ref.Level)
+		}
+		return fmt.Errorf("ошибка добавления в Рефералы: %w", err)
+	}
+
+	if s.mirror {
+		if err := s.sheets.CreateReferral(ref); err != nil {
+			log.Printf("Предупреждение: не удалось записать сделку %s в зеркало: %v", ref.DealID, err)
+		}
+	}
+	return nil
+}
+
+// HasReferral сообщает, есть ли начисление по сделке на указанном уровне
+func (s *SQLiteStore) HasReferral(dealID string, level int) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM referrals WHERE deal_id = ? AND level = MAX(?, 1))",
+		dealID, level).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("ошибка проверки сделки %s: %w", dealID, err)
+	}
+	return exists, nil
+}
+
+// ReferredProfit возвращает суммарную прибыль прямых рефералов по начислениям с кодом refCode
+func (s *SQLiteStore) ReferredProfit(refCode string) (money.Amount, error) {
+	var profit money.Amount
+	err := s.db.QueryRow("SELECT COALESCE(SUM(profit), 0) FROM referrals WHERE ref_code = ? AND level = 1",
+		strings.TrimSpace(refCode)).Scan(&profit)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка расчета прибыли рефералов %s: %w", refCode, err)
+	}
+	return profit, nil
+}
+
+// UpdatePendingPayouts переносит в журнал недостающие начисления и выплаты и пересчитывает
+// "Ожидает выплаты" по журналу: начислено минус выплачено. Повторные запуски ничего не меняют.
+func (s *SQLiteStore) UpdatePendingPayouts() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback()
+
+	backfill, err := backfillLedger(tx)
+	if err != nil {
+		return err
+	}
+
+	balances, err := ledgerBalances(tx)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT id, pending_payout FROM referrers")
+	if err != nil {
+		return fmt.Errorf("ошибка расчета выплат: %w", err)
+	}
+
+	changed := make(map[int64]money.Amount)
+	for rows.Next() {
+		var id int64
+		var current money.Amount
+		if err := rows.Scan(&id, &current); err != nil {
+			rows.Close()
+			return fmt.Errorf("ошибка расчета выплат: %w", err)
+		}
+		if computed := balances[id].Pending(); current != computed {
+			changed[id] = computed
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("ошибка расчета выплат: %w", err)
+	}
+
+	for id, pending := range changed {
+		if _, err := tx.Exec("UPDATE referrers SET pending_payout = ? WHERE id = ?", pending, id); err != nil {
+			return fmt.Errorf("ошибка обновления выплат рефовода %d: %w", id, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("ошибка сохранения выплат: %w", err)
+	}
+
+	log.Printf("Перенесено в журнал записей: %d, обновлено рефоводов: %d", len(backfill), len(changed))
+
+	if s.mirror {
+		for _, entry := range backfill {
+			s.mirrorLedgerEntry(entry)
+		}
+		for id := range changed {
+			ref, err := s.GetReferrerByID(id)
+			if err != nil || ref == nil {
+				log.Printf("Предупреждение: не удалось прочитать рефовода %d для зеркала: %v", id, err)
+				continue
+			}
+			s.mirrorReferrer(ref)
+		}
+	}
+
+	return nil
+}
+
+// mirrorReferrer дублирует рефовода в Google Таблицу; ошибки зеркала не критичны
+func (s *SQLiteStore) mirrorReferrer(ref *sheets.Referrer) {
+	if !s.mirror {
+		return
+	}
+	if err := s.sheets.MirrorReferrer(ref); err != nil {
+		log.Printf("Предупреждение: не удалось записать рефовода %d в зеркало: %v", ref.ID, err)
+	}
+}
+
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+			sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+	return false
+}
+
+// formatTime - формат дат в базе; нулевое время хранится пустой строкой
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// parseTime разбирает дату из базы; пустая или некорректная строка - нулевое время
+func parseTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
@@ -0,0 +1,306 @@
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ss_ref_bot/money"
+	"ss_ref_bot/sheets"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// newTestStore открывает пустую базу во временном каталоге без Google Таблицы
+func newTestStore(t *testing.T) *SQLiteStore {
+	t.Helper()
+	s, err := NewSQLiteStore(filepath.Join(t.TempDir(), "bot.db"), nil, false)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestMirrorRequiresSheetsClient(t *testing.T) {
+	if _, err := NewSQLiteStore(filepath.Join(t.TempDir(), "bot.db"), nil, true); err == nil {
+		t.Fatal("зеркало без клиента Sheets должно быть ошибкой")
+	}
+}
+
+func TestCreateReferralIsIdempotent(t *testing.T) {
+	s := newTestStore(t)
+
+	ref := &sheets.Referral{RefID: 1001, RefCode: "ABC123", Profit: money.FromFloat(100), DealID: "D-1",
+		Bonus: money.FromFloat(10), Date: "01.01.2025 10:00", Rate: 10 * money.Percent(money.USDT), Level: 1}
+	if err := s.CreateReferral(ref); err != nil {
+		t.Fatalf("первое начисление: %v", err)
+	}
+	if err := s.CreateReferral(ref); err == nil {
+		t.Error("повторное начисление той же сделки должно быть отклонено")
+	}
+
+	// Та же сделка на втором уровне - отдельное начисление
+	level2 := *ref
+	level2.RefCode, level2.Bonus, level2.Level = "XYZ789", money.FromFloat(2), 2
+	if err := s.CreateReferral(&level2); err != nil {
+		t.Fatalf("начисление второго уровня: %v", err)
+	}
+
+	for _, tc := range []struct {
+		deal  string
+		level int
+		want  bool
+	}{
+		{"D-1", 1, true},
+		{"D-1", 0, true}, // уровень 0 в старых данных означает первый
+		{"D-1", 2, true},
+		{"D-1", 3, false},
+		{"D-2", 1, false},
+	} {
+		got, err := s.HasReferral(tc.deal, tc.level)
+		if err != nil {
+			t.Fatalf("HasReferral(%s, %d): %v", tc.deal, tc.level, err)
+		}
+		if got != tc.want {
+			t.Errorf("HasReferral(%s, %d) = %t, ожидалось %t", tc.deal, tc.level, got, tc.want)
+		}
+	}
+
+	referrals, err := s.GetReferrals()
+	if err != nil {
+		t.Fatalf("GetReferrals: %v", err)
+	}
+	if len(referrals) != 2 {
+		t.Fatalf("начислений %d, ожидалось 2", len(referrals))
+	}
+	if referrals[0].Bonus != money.FromFloat(10) || referrals[0].Rate != ref.Rate {
+		t.Errorf("начисление прочитано как %+v", referrals[0])
+	}
+}
+
+func TestReferredProfitCountsOnlyDirectReferrals(t *testing.T) {
+	s := newTestStore(t)
+
+	for _, r := range []sheets.Referral{
+		{RefID: 1, RefCode: "ABC123", Profit: money.FromFloat(100.25), DealID: "D-1", Level: 1},
+		{RefID: 2, RefCode: "ABC123", Profit: money.FromFloat(50.5), DealID: "D-2", Level: 1},
+		{RefID: 3, RefCode: "ABC123", Profit: money.FromFloat(1000), DealID: "D-3", Level: 2},
+		{RefID: 4, RefCode: "XYZ789", Profit: money.FromFloat(7), DealID: "D-4", Level: 1},
+	} {
+		if err := s.CreateReferral(&r); err != nil {
+			t.Fatalf("CreateReferral(%s): %v", r.DealID, err)
+		}
+	}
+
+	got, err := s.ReferredProfit(" ABC123 ")
+	if err != nil {
+		t.Fatalf("ReferredProfit: %v", err)
+	}
+	if got != money.FromFloat(150.75) {
+		t.Errorf("прибыль рефералов = %s, ожидалось 150.75", got)
+	}
+
+	if got, _ := s.ReferredProfit("NONE"); got != 0 {
+		t.Errorf("прибыль без начислений = %s, ожидалось 0", got)
+	}
+}
+
+func TestModifyReferrerPersistsAllFields(t *testing.T) {
+	s := newTestStore(t)
+
+	created, err := s.CreateReferrer(111, "@ref")
+	if err != nil {
+		t.Fatalf("CreateReferrer: %v", err)
+	}
+
+	rate := 12*money.Percent(money.USDT) + money.Percent(money.USDT)/2
+	_, err = s.ModifyReferrer(111, func(ref *sheets.Referrer) error {
+		ref.Wallet = "UQwallet"
+		ref.PendingPayout += money.FromFloat(12.5)
+		ref.Rate = rate
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ModifyReferrer: %v", err)
+	}
+
+	// Ошибка в fn откатывает изменения
+	_, err = s.ModifyReferrer(111, func(ref *sheets.Referrer) error {
+		ref.PendingPayout = 0
+		return errors.New("отказ")
+	})
+	if err == nil {
+		t.Fatal("ошибка fn должна возвращаться из ModifyReferrer")
+	}
+
+	got, err := s.GetReferrerByID(111)
+	if err != nil || got == nil {
+		t.Fatalf("GetReferrerByID: %v, %v", got, err)
+	}
+	if got.Code != created.Code || got.Wallet != "UQwallet" {
+		t.Errorf("рефовод прочитан как %+v", got)
+	}
+	if got.PendingPayout != money.FromFloat(12.5) {
+		t.Errorf("Ожидает выплаты = %s, ожидалось 12.50", got.PendingPayout)
+	}
+	if got.Rate != rate {
+		t.Errorf("ставка = %s, ожидалось 12.5", got.Rate)
+	}
+
+	// UpdateReferrer тоже сохраняет ставку
+	got.Rate = 0
+	if err := s.UpdateReferrer(got); err != nil {
+		t.Fatalf("UpdateReferrer: %v", err)
+	}
+	if got, _ := s.GetReferrerByID(111); got.Rate != 0 {
+		t.Errorf("ставка после UpdateReferrer = %s, ожидалось 0", got.Rate)
+	}
+
+	if _, err := s.ModifyReferrer(222, func(*sheets.Referrer) error { return nil }); err == nil {
+		t.Error("изменение несуществующего рефовода должно быть ошибкой")
+	}
+}
+
+func TestPayoutRequestLock(t *testing.T) {
+	s := newTestStore(t)
+
+	ref := &sheets.Referrer{ID: 111, Username: "@ref", Wallet: "UQwallet"}
+	first := sheets.NewPayoutRequest(ref, money.FromFloat(25))
+	if err := s.CreatePayoutRequest(&first); err != nil {
+		t.Fatalf("первая заявка: %v", err)
+	}
+
+	second := sheets.NewPayoutRequest(ref, money.FromFloat(5))
+	if err := s.CreatePayoutRequest(&second); !errors.Is(err, sheets.ErrPayoutRequestOpen) {
+		t.Fatalf("вторая открытая заявка: %v, ожидалось ErrPayoutRequestOpen", err)
+	}
+
+	open, err := s.OpenPayoutRequest(111)
+	if err != nil || open == nil || open.ID != first.ID {
+		t.Fatalf("OpenPayoutRequest = %+v, %v; ожидалась %s", open, err, first.ID)
+	}
+
+	resolved, err := s.ResolvePayoutRequest(first.ID, sheets.PayoutApproved, "@admin", "")
+	if err != nil {
+		t.Fatalf("ResolvePayoutRequest: %v", err)
+	}
+	if resolved.Status != sheets.PayoutApproved || resolved.ReviewedBy != "@admin" {
+		t.Errorf("заявка после одобрения: %+v", resolved)
+	}
+
+	// Повторное решение по той же заявке отклоняется
+	if _, err := s.ResolvePayoutRequest(first.ID, sheets.PayoutRejected, "@other", "дубль"); !errors.Is(err, sheets.ErrPayoutRequestResolved) {
+		t.Errorf("повторное решение: %v, ожидалось ErrPayoutRequestResolved", err)
+	}
+
+	// После решения можно подать новую заявку
+	if err := s.CreatePayoutRequest(&second); err != nil {
+		t.Fatalf("заявка после решения предыдущей: %v", err)
+	}
+	if open, _ := s.OpenPayoutRequest(111); open == nil || open.ID != second.ID {
+		t.Errorf("открытая заявка %+v, ожидалась %s", open, second.ID)
+	}
+}
+
+func TestWithdrawalsWithoutSheets(t *testing.T) {
+	s := newTestStore(t)
+
+	if _, err := s.db.Exec(`INSERT INTO withdrawals (deal_id, user_id, profit, deal_time) VALUES
+		('D-1', 1001, 25500000, ''), ('D-2', 1002, 10000000, '2025-03-05T14:30:00Z')`); err != nil {
+		t.Fatalf("заполнение withdrawals: %v", err)
+	}
+	if err := s.CreateReferral(&sheets.Referral{RefID: 1001, RefCode: "ABC123", DealID: "D-1", Level: 1}); err != nil {
+		t.Fatalf("CreateReferral: %v", err)
+	}
+
+	all, err := s.GetWithdrawals()
+	if err != nil {
+		t.Fatalf("GetWithdrawals: %v", err)
+	}
+	if len(all) != 2 || all[0].Profit != money.FromFloat(25.5) {
+		t.Errorf("выводы: %+v", all)
+	}
+
+	fresh, err := s.GetNewWithdrawals()
+	if err != nil {
+		t.Fatalf("GetNewWithdrawals: %v", err)
+	}
+	if len(fresh) != 1 || fresh[0].DealID != "D-2" || fresh[0].UserID != 1002 {
+		t.Fatalf("новые выводы: %+v, ожидалась только D-2", fresh)
+	}
+	if want := time.Date(2025, 3, 5, 14, 30, 0, 0, time.UTC); !fresh[0].Date.Equal(want) {
+		t.Errorf("дата сделки D-2 = %v, ожидалось %v", fresh[0].Date, want)
+	}
+	if !all[0].Date.IsZero() {
+		t.Errorf("дата сделки D-1 = %v, ожидалась неизвестная", all[0].Date)
+	}
+}
+
+func TestMoneyColumnsMigrateFromReal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.db")
+
+	// База старой версии: суммы в USDT в колонках REAL, сделка уникальна без уровня
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE referrers (id INTEGER PRIMARY KEY, username TEXT NOT NULL DEFAULT '',
+			code TEXT NOT NULL COLLATE NOCASE, wallet TEXT NOT NULL DEFAULT '', ref_count INTEGER NOT NULL DEFAULT 0,
+			pending_payout REAL NOT NULL DEFAULT 0, paid_out REAL NOT NULL DEFAULT 0, UNIQUE (code))`,
+		`CREATE TABLE referrals (id INTEGER PRIMARY KEY AUTOINCREMENT, ref_id INTEGER NOT NULL,
+			ref_code TEXT NOT NULL COLLATE NOCASE, profit REAL NOT NULL, deal_id TEXT NOT NULL,
+			bonus REAL NOT NULL, date TEXT NOT NULL DEFAULT '', UNIQUE (deal_id))`,
+		`INSERT INTO referrers (id, username, code, pending_payout, paid_out) VALUES (111, '@ref', 'ABC123', 0.3, 12.345678)`,
+		`INSERT INTO referrals (ref_id, ref_code, profit, deal_id, bonus) VALUES
+			(1001, 'ABC123', 0.1, 'D-1', 0.01), (1002, 'ABC123', 0.2, 'D-2', 0.02)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("старая схема: %v", err)
+		}
+	}
+	db.Close()
+
+	s, err := NewSQLiteStore(path, nil, false)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	defer s.Close()
+
+	var columnType string
+	if err := s.db.QueryRow("SELECT type FROM pragma_table_info('referrals') WHERE name = 'profit'").Scan(&columnType); err != nil || columnType != "INTEGER" {
+		t.Errorf("тип referrals.profit = %q, %v; ожидался INTEGER", columnType, err)
+	}
+	var stored int64
+	if err := s.db.QueryRow("SELECT paid_out FROM referrers WHERE id = 111").Scan(&stored); err != nil || stored != 12345678 {
+		t.Errorf("referrers.paid_out = %d, %v; ожидалось 12345678 микро-USDT", stored, err)
+	}
+
+	ref, err := s.GetReferrerByID(111)
+	if err != nil || ref == nil {
+		t.Fatalf("GetReferrerByID: %v, %v", ref, err)
+	}
+	if ref.PendingPayout != money.FromFloat(0.3) || ref.PaidOut != money.FromFloat(12.345678) {
+		t.Errorf("рефовод после миграции: %s/%s, ожидалось 0.30/12.345678", ref.PendingPayout, ref.PaidOut)
+	}
+
+	// SUM по целым числам точный: 0.1 + 0.2 = 0.3 без ошибки округления
+	profit, err := s.ReferredProfit("ABC123")
+	if err != nil || profit != money.FromFloat(0.3) {
+		t.Errorf("ReferredProfit = %s, %v; ожидалось 0.30", profit, err)
+	}
+
+	// Ключ сделки тоже обновлен: второй уровень той же сделки принимается
+	if err := s.CreateReferral(&sheets.Referral{RefID: 1001, RefCode: "XYZ789", DealID: "D-1", Level: 2}); err != nil {
+		t.Errorf("начисление второго уровня после миграции: %v", err)
+	}
+}